@@ -1,6 +1,7 @@
 package jvproxy
 
 import (
+	"net/http"
 	"strconv"
 	"time"
 
@@ -8,7 +9,7 @@ import (
 	"github.com/seehuhn/jvproxy/cache"
 )
 
-func (proxy *Proxy) getFreshnessLifetime(entry *cache.Entry) time.Duration {
+func (proxy *Proxy) getFreshnessLifetime(req *http.Request, entry *cache.Entry) time.Duration {
 	// see http://tools.ietf.org/html/rfc7234#section-4.2.1
 	res := -3600 * 24 * 365 * time.Second
 	cc, _ := parseHeaders(entry.Header["Cache-Control"])
@@ -31,6 +32,8 @@ func (proxy *Proxy) getFreshnessLifetime(entry *cache.Entry) time.Duration {
 				res = a.Sub(b)
 			}
 		}
+	} else if lifetime, ok := proxy.getHeuristicLifetime(req, entry); ok {
+		res = lifetime
 	}
 	return res
 }
@@ -59,3 +62,139 @@ func (proxy *Proxy) getCurrentAge(entry *cache.Entry) time.Duration {
 
 	return res
 }
+
+// forbidsStale checks whether the cached response `entry` carries a
+// must-revalidate directive, or (for shared caches) a proxy-revalidate
+// or s-maxage directive.  Such responses must not be used after they
+// have become stale, without successful validation (RFC 7234,
+// sections 5.2.2.1, 5.2.2.7 and 5.2.2.9).
+func (proxy *Proxy) forbidsStale(entry *cache.Entry) bool {
+	cc, _ := parseHeaders(entry.Header["Cache-Control"])
+	if _, hasMustRevalidate := cc["must-revalidate"]; hasMustRevalidate {
+		return true
+	}
+	if !proxy.shared {
+		return false
+	}
+	_, hasProxyRevalidate := cc["proxy-revalidate"]
+	_, hasSMaxAge := cc["s-maxage"]
+	return hasProxyRevalidate || hasSMaxAge
+}
+
+// requiresValidation checks whether the cached response `entry`
+// carries a no-cache directive without field names.  Such responses
+// must be validated every time before they are used (RFC 7234,
+// section 5.2.2.2).
+func requiresValidation(entry *cache.Entry) bool {
+	cc, _ := parseHeaders(entry.Header["Cache-Control"])
+	val, hasNoCache := cc["no-cache"]
+	return hasNoCache && val == ""
+}
+
+// canServeStaleOnError checks whether `entry` may be used in place of
+// an upstream error response.  This is allowed, if either the request
+// or the cached response carries a stale-if-error directive and the
+// response has not been stale for longer than the given number of
+// seconds (RFC 5861, section 4).
+func (proxy *Proxy) canServeStaleOnError(req *http.Request, entry *cache.Entry) bool {
+	if proxy.forbidsStale(entry) || requiresValidation(entry) {
+		return false
+	}
+	staleness := proxy.getCurrentAge(entry) - proxy.getFreshnessLifetime(req, entry)
+	for _, header := range []http.Header{req.Header, entry.Header} {
+		cc, _ := parseHeaders(header["Cache-Control"])
+		if val, ok := cc["stale-if-error"]; ok {
+			sec, err := strconv.Atoi(val)
+			if err == nil && staleness <= time.Duration(sec)*time.Second {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// canServeStaleWhileRevalidate checks whether the stale response
+// `entry` may be served while it is being revalidated in the
+// background.  This is allowed, if the cached response carries a
+// stale-while-revalidate directive and the response has not been
+// stale for longer than the given number of seconds (RFC 5861,
+// section 3).  Request directives which ask for a fresher response
+// take precedence.
+func (proxy *Proxy) canServeStaleWhileRevalidate(req *http.Request, entry *cache.Entry, info *decision) bool {
+	if info.mustRevalidate || info.minFresh > 0 {
+		return false
+	}
+	if info.maxAge >= 0 && proxy.getCurrentAge(entry) > info.maxAge {
+		return false
+	}
+	if proxy.forbidsStale(entry) || requiresValidation(entry) {
+		return false
+	}
+	cc, _ := parseHeaders(entry.Header["Cache-Control"])
+	val, ok := cc["stale-while-revalidate"]
+	if !ok {
+		return false
+	}
+	sec, err := strconv.Atoi(val)
+	if err != nil {
+		return false
+	}
+	staleness := proxy.getCurrentAge(entry) - proxy.getFreshnessLifetime(req, entry)
+	return staleness <= time.Duration(sec)*time.Second
+}
+
+// parseDeltaSeconds parses the argument of a Cache-Control directive
+// which specifies a number of seconds (RFC 7234, section 1.2.1).
+func parseDeltaSeconds(val string) (time.Duration, bool) {
+	sec, err := strconv.Atoi(val)
+	if err != nil || sec < 0 {
+		return 0, false
+	}
+	return time.Duration(sec) * time.Second, true
+}
+
+// freshness describes whether a cached response can be used to satisfy
+// a request without contacting the upstream server.
+type freshness int
+
+const (
+	isFresh      freshness = iota // the response can be used
+	isStale                       // the response must be validated
+	staleAllowed                  // stale, but accepted by the client
+)
+
+// checkFreshness decides whether the cached response `entry` can be
+// used, taking into account the request directives max-age, min-fresh
+// and max-stale (RFC 7234, section 5.2.1), as well as the response
+// directives no-cache, must-revalidate and proxy-revalidate (RFC
+// 7234, section 5.2.2).  If one of these directives decided the
+// outcome, the second return value gives the directive for use in the
+// log.
+func (proxy *Proxy) checkFreshness(req *http.Request, entry *cache.Entry, info *decision) (freshness, string) {
+	if requiresValidation(entry) {
+		return isStale, "resp:CC=NC"
+	}
+
+	freshnessLifetime := proxy.getFreshnessLifetime(req, entry)
+	currentAge := proxy.getCurrentAge(entry)
+
+	if info.maxAge >= 0 && currentAge > info.maxAge {
+		return isStale, "req:CC=MA"
+	}
+	if info.minFresh > 0 {
+		if freshnessLifetime-currentAge < info.minFresh {
+			return isStale, "req:CC=MF"
+		}
+		return isFresh, ""
+	}
+	if freshnessLifetime > currentAge {
+		return isFresh, ""
+	}
+	if info.maxStale >= 0 && currentAge-freshnessLifetime <= info.maxStale {
+		if proxy.forbidsStale(entry) {
+			return isStale, "resp:CC=MR"
+		}
+		return staleAllowed, "req:CC=MS"
+	}
+	return isStale, ""
+}
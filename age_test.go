@@ -0,0 +1,77 @@
+package jvproxy
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/seehuhn/jvproxy/cache"
+	. "gopkg.in/check.v1"
+)
+
+func (s *MySuite) TestCheckFreshness(c *C) {
+	proxy := NewProxy("test", failingUpstream, &cache.NullCache{}, true)
+	defer proxy.Close()
+
+	for _, test := range []struct {
+		reqCC  string
+		age    time.Duration
+		state  freshness
+		reason string
+	}{
+		{"", 30 * time.Second, isFresh, ""},
+		{"", 90 * time.Second, isStale, ""},
+		{"max-age=10", 30 * time.Second, isStale, "req:CC=MA"},
+		{"max-age=40", 30 * time.Second, isFresh, ""},
+		{"min-fresh=20", 30 * time.Second, isFresh, ""},
+		{"min-fresh=40", 30 * time.Second, isStale, "req:CC=MF"},
+		{"max-stale=60", 90 * time.Second, staleAllowed, "req:CC=MS"},
+		{"max-stale=10", 90 * time.Second, isStale, ""},
+		{"max-stale", 24 * time.Hour, staleAllowed, "req:CC=MS"},
+		{"max-stale, max-age=60", 90 * time.Second, isStale, "req:CC=MA"},
+	} {
+		req, _ := http.NewRequest("GET", "http://example.com/", nil)
+		req.Header.Set("Cache-Control", test.reqCC)
+		info := proxy.getCacheability(req)
+		entry := newStaleEntry("max-age=60", test.age)
+		state, reason := proxy.checkFreshness(req, entry, info)
+		comment := Commentf("%q", test.reqCC)
+		c.Check(state, Equals, test.state, comment)
+		c.Check(reason, Equals, test.reason, comment)
+	}
+}
+
+func (s *MySuite) TestResponseDirectives(c *C) {
+	proxy := NewProxy("test", failingUpstream, &cache.NullCache{}, true)
+	defer proxy.Close()
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	req.Header.Set("Cache-Control", "max-stale=3600, stale-if-error=3600")
+	info := proxy.getCacheability(req)
+
+	entry := newStaleEntry("max-age=600, no-cache", time.Minute)
+	state, reason := proxy.checkFreshness(req, entry, info)
+	c.Check(state, Equals, isStale)
+	c.Check(reason, Equals, "resp:CC=NC")
+
+	entry = newStaleEntry("max-age=600, no-cache=\"Set-Cookie\"", time.Minute)
+	state, _ = proxy.checkFreshness(req, entry, info)
+	c.Check(state, Equals, isFresh)
+
+	for _, cc := range []string{
+		"max-age=60, must-revalidate",
+		"max-age=60, proxy-revalidate",
+		"s-maxage=60",
+	} {
+		entry = newStaleEntry(cc, 2*time.Minute)
+		state, reason = proxy.checkFreshness(req, entry, info)
+		c.Check(state, Equals, isStale, Commentf("%s", cc))
+		c.Check(reason, Equals, "resp:CC=MR", Commentf("%s", cc))
+
+		res := proxy.requestFromUpstream(req, []*cache.Entry{entry})
+		c.Check(res.Source, Equals, "error", Commentf("%s", cc))
+		c.Check(res.StatusCode, Equals, http.StatusGatewayTimeout, Commentf("%s", cc))
+	}
+
+	entry = newStaleEntry("max-age=60", 2*time.Minute)
+	res := proxy.requestFromUpstream(req, []*cache.Entry{entry})
+	c.Check(res.Source, Equals, "stale")
+}
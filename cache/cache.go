@@ -18,6 +18,22 @@ type Cache interface {
 	// returned StoreCont object.
 	StoreStart(url string, meta *MetaData) StoreCont
 
+	// StorePartial initiates the process of storing part of a
+	// response body, as received in a 206 (Partial Content) response.
+	// `meta` must describe the complete response, `offset` gives the
+	// position of the first byte of the part within the complete
+	// body, and `total` is the length of the complete body.  The
+	// data is delivered to the returned StoreCont object.  Once all
+	// parts of a body have been committed, the parts are combined
+	// into a complete cache entry (RFC 7233, section 4.3).
+	StorePartial(url string, meta *MetaData, offset, total int64) StoreCont
+
+	// Invalidate removes all stored responses for the given URL,
+	// including all variants selected by the Vary header field.  This
+	// is used after a request with an unsafe method has changed the
+	// state of the origin server (RFC 7234, section 4.4).
+	Invalidate(url string)
+
 	// Update exists the metadata of an existing cache entry.
 	Update(url string, entry *Entry)
 
@@ -29,19 +45,42 @@ type Cache interface {
 
 // MetaData describes the metadata of a HTTP response for use in a
 // caching proxy.
+//
+// VaryHeader holds the request header fields nominated by the Vary
+// header field of the response, as sent in the request which obtained
+// the response (see the VaryHeader function).  These select the
+// variant under which the response is stored.  If VaryHeader is nil,
+// the values are taken from Header instead.
 type MetaData struct {
 	StatusCode    int
 	Header        http.Header
 	ResponseTime  time.Time
 	ResponseDelay time.Duration
+	VaryHeader    http.Header
 }
 
 // Entry describes a stored HTTP response for use in a caching proxy.
+// For complete bodies stored in the cache, the reader returned by
+// GetBody also implements io.Seeker, to allow serving byte ranges
+// from the body.
+//
+// If the body is stored compressed, Encoding gives the content-coding
+// used, and GetEncodedBody returns the compressed bytes; GetBody
+// always returns the uncompressed body.  GetEncodedBody is nil if the
+// compressed bytes cannot be sent to clients directly.
+//
+// Dropped is set if only the metadata of the response is kept, because
+// the body was removed after the response expired.  For such entries,
+// GetBody returns nil.
 type Entry struct {
 	MetaData
 	GetBody func() io.ReadCloser
 	CacheID []byte
 	Source  string
+	Dropped bool
+
+	Encoding       string
+	GetEncodedBody func() io.ReadCloser
 }
 
 // StoreCont objects are used to store a response body in the cache,
@@ -66,3 +105,14 @@ type StoreCont interface {
 	// discarded.
 	Discard()
 }
+
+// StoreFollower is implemented by StoreCont objects which allow the
+// response body to be read while it is being stored.
+type StoreFollower interface {
+	// Follow returns a reader for the body, which blocks when it
+	// catches up with the data stored so far.  At the end of the
+	// body, the reader returns io.EOF after Commit, or ErrIncomplete
+	// after Discard.  If the body can no longer be read, for example
+	// because it was discarded in the meantime, nil is returned.
+	Follow() io.ReadCloser
+}
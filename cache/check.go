@@ -0,0 +1,524 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/seehuhn/jvproxy/cache/pb"
+	"github.com/seehuhn/trace"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"golang.org/x/crypto/sha3"
+)
+
+// A CheckReport describes the problems found by Check.  File names
+// are given relative to the cache directory, metadata records are
+// identified by their URL.
+type CheckReport struct {
+	ContentFiles int
+	ContentBytes int64
+	MetaRecords  int
+	IndexEntries int
+	PartialFiles int
+
+	// Corrupt lists the content files where the content does not
+	// match the hash given by the file name.
+	Corrupt []string
+
+	// Malformed lists the files in the content directories which
+	// are not named after a hash.
+	Malformed []string
+
+	// BadMeta lists the metadata records which cannot be decoded.
+	BadMeta []string
+
+	// MissingContent lists the metadata records which refer to
+	// content not present in the cache.  Records where the content
+	// was deliberately removed by the sweep for expired data are
+	// not listed here, but counted in Dropped.
+	MissingContent []string
+	Dropped        int
+
+	// OldMeta counts the metadata records where the key or the
+	// value is stored in an older format.  These are converted when
+	// repairing, and when the cache is opened.
+	OldMeta int
+
+	// Unreferenced lists the content files which are not used by
+	// any metadata record.
+	Unreferenced []string
+
+	// IndexMismatch counts the index entries which are missing,
+	// superfluous or have the wrong size.
+	IndexMismatch int
+
+	// StaleNew lists the temporary files left in the "new"
+	// directory.
+	StaleNew []string
+
+	// BadPartial lists the files in the "partial" directory where
+	// either the sparse file or the list of ranges is missing, or
+	// where the list of ranges cannot be decoded.
+	BadPartial []string
+
+	// Repaired is set if the problems listed above have been
+	// fixed.
+	Repaired bool
+}
+
+// OK returns true if no problems were found.
+func (r *CheckReport) OK() bool {
+	return len(r.Corrupt) == 0 && len(r.Malformed) == 0 &&
+		len(r.BadMeta) == 0 && len(r.MissingContent) == 0 &&
+		len(r.Unreferenced) == 0 && r.IndexMismatch == 0 &&
+		len(r.StaleNew) == 0 && len(r.BadPartial) == 0
+}
+
+func (r *CheckReport) String() string {
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "%d content files (%s), %d metadata records, %d index entries, %d incomplete bodies\n",
+		r.ContentFiles, byteSize(r.ContentBytes), r.MetaRecords, r.IndexEntries,
+		r.PartialFiles)
+	list := func(title string, items []string) {
+		if len(items) == 0 {
+			return
+		}
+		fmt.Fprintf(buf, "%s: %d\n", title, len(items))
+		for _, item := range items {
+			fmt.Fprintf(buf, "  %s\n", item)
+		}
+	}
+	list("corrupt content files", r.Corrupt)
+	list("malformed content file names", r.Malformed)
+	list("undecodable metadata records", r.BadMeta)
+	list("metadata records with missing content", r.MissingContent)
+	list("unreferenced content files", r.Unreferenced)
+	list("stale temporary files", r.StaleNew)
+	list("broken incomplete bodies", r.BadPartial)
+	if r.Dropped > 0 {
+		fmt.Fprintf(buf, "metadata records for expired content: %d\n", r.Dropped)
+	}
+	if r.OldMeta > 0 {
+		fmt.Fprintf(buf, "metadata records in old format: %d\n", r.OldMeta)
+	}
+	if r.IndexMismatch > 0 {
+		fmt.Fprintf(buf, "index entries missing or wrong: %d\n", r.IndexMismatch)
+	}
+	switch {
+	case r.OK():
+		buf.WriteString("no problems found\n")
+	case r.Repaired:
+		buf.WriteString("all problems have been repaired\n")
+	default:
+		buf.WriteString("problems found, not repaired\n")
+	}
+	return buf.String()
+}
+
+// Check verifies the consistency of the LevelDB cache in `baseDir`:
+// the names of all content files are compared to the SHAKE128 hashes
+// of their contents, the metadata records are checked for missing
+// content, and the content files for missing references.  If
+// `repair` is true, broken content files and metadata records are
+// removed, the index is rebuilt from the remaining content, and
+// temporary files left over from interrupted downloads as well as
+// broken incomplete bodies are deleted.
+// The cache must not be in use while Check runs.
+func Check(baseDir string, repair bool) (*CheckReport, error) {
+	fi, err := os.Stat(baseDir)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return nil, errors.New("cache: " + baseDir + " is not a directory")
+	}
+
+	dbOpts := &opt.Options{ErrorIfMissing: true}
+	meta, err := leveldb.OpenFile(filepath.Join(baseDir, metaDirName), dbOpts)
+	if err != nil {
+		return nil, err
+	}
+	defer meta.Close()
+	index, err := leveldb.OpenFile(filepath.Join(baseDir, indexDirName), dbOpts)
+	if err != nil {
+		return nil, err
+	}
+	defer index.Close()
+
+	c := &checker{
+		cache: &ldbCache{
+			baseDir: baseDir,
+			newDir:  filepath.Join(baseDir, newDirName),
+			index:   index,
+			meta:    meta,
+		},
+		repair:  repair,
+		report:  &CheckReport{},
+		content: make(map[string]*pb.Entry),
+		old:     make(map[string]*pb.Entry),
+	}
+	steps := []func() error{
+		c.readIndex,
+		c.checkContent,
+		c.checkMeta,
+		c.checkUnreferenced,
+		c.rebuildIndex,
+		c.checkNew,
+		c.checkPartial,
+	}
+	for _, step := range steps {
+		err = step()
+		if err != nil {
+			return nil, err
+		}
+	}
+	c.report.Repaired = repair
+	return c.report, nil
+}
+
+type checker struct {
+	cache  *ldbCache
+	repair bool
+	report *CheckReport
+
+	// content maps the hashes of all valid content files to new
+	// index entries.
+	content map[string]*pb.Entry
+
+	// old contains the entries of the existing index.
+	old map[string]*pb.Entry
+
+	// referenced counts the metadata records using each hash.
+	referenced map[string]int32
+}
+
+func (c *checker) remove(fname string) {
+	if !c.repair {
+		return
+	}
+	err := os.Remove(fname)
+	if err != nil {
+		trace.T("jvproxy/cache", trace.PrioError,
+			"cannot remove %s: %s", fname, err.Error())
+	}
+}
+
+// checkContent re-hashes all content files.  Compressed content is
+// decompressed first, using the content-coding recorded in the index.
+// If the index has no entry for a file, all codecs are tried.
+func (c *checker) checkContent() error {
+	for i := 0; i < 256; i++ {
+		part := fmt.Sprintf("%02x", i)
+		dir := filepath.Join(c.cache.baseDir, part)
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, fi := range files {
+			rel := filepath.Join(part, fi.Name())
+			fname := filepath.Join(dir, fi.Name())
+			hash, err := hex.DecodeString(part + fi.Name())
+			if err != nil || len(hash) != hashLen || !fi.Mode().IsRegular() {
+				c.report.Malformed = append(c.report.Malformed, rel)
+				c.remove(fname)
+				continue
+			}
+
+			old := c.old[string(hash)]
+			encoding := old.GetEncoding()
+			ok, size, err := hasHash(fname, hash, encoding)
+			for _, name := range Codecs() {
+				if ok || err != nil || old != nil {
+					break
+				}
+				encoding = name
+				ok, size, err = hasHash(fname, hash, encoding)
+			}
+			if err != nil {
+				return err
+			}
+			if !ok {
+				c.report.Corrupt = append(c.report.Corrupt, rel)
+				c.remove(fname)
+				continue
+			}
+
+			c.report.ContentFiles++
+			c.report.ContentBytes += fi.Size()
+			useTime := fi.ModTime().Unix()
+			data := &pb.Entry{
+				FirstUsed:   proto.Int64(useTime),
+				LastUsed:    proto.Int64(useTime),
+				Size:        proto.Int64(fi.Size()),
+				UseCount:    proto.Int32(1),
+				ContentSize: proto.Int64(size),
+			}
+			if encoding != "" {
+				data.Encoding = proto.String(encoding)
+			}
+			c.content[string(hash)] = data
+		}
+	}
+	return nil
+}
+
+// hasHash checks whether the SHAKE128 hash of the contents of `fname`
+// equals `hash`.  If `encoding` is not empty, the contents are
+// decompressed before hashing, and data which cannot be decompressed
+// is reported as not matching.  The second return value is the size
+// of the (uncompressed) contents.
+func hasHash(fname string, hash []byte, encoding string) (bool, int64, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return false, 0, err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if encoding != "" {
+		codec, err := getCodec(encoding)
+		if err != nil {
+			return false, 0, nil
+		}
+		dec, err := codec.NewReader(f)
+		if err != nil {
+			return false, 0, nil
+		}
+		defer dec.Close()
+		r = dec
+	}
+	h := sha3.NewShake128()
+	n, err := io.Copy(h, r)
+	if err != nil {
+		if encoding != "" {
+			return false, 0, nil
+		}
+		return false, 0, err
+	}
+	sum := make([]byte, hashLen)
+	h.Read(sum)
+	return bytes.Equal(sum, hash), n, nil
+}
+
+// readIndex reads the existing index, so that the usage information
+// can be carried over to the rebuilt index.
+func (c *checker) readIndex() error {
+	iter := c.cache.index.NewIterator(nil, nil)
+	defer iter.Release()
+	for iter.Next() {
+		c.report.IndexEntries++
+		data := &pb.Entry{}
+		err := proto.Unmarshal(iter.Value(), data)
+		if err != nil {
+			c.report.IndexMismatch++
+			continue
+		}
+		c.old[string(iter.Key())] = data
+	}
+	return iter.Error()
+}
+
+// checkMeta checks that all metadata records refer to existing content.
+func (c *checker) checkMeta() error {
+	c.referenced = make(map[string]int32)
+	batch := new(leveldb.Batch)
+	iter := c.cache.meta.NewIterator(nil, nil)
+	for iter.Next() {
+		c.report.MetaRecords++
+		key := append([]byte{}, iter.Key()...)
+		url, _, _, err := keyToURL(key)
+		newKey := key
+		if err != nil {
+			url, _, _, err = keyToURLV1(key)
+			newKey = convertKey(key)
+		}
+		if err != nil {
+			c.report.BadMeta = append(c.report.BadMeta, fmt.Sprintf("%q", key))
+			batch.Delete(key)
+			continue
+		}
+
+		record, current := parseMetaRecord(iter.Value())
+		if record == nil {
+			c.report.BadMeta = append(c.report.BadMeta, url)
+			batch.Delete(key)
+			continue
+		}
+
+		hash := string(record.ContentHash)
+		data, ok := c.content[hash]
+		if !ok {
+			old := c.old[hash]
+			if old == nil || !old.GetDropped() {
+				c.report.MissingContent = append(c.report.MissingContent, url)
+				batch.Delete(key)
+				continue
+			}
+			c.report.Dropped++
+		} else {
+			setExpiry(data, getExpiry(metaDataFromPB(record)))
+		}
+		c.referenced[hash]++
+
+		// Records in an older format are converted.
+		if !current || !bytes.Equal(newKey, key) {
+			c.report.OldMeta++
+			raw, err := proto.Marshal(record)
+			if err != nil {
+				panic(err)
+			}
+			batch.Delete(key)
+			batch.Put(newKey, raw)
+		}
+	}
+	iter.Release()
+	err := iter.Error()
+	if err != nil || !c.repair {
+		return err
+	}
+	return c.cache.meta.Write(batch, nil)
+}
+
+// checkUnreferenced finds content files which are not used by any
+// metadata record.
+func (c *checker) checkUnreferenced() error {
+	for hash := range c.content {
+		if c.referenced[hash] > 0 {
+			continue
+		}
+		fname := c.cache.getStoreName([]byte(hash))
+		rel, _ := filepath.Rel(c.cache.baseDir, fname)
+		c.report.Unreferenced = append(c.report.Unreferenced, rel)
+		c.remove(fname)
+		delete(c.content, hash)
+	}
+	sort.Strings(c.report.Unreferenced)
+	return nil
+}
+
+// rebuildIndex compares the index to the content found on disk, and
+// if repairs are requested, replaces the index with entries for the
+// valid content files.  Usage information is carried over from the
+// old index where possible.  Reference counts are recorded, but not
+// compared, since the cache recounts the references when it is
+// opened.
+func (c *checker) rebuildIndex() error {
+	for hash, data := range c.content {
+		data.RefCount = proto.Int32(c.referenced[hash])
+		old := c.old[hash]
+		if old == nil || old.GetSize() != data.GetSize() ||
+			old.GetEncoding() != data.GetEncoding() || old.GetDropped() {
+			c.report.IndexMismatch++
+			continue
+		}
+		data.FirstUsed = proto.Int64(old.GetFirstUsed())
+		data.LastUsed = proto.Int64(old.GetLastUsed())
+		data.UseCount = proto.Int32(old.GetUseCount())
+		data.Generation = old.Generation
+	}
+	for hash, old := range c.old {
+		_, ok := c.content[hash]
+		if !ok && !(old.GetDropped() && c.referenced[hash] > 0) {
+			c.report.IndexMismatch++
+		}
+	}
+	if !c.repair {
+		return nil
+	}
+
+	batch := new(leveldb.Batch)
+	iter := c.cache.index.NewIterator(nil, nil)
+	for iter.Next() {
+		batch.Delete(append([]byte{}, iter.Key()...))
+	}
+	iter.Release()
+	err := iter.Error()
+	if err != nil {
+		return err
+	}
+	for hash, old := range c.old {
+		if old.GetDropped() && c.referenced[hash] > 0 {
+			old.RefCount = proto.Int32(c.referenced[hash])
+			c.content[hash] = old
+		}
+	}
+	for hash, data := range c.content {
+		raw, err := proto.Marshal(data)
+		if err != nil {
+			panic(err)
+		}
+		batch.Put([]byte(hash), raw)
+	}
+	return c.cache.index.Write(batch, nil)
+}
+
+// checkNew finds temporary files left over from interrupted
+// downloads.  Since the cache is not in use, all these files are
+// stale.
+func (c *checker) checkNew() error {
+	files, err := ioutil.ReadDir(c.cache.newDir)
+	if err != nil {
+		return err
+	}
+	for _, fi := range files {
+		c.report.StaleNew = append(c.report.StaleNew,
+			filepath.Join(newDirName, fi.Name()))
+		c.remove(filepath.Join(c.cache.newDir, fi.Name()))
+	}
+	return nil
+}
+
+// checkPartial verifies that each sparse file in the "partial"
+// directory comes with a valid list of ranges, and vice versa.
+func (c *checker) checkPartial() error {
+	dir := filepath.Join(c.cache.baseDir, partialDirName)
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	present := make(map[string]bool)
+	for _, fi := range files {
+		present[fi.Name()] = true
+	}
+	bad := func(name string) {
+		c.report.BadPartial = append(c.report.BadPartial,
+			filepath.Join(partialDirName, name))
+		c.remove(filepath.Join(dir, name))
+	}
+	for _, fi := range files {
+		name := fi.Name()
+		if !strings.HasSuffix(name, rangesSuffix) {
+			if !present[name+rangesSuffix] {
+				bad(name)
+			}
+			continue
+		}
+		if !present[strings.TrimSuffix(name, rangesSuffix)] {
+			bad(name)
+			continue
+		}
+		raw, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return err
+		}
+		state := &pb.Partial{}
+		err = proto.Unmarshal(raw, state)
+		if err != nil || !validRanges(state) || len(state.Ranges) == 0 {
+			bad(name)
+			bad(strings.TrimSuffix(name, rangesSuffix))
+			continue
+		}
+		c.report.PartialFiles++
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package cache
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/sha3"
+	. "gopkg.in/check.v1"
+)
+
+func (s *MySuite) TestCheck(c *C) {
+	tempDir, err := ioutil.TempDir("", "jvproxy-test")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(tempDir)
+
+	store, err := NewLevelDBCache(tempDir, nil)
+	c.Assert(err, IsNil)
+	names := []string{"a", "b", "c", "d"}
+	for _, name := range names {
+		storeString(c, store, "http://example.com/"+name, http.Header{},
+			"content of "+name)
+	}
+	waitForUsage(c, store.(Configurable), func(u LevelDBUsage) bool {
+		return u.Entries == int64(len(names))
+	})
+	ids := map[string][]byte{}
+	for _, name := range names {
+		req, _ := http.NewRequest("GET", "http://example.com/"+name, nil)
+		entries := store.Retrieve(req)
+		c.Assert(entries, HasLen, 1)
+		ids[name] = entries[0].CacheID
+	}
+	cache := store.(*ldbCache)
+	store.Close()
+
+	// a clean cache
+	report, err := Check(tempDir, false)
+	c.Assert(err, IsNil)
+	c.Check(report.OK(), Equals, true, Commentf("%s", report))
+	c.Check(report.ContentFiles, Equals, 4)
+	c.Check(report.MetaRecords, Equals, 4)
+	c.Check(report.IndexEntries, Equals, 4)
+
+	// damage the cache
+	err = ioutil.WriteFile(cache.getStoreName(ids["a"]), []byte("garbage"), 0644)
+	c.Assert(err, IsNil)
+	err = os.Remove(cache.getStoreName(ids["b"]))
+	c.Assert(err, IsNil)
+	orphan := []byte("orphan")
+	orphanHash := make([]byte, hashLen)
+	sha3.ShakeSum128(orphanHash, orphan)
+	err = ioutil.WriteFile(cache.getStoreName(orphanHash), orphan, 0644)
+	c.Assert(err, IsNil)
+	err = ioutil.WriteFile(filepath.Join(tempDir, newDirName, "123"), nil, 0644)
+	c.Assert(err, IsNil)
+	err = ioutil.WriteFile(filepath.Join(tempDir, partialDirName, "456"), nil, 0644)
+	c.Assert(err, IsNil)
+
+	report, err = Check(tempDir, false)
+	c.Assert(err, IsNil)
+	c.Check(report.OK(), Equals, false)
+	c.Check(report.Corrupt, HasLen, 1)
+	c.Check(report.MissingContent, HasLen, 2)
+	c.Check(report.Unreferenced, HasLen, 1)
+	c.Check(report.StaleNew, HasLen, 1)
+	c.Check(report.BadPartial, HasLen, 1)
+	c.Check(report.IndexMismatch, Equals, 2)
+
+	report, err = Check(tempDir, true)
+	c.Assert(err, IsNil)
+	c.Check(report.Repaired, Equals, true)
+
+	report, err = Check(tempDir, false)
+	c.Assert(err, IsNil)
+	c.Check(report.OK(), Equals, true, Commentf("%s", report))
+	c.Check(report.ContentFiles, Equals, 2)
+	c.Check(report.MetaRecords, Equals, 2)
+	c.Check(report.IndexEntries, Equals, 2)
+}
@@ -0,0 +1,267 @@
+package cache
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/seehuhn/trace"
+)
+
+// A Codec compresses and decompresses stored response bodies.  The
+// name of a codec is the HTTP content-coding of the compressed data,
+// so that compressed bodies can be sent to clients unchanged.
+type Codec interface {
+	// Name returns the content-coding implemented by the codec,
+	// e.g. "gzip".
+	Name() string
+
+	// NewWriter returns a writer which compresses the data written
+	// to it, and writes the result to `w`.  All data is flushed to
+	// `w` by the Close method of the returned writer.
+	NewWriter(w io.Writer) (io.WriteCloser, error)
+
+	// NewReader returns a reader which decompresses the data read
+	// from `r`.
+	NewReader(r io.Reader) (io.ReadCloser, error)
+}
+
+var (
+	codecMutex sync.RWMutex
+	codecs     = map[string]Codec{
+		"gzip": gzipCodec{},
+		"zstd": zstdCodec{},
+	}
+)
+
+// RegisterCodec makes a codec available for use in
+// LevelDBOptions.Compression.  The "gzip" and "zstd" codecs are built
+// in.
+func RegisterCodec(codec Codec) {
+	codecMutex.Lock()
+	codecs[codec.Name()] = codec
+	codecMutex.Unlock()
+}
+
+// Codecs returns the names of all registered codecs.
+func Codecs() []string {
+	codecMutex.RLock()
+	defer codecMutex.RUnlock()
+	var res []string
+	for name := range codecs {
+		res = append(res, name)
+	}
+	sort.Strings(res)
+	return res
+}
+
+func getCodec(name string) (Codec, error) {
+	codecMutex.RLock()
+	codec, ok := codecs[name]
+	codecMutex.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("cache: unknown content-coding %q", name)
+	}
+	return codec, nil
+}
+
+type gzipCodec struct{}
+
+func (gzipCodec) Name() string { return "gzip" }
+
+func (gzipCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return gzip.NewWriter(w), nil
+}
+
+func (gzipCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+// storedFormat describes how a response body is stored on disk:
+// `encoding` is the content-coding used for compression, or "" for
+// uncompressed bodies, and `size` is the size of the uncompressed
+// body.
+type storedFormat struct {
+	encoding string
+	size     int64
+}
+
+// encodingFor returns the content-coding used to store response bodies
+// with the given header, or "" if the body should be stored
+// uncompressed.  Bodies which already have a content-coding are never
+// compressed again.
+func (opts LevelDBOptions) encodingFor(header http.Header) string {
+	if len(opts.Compression) == 0 {
+		return ""
+	}
+	ce := strings.TrimSpace(header.Get("Content-Encoding"))
+	if ce != "" && !strings.EqualFold(ce, "identity") {
+		return ""
+	}
+	mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		return ""
+	}
+	if encoding, ok := opts.Compression[mediaType]; ok {
+		return encoding
+	}
+	if pos := strings.IndexByte(mediaType, '/'); pos > 0 {
+		return opts.Compression[mediaType[:pos]+"/*"]
+	}
+	return ""
+}
+
+// compressContent writes a compressed copy of the file `fname`, which
+// has size `size`, into the "new" directory.  The name and size of the
+// compressed file are returned.  If compression fails or does not
+// save space, the returned name is "".
+func (cache *ldbCache) compressContent(fname string, size int64, encoding string) (string, int64) {
+	codec, err := getCodec(encoding)
+	if err != nil {
+		// The options have been checked, but a codec may have been
+		// requested which is not compiled in.
+		return "", 0
+	}
+	src, err := os.Open(fname)
+	if err != nil {
+		trace.T("jvproxy/cache", trace.PrioError,
+			"cannot open %s: %s", fname, err.Error())
+		return "", 0
+	}
+	defer src.Close()
+	dst, err := ioutil.TempFile(cache.newDir, "")
+	if err != nil {
+		trace.T("jvproxy/cache", trace.PrioError,
+			"cannot create compressed file: %s", err.Error())
+		return "", 0
+	}
+	dstName := dst.Name()
+
+	w, err := codec.NewWriter(dst)
+	if err == nil {
+		_, err = io.Copy(w, src)
+		if e := w.Close(); err == nil {
+			err = e
+		}
+	}
+	var n int64
+	if err == nil {
+		n, err = dst.Seek(0, io.SeekCurrent)
+	}
+	if e := dst.Close(); err == nil {
+		err = e
+	}
+	if err != nil || n >= size {
+		if err != nil {
+			trace.T("jvproxy/cache", trace.PrioError,
+				"cannot compress %s: %s", fname, err.Error())
+		}
+		os.Remove(dstName)
+		return "", 0
+	}
+	return dstName, n
+}
+
+// errBadSeek is returned by decodingReader.Seek for negative
+// positions.
+var errBadSeek = errors.New("cache: seek to negative position")
+
+// decodingReader decompresses a stored response body while it is
+// read.  Seeking only records the new position.  The next read then
+// decompresses and discards the data up to this position, restarting
+// decompression from the beginning of the file if the position is
+// before the current one.
+type decodingReader struct {
+	file  *os.File
+	codec Codec
+	size  int64 // the uncompressed size
+
+	r      io.ReadCloser
+	pos    int64 // the position of r
+	target int64 // the position set by Seek
+}
+
+func newDecodingReader(file *os.File, encoding string, size int64) (*decodingReader, error) {
+	codec, err := getCodec(encoding)
+	if err != nil {
+		return nil, err
+	}
+	r, err := codec.NewReader(file)
+	if err != nil {
+		return nil, err
+	}
+	return &decodingReader{
+		file:  file,
+		codec: codec,
+		size:  size,
+		r:     r,
+	}, nil
+}
+
+func (r *decodingReader) Read(p []byte) (int, error) {
+	if r.target != r.pos {
+		err := r.skip()
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.r.Read(p)
+	r.pos += int64(n)
+	r.target = r.pos
+	return n, err
+}
+
+// skip moves the decompressor to the position set by Seek.
+func (r *decodingReader) skip() error {
+	if r.target < r.pos {
+		_, err := r.file.Seek(0, io.SeekStart)
+		if err != nil {
+			return err
+		}
+		r.r.Close()
+		r.r, err = r.codec.NewReader(r.file)
+		if err != nil {
+			return err
+		}
+		r.pos = 0
+	}
+	n, err := io.CopyN(ioutil.Discard, r.r, r.target-r.pos)
+	r.pos += n
+	if err == io.EOF {
+		// Seeking beyond the end is allowed, reads then return
+		// io.EOF.
+		return io.EOF
+	}
+	return err
+}
+
+// Seek implements the io.Seeker interface.
+func (r *decodingReader) Seek(offset int64, whence int) (int64, error) {
+	var target int64
+	switch whence {
+	case io.SeekStart:
+		target = offset
+	case io.SeekCurrent:
+		target = r.target + offset
+	case io.SeekEnd:
+		target = r.size + offset
+	}
+	if target < 0 {
+		return 0, errBadSeek
+	}
+	r.target = target
+	return target, nil
+}
+
+func (r *decodingReader) Close() error {
+	r.r.Close()
+	return r.file.Close()
+}
@@ -0,0 +1,159 @@
+package cache
+
+import (
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	. "gopkg.in/check.v1"
+)
+
+func (s *MySuite) TestEncodingFor(c *C) {
+	opts := LevelDBOptions{
+		Compression: map[string]string{
+			"text/*":           "gzip",
+			"application/json": "gzip",
+			"text/css":         "",
+		},
+	}
+	cases := []struct {
+		contentType, contentEncoding, expected string
+	}{
+		{"text/html; charset=utf-8", "", "gzip"},
+		{"Application/JSON", "", "gzip"},
+		{"application/javascript", "", ""},
+		{"text/css", "", ""},
+		{"text/plain", "identity", "gzip"},
+		{"text/plain", "br", ""},
+		{"", "", ""},
+	}
+	for _, test := range cases {
+		h := http.Header{}
+		h.Set("Content-Type", test.contentType)
+		if test.contentEncoding != "" {
+			h.Set("Content-Encoding", test.contentEncoding)
+		}
+		c.Check(opts.encodingFor(h), Equals, test.expected,
+			Commentf("Content-Type: %s", test.contentType))
+	}
+
+	c.Check(opts.check(), IsNil)
+	// zstd is available without build tags
+	opts.Compression["image/*"] = "zstd"
+	c.Check(opts.check(), IsNil)
+	opts.Compression["image/*"] = "no-such-coding"
+	c.Check(opts.check(), NotNil)
+}
+
+func (s *MySuite) TestCompression(c *C) {
+	tempDir, err := ioutil.TempDir("", "jvproxy-test")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(tempDir)
+
+	store, err := NewLevelDBCache(tempDir, &LevelDBOptions{
+		Compression: map[string]string{"text/*": "gzip"},
+	})
+	c.Assert(err, IsNil)
+	cache := store.(*ldbCache)
+
+	text := strings.Repeat("all work and no play makes Jack a dull boy\n", 50)
+	h := http.Header{}
+	h.Set("Content-Type", "text/plain")
+	storeString(c, store, "http://example.com/text", h, text)
+	h = http.Header{}
+	h.Set("Content-Type", "image/png")
+	storeString(c, store, "http://example.com/image", h, text+"!")
+
+	req, _ := http.NewRequest("GET", "http://example.com/text", nil)
+	entries := store.Retrieve(req)
+	c.Assert(entries, HasLen, 1)
+	entry := entries[0]
+	c.Check(entry.Encoding, Equals, "gzip")
+	c.Assert(entry.GetEncodedBody, NotNil)
+
+	// the index records both sizes
+	data := cache.getIndexEntry(entry.CacheID)
+	c.Check(data.GetEncoding(), Equals, "gzip")
+	c.Check(data.GetContentSize(), Equals, int64(len(text)))
+	fi, err := os.Stat(cache.getStoreName(entry.CacheID))
+	c.Assert(err, IsNil)
+	c.Check(data.GetSize(), Equals, fi.Size())
+	c.Check(fi.Size() < int64(len(text)), Equals, true)
+
+	// GetBody decompresses, and supports seeking
+	c.Check(readBody(c, entry), Equals, text)
+	body := entry.GetBody()
+	seeker, ok := body.(io.ReadSeeker)
+	c.Assert(ok, Equals, true)
+	size, err := seeker.Seek(0, io.SeekEnd)
+	c.Assert(err, IsNil)
+	c.Check(size, Equals, int64(len(text)))
+	// seeking does not decompress anything
+	c.Check(body.(*decodingReader).pos, Equals, int64(0))
+	_, err = seeker.Seek(13, io.SeekStart)
+	c.Assert(err, IsNil)
+	buf := make([]byte, 7)
+	_, err = io.ReadFull(seeker, buf)
+	c.Assert(err, IsNil)
+	c.Check(string(buf), Equals, "no play")
+	body.Close()
+
+	// GetEncodedBody returns the compressed bytes
+	body = entry.GetEncodedBody()
+	c.Assert(body, NotNil)
+	zr, err := gzip.NewReader(body)
+	c.Assert(err, IsNil)
+	plain, err := ioutil.ReadAll(zr)
+	c.Assert(err, IsNil)
+	c.Check(string(plain), Equals, text)
+	body.Close()
+
+	// other media types are stored uncompressed
+	req, _ = http.NewRequest("GET", "http://example.com/image", nil)
+	entries = store.Retrieve(req)
+	c.Assert(entries, HasLen, 1)
+	c.Check(entries[0].Encoding, Equals, "")
+	c.Check(entries[0].GetEncodedBody, IsNil)
+	c.Check(readBody(c, entries[0]), Equals, text+"!")
+
+	// compressed content is verified after decompression
+	opts := cache.Options()
+	opts.VerifyReads = true
+	c.Assert(cache.SetOptions(opts), IsNil)
+	req, _ = http.NewRequest("GET", "http://example.com/text", nil)
+	entries = store.Retrieve(req)
+	c.Assert(entries, HasLen, 1)
+	c.Check(entries[0].GetEncodedBody, IsNil)
+	c.Check(readBody(c, entries[0]), Equals, text)
+	c.Check(cache.Usage().IntegrityErrors, Equals, int64(0))
+
+	c.Assert(store.Close(), IsNil)
+	report, err := Check(tempDir, false)
+	c.Assert(err, IsNil)
+	c.Check(report.OK(), Equals, true, Commentf("%s", report))
+
+	// if the index is lost, Check finds the content-coding
+	indexDir := filepath.Join(tempDir, indexDirName)
+	c.Assert(os.RemoveAll(indexDir), IsNil)
+	index, err := leveldb.OpenFile(indexDir, nil)
+	c.Assert(err, IsNil)
+	c.Assert(index.Close(), IsNil)
+	report, err = Check(tempDir, true)
+	c.Assert(err, IsNil)
+	c.Check(report.Corrupt, HasLen, 0)
+	c.Check(report.IndexMismatch, Equals, 2)
+
+	store, err = NewLevelDBCache(tempDir, nil)
+	c.Assert(err, IsNil)
+	defer store.Close()
+	req, _ = http.NewRequest("GET", "http://example.com/text", nil)
+	entries = store.Retrieve(req)
+	c.Assert(entries, HasLen, 1)
+	c.Check(entries[0].Encoding, Equals, "gzip")
+	c.Check(readBody(c, entries[0]), Equals, text)
+}
@@ -0,0 +1,274 @@
+package cache
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// UsageInfo describes the use of one stored response body, as
+// recorded in the index of a LevelDB cache.  Times are given in
+// seconds since the Unix epoch.  Expires is the time when the last of
+// the responses using this body becomes stale, or 0 if this is not
+// known.  Validator indicates whether any of these responses can be
+// revalidated.
+type UsageInfo struct {
+	Size      int64
+	FirstUsed int64
+	LastUsed  int64
+	UseCount  int
+	Expires   int64
+	Validator bool
+}
+
+// An EvictionPolicy decides which response bodies are removed first,
+// when a LevelDB cache exceeds its size limits.  Expired bodies which
+// cannot be revalidated are always removed before the bodies ranked
+// by the policy.  Score is called for
+// all entries of the index during a scan, Evicted is called for every
+// body removed afterwards.  The two methods may be called from
+// different goroutines.
+type EvictionPolicy interface {
+	// Name returns the name used to select the policy in
+	// LevelDBOptions.
+	Name() string
+
+	// Score returns the eviction score of the data described by
+	// `info`, at time `now`.  Data with higher scores is evicted
+	// first.  All calls during one scan of the index use the same
+	// value of `now`.
+	Score(info *UsageInfo, now int64) float64
+
+	// Evicted is called after data with the given score has been
+	// removed from the cache.
+	Evicted(score float64)
+}
+
+// DefaultEvictionPolicy is used if LevelDBOptions.Policy is empty.
+const DefaultEvictionPolicy = "lru"
+
+var evictionPolicies = map[string]func() EvictionPolicy{
+	"lru":      func() EvictionPolicy { return lruPolicy{} },
+	"lfu":      func() EvictionPolicy { return lfuPolicy{} },
+	"gdsf":     func() EvictionPolicy { return &gdsfPolicy{} },
+	"survival": func() EvictionPolicy { return NewSurvivalPolicy(time.Hour) },
+}
+
+// EvictionPolicies returns the names of the built-in eviction
+// policies.
+func EvictionPolicies() []string {
+	var res []string
+	for name := range evictionPolicies {
+		res = append(res, name)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// NewEvictionPolicy returns a new instance of the built-in eviction
+// policy with the given name.
+func NewEvictionPolicy(name string) (EvictionPolicy, error) {
+	if name == "" {
+		name = DefaultEvictionPolicy
+	}
+	newPolicy, ok := evictionPolicies[name]
+	if !ok {
+		return nil, fmt.Errorf("cache: unknown eviction policy %q", name)
+	}
+	return newPolicy(), nil
+}
+
+// lruPolicy evicts the least recently used data first.
+type lruPolicy struct{}
+
+func (lruPolicy) Name() string { return "lru" }
+
+func (lruPolicy) Score(info *UsageInfo, now int64) float64 {
+	return -float64(info.LastUsed)
+}
+
+func (lruPolicy) Evicted(score float64) {}
+
+// lfuPolicy evicts the least frequently used data first.  Ties are
+// broken by evicting the least recently used data first; the scaled
+// time stays below 1 until the year 2286.
+type lfuPolicy struct{}
+
+func (lfuPolicy) Name() string { return "lfu" }
+
+func (lfuPolicy) Score(info *UsageInfo, now int64) float64 {
+	return -(float64(info.UseCount) + 1e-10*float64(info.LastUsed))
+}
+
+func (lfuPolicy) Evicted(score float64) {}
+
+// gdsfPolicy implements the "Greedy Dual Size Frequency" policy: the
+// priority of an object is L + UseCount/Size, where the inflation
+// value L is the priority of the last evicted object at the time the
+// object was last used.  Objects with lowest priority are evicted
+// first.  Since the index only stores the time of last use, the
+// history of L is kept here.
+type gdsfPolicy struct {
+	mutex   sync.Mutex
+	history []inflation
+}
+
+type inflation struct {
+	time  int64
+	value float64
+}
+
+const maxInflationHistory = 1024
+
+func (p *gdsfPolicy) Name() string { return "gdsf" }
+
+func (p *gdsfPolicy) Score(info *UsageInfo, now int64) float64 {
+	size := info.Size
+	if size < 1 {
+		size = 1
+	}
+	return -(p.inflationAt(info.LastUsed) + float64(info.UseCount)/float64(size))
+}
+
+func (p *gdsfPolicy) Evicted(score float64) {
+	now := time.Now().Unix()
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	n := len(p.history)
+	if n > 0 && -score <= p.history[n-1].value {
+		return
+	}
+	if n > 0 && p.history[n-1].time == now {
+		p.history[n-1].value = -score
+		return
+	}
+	if n >= maxInflationHistory {
+		p.history = append(p.history[:0], p.history[n/2:]...)
+	}
+	p.history = append(p.history, inflation{now, -score})
+}
+
+// inflationAt returns the value of L at time `t`.
+func (p *gdsfPolicy) inflationAt(t int64) float64 {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	idx := sort.Search(len(p.history), func(i int) bool {
+		return p.history[i].time > t
+	})
+	if idx == 0 {
+		return 0
+	}
+	return p.history[idx-1].value
+}
+
+// SurvivalPolicy evicts the data which is least likely to be used
+// again within the time Horizon.  The waiting times between uses of
+// an object are modelled as exponentially distributed, with
+// right-censoring at the current time ("model 2" in notes.tex).  For
+// an object used n times since it was first stored, the ML estimate
+// of the rate is (n-1)/(now-FirstUsed).  To get useful estimates for
+// objects used only once, the rates are shrunk towards the rate
+// pooled over all objects of the previous scan of the index.
+type SurvivalPolicy struct {
+	Horizon time.Duration
+
+	mutex      sync.Mutex
+	scanTime   int64
+	reuses     float64
+	exposure   float64
+	pooledRate float64
+}
+
+// survivalPriorWeight is the number of pseudo-observations given to
+// the pooled rate.
+const survivalPriorWeight = 1
+
+// NewSurvivalPolicy returns a new SurvivalPolicy with the given
+// horizon.
+func NewSurvivalPolicy(horizon time.Duration) *SurvivalPolicy {
+	return &SurvivalPolicy{
+		Horizon:    horizon,
+		pooledRate: 1 / (24 * 60 * 60.0),
+	}
+}
+
+// Name implements the EvictionPolicy interface.
+func (p *SurvivalPolicy) Name() string { return "survival" }
+
+// Score implements the EvictionPolicy interface.  The score is minus
+// the estimated probability of the data being used again within
+// p.Horizon.
+func (p *SurvivalPolicy) Score(info *UsageInfo, now int64) float64 {
+	first := info.FirstUsed
+	if first <= 0 {
+		first = info.LastUsed
+	}
+	reuses := float64(info.UseCount - 1)
+	if reuses < 0 {
+		reuses = 0
+	}
+	exposure := float64(now - first)
+	if exposure < 1 {
+		exposure = 1
+	}
+
+	p.mutex.Lock()
+	if now != p.scanTime {
+		if p.exposure > 0 && p.reuses > 0 {
+			p.pooledRate = p.reuses / p.exposure
+		}
+		p.scanTime = now
+		p.reuses = 0
+		p.exposure = 0
+	}
+	p.reuses += reuses
+	p.exposure += exposure
+	pooledRate := p.pooledRate
+	p.mutex.Unlock()
+
+	rate := (reuses + survivalPriorWeight) /
+		(exposure + survivalPriorWeight/pooledRate)
+	return math.Expm1(-rate * p.Horizon.Seconds())
+}
+
+// Evicted implements the EvictionPolicy interface.
+func (p *SurvivalPolicy) Evicted(score float64) {}
+
+// EvictionStats records how well the eviction policy of a LevelDB
+// cache works.  The counts are reset whenever the policy is changed,
+// so that policies can be compared.
+type EvictionStats struct {
+	Policy string
+	Since  time.Time
+
+	// Hits counts the stored bodies read from the cache, Misses
+	// counts the bodies newly stored in the cache.
+	Hits, HitBytes          int64
+	Misses, MissBytes       int64
+	Evictions, EvictedBytes int64
+}
+
+// HitRatio returns the fraction of requests served from the cache.
+func (s EvictionStats) HitRatio() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+// ByteHitRatio returns the fraction of bytes served from the cache.
+func (s EvictionStats) ByteHitRatio() float64 {
+	if s.HitBytes+s.MissBytes == 0 {
+		return 0
+	}
+	return float64(s.HitBytes) / float64(s.HitBytes+s.MissBytes)
+}
+
+func (s EvictionStats) String() string {
+	return fmt.Sprintf("%s: %d hits (%s), %d misses (%s), hit ratio %.1f%%, byte hit ratio %.1f%%, %d evictions (%s)",
+		s.Policy, s.Hits, byteSize(s.HitBytes), s.Misses, byteSize(s.MissBytes),
+		100*s.HitRatio(), 100*s.ByteHitRatio(), s.Evictions, byteSize(s.EvictedBytes))
+}
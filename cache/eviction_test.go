@@ -0,0 +1,111 @@
+package cache
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+
+	. "gopkg.in/check.v1"
+)
+
+// evictionOrder returns the indices of `infos`, in the order in which
+// `policy` evicts the corresponding data.
+func evictionOrder(policy EvictionPolicy, infos []UsageInfo, now int64) []int {
+	scores := make([]float64, len(infos))
+	for i := range infos {
+		scores[i] = policy.Score(&infos[i], now)
+	}
+	idx := make([]int, len(infos))
+	for i := range idx {
+		idx[i] = i
+	}
+	sort.SliceStable(idx, func(i, j int) bool {
+		return scores[idx[i]] > scores[idx[j]]
+	})
+	return idx
+}
+
+func (s *MySuite) TestEvictionPolicies(c *C) {
+	const now = 1000000
+	infos := []UsageInfo{
+		{Size: 100, FirstUsed: now - 1000, LastUsed: now - 10, UseCount: 1},
+		{Size: 100, FirstUsed: now - 1000, LastUsed: now - 500, UseCount: 20},
+		{Size: 10000, FirstUsed: now - 1000, LastUsed: now - 100, UseCount: 5},
+	}
+
+	for _, name := range EvictionPolicies() {
+		policy, err := NewEvictionPolicy(name)
+		c.Assert(err, IsNil)
+		c.Check(policy.Name(), Equals, name)
+	}
+	_, err := NewEvictionPolicy("random")
+	c.Assert(err, NotNil)
+
+	cases := []struct {
+		name     string
+		expected []int
+	}{
+		{"lru", []int{1, 2, 0}},
+		{"lfu", []int{0, 2, 1}},
+		{"gdsf", []int{2, 0, 1}},
+		{"survival", []int{0, 2, 1}},
+	}
+	for _, test := range cases {
+		policy, _ := NewEvictionPolicy(test.name)
+		c.Check(evictionOrder(policy, infos, now), DeepEquals, test.expected,
+			Commentf("policy %s", test.name))
+	}
+}
+
+func (s *MySuite) TestGDSFAging(c *C) {
+	p := &gdsfPolicy{}
+	old := &UsageInfo{Size: 1, LastUsed: 100, UseCount: 10}
+	score := p.Score(old, 200)
+	c.Assert(score, Equals, -10.0)
+
+	// After data with priority 50 has been evicted, recently used
+	// data ranks above the old data, even if it is used less often.
+	p.Evicted(-50)
+	recent := &UsageInfo{Size: 1, LastUsed: p.history[0].time, UseCount: 1}
+	c.Assert(p.Score(old, 200) > p.Score(recent, 200), Equals, true)
+}
+
+func (s *MySuite) TestEvictionStats(c *C) {
+	tempDir, err := ioutil.TempDir("", "jvproxy-test")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(tempDir)
+
+	cache, err := NewLevelDBCache(tempDir, &LevelDBOptions{Policy: "lfu"})
+	c.Assert(err, IsNil)
+	defer cache.Close()
+	conf := cache.(Configurable)
+	c.Assert(conf.EvictionStats().Policy, Equals, "lfu")
+
+	for i := 0; i < 4; i++ {
+		url := fmt.Sprintf("http://example.com/%d", i)
+		storeString(c, cache, url, http.Header{}, fmt.Sprintf("body %05d", i))
+	}
+	req, _ := http.NewRequest("GET", "http://example.com/0", nil)
+	for i := 0; i < 3; i++ {
+		entries := cache.Retrieve(req)
+		c.Assert(entries, HasLen, 1)
+		readBody(c, entries[0])
+	}
+
+	stats := conf.EvictionStats()
+	c.Check(stats.Hits, Equals, int64(3))
+	c.Check(stats.HitBytes, Equals, int64(30))
+	c.Check(stats.Misses, Equals, int64(4))
+	c.Check(stats.ByteHitRatio(), Equals, 30.0/70.0)
+
+	opts := conf.Options()
+	opts.Policy = "unknown"
+	c.Assert(conf.SetOptions(opts), NotNil)
+	opts.Policy = "gdsf"
+	c.Assert(conf.SetOptions(opts), IsNil)
+	stats = conf.EvictionStats()
+	c.Check(stats.Policy, Equals, "gdsf")
+	c.Check(stats.Hits, Equals, int64(0))
+}
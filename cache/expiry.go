@@ -0,0 +1,241 @@
+package cache
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/seehuhn/httputil"
+	"github.com/seehuhn/jvproxy/cache/pb"
+	"github.com/seehuhn/trace"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// sweepInterval gives how often the index is checked for entries which
+// have been expired for longer than LevelDBOptions.MaxStaleness.
+const sweepInterval = time.Hour
+
+// expiredScore is added to the eviction score of expired data which
+// cannot be revalidated, so that this data is evicted before all
+// other data.  The scores of all built-in policies are well below
+// this value.
+const expiredScore = 1e15
+
+// expiry summarises the freshness information of a stored response.
+type expiry struct {
+	expires   int64 // Unix time, 0 if not known
+	validator bool
+}
+
+// getExpiry determines when the response described by `meta` becomes
+// stale, using only the explicit expiration time given by the server
+// (RFC 7234, section 4.2.1).  If the server gives no expiration time,
+// but heuristic freshness can be used, the expiration time is
+// reported as unknown.  Responses which can be used neither way are
+// considered stale from the start.
+func getExpiry(meta *MetaData) *expiry {
+	h := meta.Header
+	res := &expiry{
+		validator: h.Get("Etag") != "" || h.Get("Last-Modified") != "",
+	}
+
+	date := httputil.ParseDate(h.Get("Date"))
+	if date.IsZero() {
+		date = meta.ResponseTime
+	}
+	age, _ := strconv.ParseInt(h.Get("Age"), 10, 64)
+
+	lifetime := int64(-1)
+	parts, _ := httputil.ParseHeader(strings.Join(h["Cache-Control"], ","))
+	for _, part := range parts {
+		switch part.Key {
+		case "max-age", "s-maxage":
+			// The cache does not know whether it is used as a
+			// shared cache, so the longer lifetime is used.
+			seconds, err := strconv.ParseInt(part.Value, 10, 64)
+			if err == nil && seconds > lifetime {
+				lifetime = seconds
+			}
+		case "no-cache":
+			if part.Value == "" {
+				return &expiry{date.Unix() - age, res.validator}
+			}
+		}
+	}
+	if lifetime < 0 {
+		if expires, ok := h["Expires"]; ok {
+			t := httputil.ParseDate(expires[0])
+			if !t.IsZero() {
+				lifetime = t.Unix() - date.Unix()
+			}
+			if lifetime < 0 {
+				lifetime = 0
+			}
+		} else if h.Get("Last-Modified") != "" {
+			return res
+		} else {
+			lifetime = 0
+		}
+	}
+	res.expires = date.Unix() + lifetime - age
+	return res
+}
+
+// setExpiry records the freshness information `e` in the index entry
+// `data`.  If several responses share the same body, the data expires
+// when the last of the responses expires.
+func setExpiry(data *pb.Entry, e *expiry) {
+	if data.Expires == nil {
+		data.Expires = proto.Int64(e.expires)
+	} else if data.GetExpires() != 0 &&
+		(e.expires == 0 || e.expires > data.GetExpires()) {
+		data.Expires = proto.Int64(e.expires)
+	}
+	data.Validator = proto.Bool(data.GetValidator() || e.validator)
+}
+
+// isUseless checks whether the data described by `data` is expired and
+// cannot be revalidated.  Such data can only be used to answer
+// requests which allow stale responses.
+func isUseless(data *pb.Entry, now int64) bool {
+	expires := data.GetExpires()
+	return expires != 0 && expires < now && !data.GetValidator()
+}
+
+// isLongExpired checks whether the data described by `data` has been
+// expired for longer than `maxStaleness`.
+func isLongExpired(data *pb.Entry, now int64, maxStaleness time.Duration) bool {
+	expires := data.GetExpires()
+	return expires != 0 && now-expires > int64(maxStaleness/time.Second)
+}
+
+// sweepExpired removes the data which has been expired for longer
+// than LevelDBOptions.MaxStaleness.  If the data can be revalidated,
+// only the content is removed, and the metadata is kept.  The index is
+// scanned in the calling goroutine, the changes are applied by the
+// cache manager.  sweepExpired returns after the sweep is complete.
+func (cache *ldbCache) sweepExpired() {
+	maxStaleness := cache.Options().MaxStaleness
+	if maxStaleness <= 0 {
+		return
+	}
+
+	trace.T("jvproxy/cache", trace.PrioDebug,
+		"starting to sweep expired data")
+
+	now := time.Now().Unix()
+	var victims [][]byte
+	iter := cache.index.NewIterator(nil, nil)
+	for iter.Next() {
+		data := &pb.Entry{}
+		err := proto.Unmarshal(iter.Value(), data)
+		if err != nil {
+			continue
+		}
+		if isLongExpired(data, now, maxStaleness) {
+			victims = append(victims, append([]byte{}, iter.Key()...))
+		}
+	}
+	iter.Release()
+	err := iter.Error()
+	if err != nil {
+		trace.T("jvproxy/cache", trace.PrioError,
+			"error while using levelDB iterator: %s", err.Error())
+	}
+	if len(victims) == 0 {
+		return
+	}
+
+	wait := make(chan struct{})
+	select {
+	case cache.sweep <- &sweepRequest{
+		hashes:       victims,
+		maxStaleness: maxStaleness,
+		wait:         wait,
+	}:
+		<-wait
+	case <-cache.done:
+	}
+}
+
+type sweepRequest struct {
+	hashes       [][]byte
+	maxStaleness time.Duration
+	wait         chan<- struct{}
+}
+
+// applySweep removes the data listed in `req`.  Since the index may
+// have changed after the sweep started, the expiry of every entry is
+// checked again.  This must be called by the cache manager.  Index
+// entries of data where only the content was removed are deleted once
+// they have been expired for twice the maximal staleness.
+func (cache *ldbCache) applySweep(req *sweepRequest) {
+	now := time.Now().Unix()
+	var removed, dropped int
+	var size int64
+	for _, hash := range req.hashes {
+		raw, err := cache.index.Get(hash, nil)
+		if err != nil {
+			if err != leveldb.ErrNotFound {
+				trace.T("jvproxy/cache", trace.PrioError,
+					"error while reading index entry: %s", err.Error())
+			}
+			continue
+		}
+		data := &pb.Entry{}
+		err = proto.Unmarshal(raw, data)
+		if err != nil || !isLongExpired(data, now, req.maxStaleness) {
+			continue
+		}
+
+		if data.GetDropped() {
+			if isLongExpired(data, now, 2*req.maxStaleness) {
+				cache.deleteIndexEntry(hash)
+			}
+			continue
+		}
+
+		fname := cache.getStoreName(hash)
+		err = os.Remove(fname)
+		if err != nil && !os.IsNotExist(err) {
+			trace.T("jvproxy/cache", trace.PrioError,
+				"cannot remove %s: %s", fname, err.Error())
+			continue
+		}
+		if data.GetValidator() {
+			data.Dropped = proto.Bool(true)
+			raw, err = proto.Marshal(data)
+			if err != nil {
+				panic(err)
+			}
+			err = cache.index.Put(hash, raw, nil)
+			if err != nil {
+				trace.T("jvproxy/cache", trace.PrioError,
+					"error while writing index entry: %s", err.Error())
+			}
+			dropped++
+		} else {
+			cache.deleteIndexEntry(hash)
+			removed++
+		}
+		size += data.GetSize()
+
+		cache.usageMutex.Lock()
+		cache.totalBytes -= data.GetSize()
+		cache.totalEntries--
+		cache.usageMutex.Unlock()
+	}
+	trace.T("jvproxy/cache", trace.PrioInfo,
+		"swept %d expired data and the content of %d more (%s total)",
+		removed, dropped, byteSize(size))
+}
+
+func (cache *ldbCache) deleteIndexEntry(hash []byte) {
+	err := cache.index.Delete(hash, nil)
+	if err != nil {
+		trace.T("jvproxy/cache", trace.PrioError,
+			"cannot delete index entry %x: %s", hash, err.Error())
+	}
+}
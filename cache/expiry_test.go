@@ -0,0 +1,120 @@
+package cache
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *MySuite) TestGetExpiry(c *C) {
+	now := time.Now()
+	date := now.Format(http.TimeFormat)
+	later := now.Add(time.Hour).Format(http.TimeFormat)
+	cases := []struct {
+		header    http.Header
+		lifetime  int64 // -1 for unknown
+		validator bool
+	}{
+		{http.Header{"Cache-Control": {"max-age=60"}}, 60, false},
+		{http.Header{"Cache-Control": {"max-age=60, s-maxage=120"}}, 120, false},
+		{http.Header{"Cache-Control": {"max-age=60"}, "Age": {"20"}}, 40, false},
+		{http.Header{"Cache-Control": {"no-cache"}, "Etag": {`"x"`}}, 0, true},
+		{http.Header{"Expires": {later}}, 3600, false},
+		{http.Header{"Expires": {"0"}}, 0, false},
+		{http.Header{"Last-Modified": {date}}, -1, true},
+		{http.Header{}, 0, false},
+	}
+	for i, test := range cases {
+		test.header.Set("Date", date)
+		e := getExpiry(&MetaData{
+			StatusCode:   200,
+			Header:       test.header,
+			ResponseTime: now,
+		})
+		expected := int64(0)
+		if test.lifetime >= 0 {
+			expected = now.Unix() + test.lifetime
+		}
+		c.Check(e.expires, Equals, expected, Commentf("case %d", i))
+		c.Check(e.validator, Equals, test.validator, Commentf("case %d", i))
+	}
+}
+
+func (s *MySuite) TestSweepExpired(c *C) {
+	tempDir, err := ioutil.TempDir("", "jvproxy-test")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(tempDir)
+
+	store, err := NewLevelDBCache(tempDir, &LevelDBOptions{
+		MaxStaleness: time.Hour,
+	})
+	c.Assert(err, IsNil)
+	defer store.Close()
+	cache := store.(*ldbCache)
+
+	old := time.Now().Add(-3 * time.Hour).Format(http.TimeFormat)
+	storeString(c, store, "http://example.com/useless", http.Header{
+		"Date":          {old},
+		"Cache-Control": {"max-age=60"},
+	}, "useless")
+	storeString(c, store, "http://example.com/validator", http.Header{
+		"Date":          {old},
+		"Cache-Control": {"max-age=60"},
+		"Etag":          {`"v1"`},
+	}, "validator")
+	storeString(c, store, "http://example.com/fresh", http.Header{
+		"Date":          {time.Now().Format(http.TimeFormat)},
+		"Cache-Control": {"max-age=60"},
+	}, "fresh")
+	waitForUsage(c, cache, func(u LevelDBUsage) bool {
+		return u.Entries == 3
+	})
+
+	retrieve := func(name string) *Entry {
+		req, _ := http.NewRequest("GET", "http://example.com/"+name, nil)
+		entries := store.Retrieve(req)
+		c.Assert(entries, HasLen, 1)
+		return entries[0]
+	}
+	useless := retrieve("useless").CacheID
+
+	// Expired data without validators is evicted first, even if it
+	// was used most recently.
+	readBody(c, retrieve("useless"))
+	waitForUsage(c, cache, func(LevelDBUsage) bool {
+		return cache.useCount(useless) == 2
+	})
+	candidates := cache.pruneData(lruPolicy{})
+	c.Assert(candidates, HasLen, 3)
+	c.Check(bytes.Equal(candidates[0].hash, useless), Equals, true)
+
+	cache.sweepExpired()
+	c.Check(cache.Usage().Entries, Equals, int64(1))
+	_, err = cache.index.Get(useless, nil)
+	c.Check(err, NotNil)
+	c.Check(retrieve("useless").GetBody(), IsNil)
+
+	entry := retrieve("validator")
+	c.Check(entry.Header.Get("Etag"), Equals, `"v1"`)
+	c.Check(entry.Dropped, Equals, true)
+	c.Check(entry.GetBody(), IsNil)
+
+	c.Check(readBody(c, retrieve("fresh")), Equals, "fresh")
+
+	// Storing the content again makes the dropped entry usable.
+	storeString(c, store, "http://example.com/validator", http.Header{
+		"Date":          {time.Now().Format(http.TimeFormat)},
+		"Cache-Control": {"max-age=60"},
+		"Etag":          {`"v1"`},
+	}, "validator")
+	waitForUsage(c, cache, func(u LevelDBUsage) bool {
+		return u.Entries == 2
+	})
+	entry = retrieve("validator")
+	c.Check(entry.Dropped, Equals, false)
+	c.Check(readBody(c, entry), Equals, "validator")
+}
@@ -0,0 +1,20 @@
+//go:build !windows
+// +build !windows
+
+package cache
+
+import (
+	"syscall"
+)
+
+// freeSpace returns the number of bytes available to unprivileged
+// users on the volume containing `dir`, or -1 if this cannot be
+// determined.
+func freeSpace(dir string) int64 {
+	var st syscall.Statfs_t
+	err := syscall.Statfs(dir, &st)
+	if err != nil {
+		return -1
+	}
+	return int64(st.Bavail) * int64(st.Bsize)
+}
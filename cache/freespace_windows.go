@@ -0,0 +1,8 @@
+package cache
+
+// freeSpace returns the number of bytes available on the volume
+// containing `dir`.  This is not implemented on Windows, so -1 is
+// returned and the MinFreeBytes limit is ignored.
+func freeSpace(dir string) int64 {
+	return -1
+}
@@ -1,6 +1,7 @@
 package cache
 
 import (
+	"bytes"
 	"encoding/hex"
 	"fmt"
 	"io"
@@ -8,7 +9,7 @@ import (
 	"os"
 	"path/filepath"
 	"sort"
-	"sync"
+	"time"
 
 	"github.com/golang/protobuf/proto"
 	"github.com/seehuhn/jvproxy/cache/pb"
@@ -19,8 +20,6 @@ import (
 const (
 	scanChunkSize  = 16
 	pruneChunkSize = 1000
-	lowWaterMark   = 48 * 1024 * 1024
-	highWaterMark  = 49 * 1024 * 1024
 )
 
 type victim struct {
@@ -94,10 +93,15 @@ func (cache *ldbCache) indexExistingData(res chan<- *sample) {
 						part, fi.Name(), err.Error())
 					continue
 				}
-				res <- &sample{
+				select {
+				case res <- &sample{
 					hash:    hash,
 					useTime: fi.ModTime().Unix(),
 					size:    size,
+				}:
+				case <-cache.done:
+					f.Close()
+					return
 				}
 				count++
 				totalSize += size
@@ -111,11 +115,14 @@ func (cache *ldbCache) indexExistingData(res chan<- *sample) {
 		count, byteSize(totalSize))
 }
 
-func (cache *ldbCache) pruneData() candidates {
+// pruneData scans the index and returns the data with the highest
+// eviction scores, according to `policy`.
+func (cache *ldbCache) pruneData(policy EvictionPolicy) candidates {
 	trace.T("jvproxy/cache", trace.PrioDebug,
-		"starting to prune data")
+		"starting to prune data, using policy %s", policy.Name())
 
 	p := candidates{}
+	now := time.Now().Unix()
 
 	iter := cache.index.NewIterator(nil, nil)
 	defer func() {
@@ -136,8 +143,25 @@ func (cache *ldbCache) pruneData() candidates {
 				"error while decoding index entry: %s",
 				err.Error())
 			score = math.MaxFloat64 // always evict invalid metadata
+		} else if data.GetDropped() {
+			continue
+		} else if isUnreferenced(data, now) {
+			// Data not used by any stored response is
+			// evicted first.
+			score = 2 * expiredScore
+		} else if isUseless(data, now) {
+			// Evict expired data which cannot be revalidated
+			// next, starting with the data expired longest.
+			score = expiredScore + float64(now-data.GetExpires())
 		} else {
-			score = -float64(data.GetLastUsed())
+			score = policy.Score(&UsageInfo{
+				Size:      data.GetSize(),
+				FirstUsed: data.GetFirstUsed(),
+				LastUsed:  data.GetLastUsed(),
+				UseCount:  int(data.GetUseCount()),
+				Expires:   data.GetExpires(),
+				Validator: data.GetValidator(),
+			}, now)
 		}
 
 		p = p.add(iter.Key(), data.GetSize(), score)
@@ -148,47 +172,79 @@ func (cache *ldbCache) pruneData() candidates {
 	return p
 }
 
+// pruneMetadata removes the metadata records for content which is no
+// longer present in the index, or which refer to an older generation
+// of the index entry.  Records which are replaced while this runs are
+// kept.
 func (cache *ldbCache) pruneMetadata() {
 	trace.T("jvproxy/cache", trace.PrioDebug,
 		"starting to prune metadata")
 
+	var orphans [][]byte
+	var refs []contentRef
 	iter := cache.meta.NewIterator(nil, nil)
-	defer func() {
-		iter.Release()
-		err := iter.Error()
-		if err != nil {
-			trace.T("jvproxy/cache", trace.PrioError,
-				"error while using levelDB iterator: %s", err.Error())
-		}
-	}()
-	count := 0
 	for iter.Next() {
-		key := iter.Key()
-		hashes := iter.Value()
-		contentHash := hashes[hashLen:]
-		present, err := cache.index.Has(contentHash, nil)
-		if err != nil {
+		ref := metaRecordRef(iter.Value())
+		if ref.hash == nil {
+			// left for Check to report
+			continue
+		}
+		raw, err := cache.index.Get(ref.hash, nil)
+		if err != nil && err != leveldb.ErrNotFound {
 			trace.T("jvproxy/cache", trace.PrioError,
-				"error while checking for key presence: %s", err.Error())
-		} else if !present {
-			err = cache.meta.Delete(key, nil)
-			if err != nil {
-				trace.T("jvproxy/cache", trace.PrioError,
-					"error while deleting DB entry: %s", err.Error())
-			} else {
-				count++
+				"error while reading index entry: %s", err.Error())
+			continue
+		}
+		if err == nil {
+			data := &pb.Entry{}
+			err = proto.Unmarshal(raw, data)
+			if err != nil || data.GetGeneration() == ref.generation {
+				continue
 			}
 		}
+		orphans = append(orphans, append([]byte{}, iter.Key()...))
+		refs = append(refs, ref)
+	}
+	iter.Release()
+	err := iter.Error()
+	if err != nil {
+		trace.T("jvproxy/cache", trace.PrioError,
+			"error while using levelDB iterator: %s", err.Error())
+		return
+	}
+
+	cache.metaMutex.Lock()
+	defer cache.metaMutex.Unlock()
+	batch := new(leveldb.Batch)
+	for i, key := range orphans {
+		value, err := cache.meta.Get(key, nil)
+		if err != nil {
+			continue
+		}
+		ref := metaRecordRef(value)
+		if !bytes.Equal(ref.hash, refs[i].hash) ||
+			ref.generation != refs[i].generation {
+			continue
+		}
+		batch.Delete(key)
+	}
+	err = cache.meta.Write(batch, nil)
+	if err != nil {
+		trace.T("jvproxy/cache", trace.PrioError,
+			"error while deleting DB entries: %s", err.Error())
+		return
 	}
 	trace.T("jvproxy/cache", trace.PrioInfo,
-		"pruned %d metadata entries", count)
+		"pruned %d metadata entries", batch.Len())
 }
 
-// updateIndex updates the information about the data with the given
-// hash in the index.  This method is *not* goroutine-safe.
-func (cache *ldbCache) updateIndex(hash []byte, time, size int64, new bool) int64 {
+// updateIndex updates the information about the data described by
+// `s` in the index.  The return value is the size of the data, if the
+// data is new to the index, and -1 if the data has already been
+// accounted for.  This method is *not* goroutine-safe.
+func (cache *ldbCache) updateIndex(s *sample, new bool) int64 {
 	var data *pb.Entry
-	raw, err := cache.index.Get(hash, nil)
+	raw, err := cache.index.Get(s.hash, nil)
 	if err == nil {
 		data = &pb.Entry{}
 		err = proto.Unmarshal(raw, data)
@@ -204,39 +260,88 @@ func (cache *ldbCache) updateIndex(hash []byte, time, size int64, new bool) int6
 			err.Error())
 	}
 
-	if data != nil && data.GetSize() != size {
+	if s.size < 0 {
+		// The sample only changes an existing entry.
+		if data != nil {
+			cache.changeEntry(s, data)
+		}
+		return -1
+	}
+
+	if new && data != nil {
+		// The data has been added to the index since the scan
+		// found the file.  If the file has changed since then,
+		// the newer sample describes it.
+		return -1
+	}
+
+	res := int64(-1)
+	if data != nil && data.GetDropped() {
+		// The content was removed by sweepExpired and has now
+		// been stored again.
+		data.Dropped = nil
+		data.Size = proto.Int64(s.size)
+		res = s.size
+	} else if data != nil && data.GetSize() != s.size {
 		trace.T("jvproxy/cache", trace.PrioError,
 			"index entry with wrong size: db=%d, file=%d",
-			data.GetSize(), size)
+			data.GetSize(), s.size)
+		// The entry is replaced below, and counted again.
+		cache.usageMutex.Lock()
+		cache.totalBytes -= data.GetSize()
+		cache.totalEntries--
+		cache.usageMutex.Unlock()
 		data = nil
 	}
 
-	if new && data != nil {
-		return data.GetSize()
+	if data == nil {
+		// The content may have been removed since the sample was
+		// taken, e.g. because it was found to be corrupt or was
+		// pruned.
+		_, err := os.Stat(cache.getStoreName(s.hash))
+		if os.IsNotExist(err) {
+			return -1
+		}
 	}
 
-	var res int64
 	if data == nil {
 		data = &pb.Entry{
-			LastUsed: proto.Int64(time),
-			Size:     proto.Int64(size),
-			UseCount: proto.Int32(1),
+			FirstUsed:  proto.Int64(s.useTime),
+			LastUsed:   proto.Int64(s.useTime),
+			Size:       proto.Int64(s.size),
+			UseCount:   proto.Int32(1),
+			RefCount:   proto.Int32(0),
+			Generation: proto.Int64(cache.newGeneration()),
 		}
-		res = size
-	} else {
-		data.LastUsed = proto.Int64(time)
+		res = s.size
+	} else if s.useTime > 0 {
+		data.LastUsed = proto.Int64(s.useTime)
 		n := data.GetUseCount()
 		if n < math.MaxInt32 {
 			n++
 		}
 		data.UseCount = proto.Int32(n)
 	}
+	if s.expiry != nil {
+		setExpiry(data, s.expiry)
+	}
+	if s.refs != 0 {
+		data.RefCount = proto.Int32(data.GetRefCount() + s.refs)
+		s.generation = data.GetGeneration()
+	}
+	if s.format != nil {
+		data.Encoding = nil
+		if s.format.encoding != "" {
+			data.Encoding = proto.String(s.format.encoding)
+		}
+		data.ContentSize = proto.Int64(s.format.size)
+	}
 
 	raw, err = proto.Marshal(data)
 	if err != nil {
 		panic(err)
 	}
-	err = cache.index.Put(hash, raw, nil)
+	err = cache.index.Put(s.hash, raw, nil)
 	if err != nil {
 		trace.T("jvproxy/cache", trace.PrioError,
 			"error while writing index entry: %s",
@@ -246,71 +351,178 @@ func (cache *ldbCache) updateIndex(hash []byte, time, size int64, new bool) int6
 	return res
 }
 
+// countIndex initialises the total size and number of entries from
+// the index.  Data which is present on disk but missing from the index
+// is added to the totals later, by indexExistingData.
+func (cache *ldbCache) countIndex() {
+	var bytes, entries int64
+	iter := cache.index.NewIterator(nil, nil)
+	for iter.Next() {
+		data := &pb.Entry{}
+		err := proto.Unmarshal(iter.Value(), data)
+		if err != nil || data.GetDropped() {
+			continue
+		}
+		bytes += data.GetSize()
+		entries++
+	}
+	iter.Release()
+	err := iter.Error()
+	if err != nil {
+		trace.T("jvproxy/cache", trace.PrioError,
+			"error while using levelDB iterator: %s", err.Error())
+	}
+
+	cache.usageMutex.Lock()
+	cache.totalBytes += bytes
+	cache.totalEntries += entries
+	cache.usageMutex.Unlock()
+}
+
 func (cache *ldbCache) manageIndex() {
+	cache.countIndex()
+
 	primordial := make(chan *sample, scanChunkSize)
 	type pruneRequest struct {
-		c    candidates
-		wait chan<- struct{}
+		c      candidates
+		policy EvictionPolicy
+		wait   chan<- struct{}
 	}
 	prune := make(chan *pruneRequest)
 
-	var totalBytes int64
-	var pruneMutex sync.Mutex
-	pruneCond := sync.NewCond(&pruneMutex)
+	// The free space on the volume changes without any action of
+	// the cache, so we need to check periodically.
+	cache.wg.Add(1)
+	go func() {
+		defer cache.wg.Done()
+		ticker := time.NewTicker(freeSpaceCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				cache.usageMutex.Lock()
+				cache.usageCond.Signal()
+				cache.usageMutex.Unlock()
+			case <-cache.done:
+				return
+			}
+		}
+	}()
+
+	cache.wg.Add(1)
+	go func() {
+		defer cache.wg.Done()
+		ticker := time.NewTicker(sweepInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				cache.sweepExpired()
+				cache.removeOldPartial(false)
+			case <-cache.done:
+				return
+			}
+		}
+	}()
 
+	cache.wg.Add(1)
 	go func() {
+		defer cache.wg.Done()
 		cache.indexExistingData(primordial)
 
 		for {
-			// TODO(voss): implement a method to abort this loop
+			// wait until one of the limits is exceeded
+			cache.usageMutex.Lock()
+			for !cache.isClosed() && !cache.overLimit(1, freeSpace(cache.baseDir), 0) {
+				cache.usageCond.Wait()
+			}
+			policy := cache.policy
+			cache.usageMutex.Unlock()
+			if cache.isClosed() {
+				return
+			}
 
-			// wait until high watermark is reached
-			pruneMutex.Lock()
-			for totalBytes <= highWaterMark {
-				pruneCond.Wait()
+			// Incomplete bodies are removed first.
+			cache.removeOldPartial(true)
+			cache.usageMutex.Lock()
+			over := cache.overLimit(1, freeSpace(cache.baseDir), 0)
+			cache.usageMutex.Unlock()
+			if !over {
+				continue
 			}
-			pruneMutex.Unlock()
 
-			candidates := cache.pruneData()
+			candidates := cache.pruneData(policy)
 			wait := make(chan struct{})
-			prune <- &pruneRequest{
-				c:    candidates,
-				wait: wait,
+			select {
+			case prune <- &pruneRequest{
+				c:      candidates,
+				policy: policy,
+				wait:   wait,
+			}:
+				<-wait
+			case <-cache.done:
+				return
 			}
-			_ = <-wait
 			cache.pruneMetadata()
+
+			if len(candidates) == 0 {
+				// Nothing left to prune, wait for the next check.
+				cache.usageMutex.Lock()
+				if !cache.isClosed() {
+					cache.usageCond.Wait()
+				}
+				cache.usageMutex.Unlock()
+			}
 		}
 	}()
 
+	addSample := func(entry *sample, new bool) {
+		n := cache.updateIndex(entry, new)
+		cache.usageMutex.Lock()
+		if n >= 0 {
+			cache.totalBytes += n
+			cache.totalEntries++
+			if cache.overLimit(1, -1, 0) {
+				cache.usageCond.Signal()
+			}
+		}
+		cache.usageMutex.Unlock()
+		if entry.wait != nil {
+			close(entry.wait)
+		}
+	}
+
 	for {
 		select {
-		case entry, ok := <-cache.submit:
-			if !ok {
-				trace.T("jvproxy/cache", trace.PrioDebug,
-					"stopping cache manager for %d", cache.baseDir)
-				return
-			}
-			n := cache.updateIndex(entry.hash, entry.useTime, entry.size, false)
-			pruneMutex.Lock()
-			totalBytes += n
-			if totalBytes > highWaterMark {
-				pruneCond.Signal()
+		case entry := <-cache.submit:
+			addSample(entry, false)
+		case <-cache.done:
+			// Record the samples submitted before the cache
+			// was closed.
+			for {
+				select {
+				case entry := <-cache.submit:
+					addSample(entry, false)
+				default:
+					trace.T("jvproxy/cache", trace.PrioDebug,
+						"stopping cache manager for %s", cache.baseDir)
+					return
+				}
 			}
-			pruneMutex.Unlock()
 		case entry := <-primordial:
-			n := cache.updateIndex(entry.hash, entry.useTime, entry.size, true)
-			pruneMutex.Lock()
-			totalBytes += n
-			if totalBytes > highWaterMark {
-				pruneCond.Signal()
-			}
-			pruneMutex.Unlock()
+			addSample(entry, true)
+		case req := <-cache.sweep:
+			cache.applySweep(req)
+			close(req.wait)
+		case hash := <-cache.corrupt:
+			cache.quarantine(hash)
 		case req := <-prune:
 			count := 0
 			var prunedSize int64
-			pruneMutex.Lock()
+			free := freeSpace(cache.baseDir)
+			cache.usageMutex.Lock()
 			for _, x := range req.c {
-				if totalBytes <= lowWaterMark {
+				if !cache.overLimit(pruneFraction, free, prunedSize) {
 					break
 				}
 				fname := cache.getStoreName(x.hash)
@@ -324,15 +536,66 @@ func (cache *ldbCache) manageIndex() {
 					trace.T("jvproxy/cache", trace.PrioError,
 						"cannot delete index entry %x: %s", x.hash, err.Error())
 				}
+				req.policy.Evicted(x.score)
 				count++
 				prunedSize += x.size
-				totalBytes -= x.size
+				cache.totalBytes -= x.size
+				cache.totalEntries--
+			}
+			if req.policy == cache.policy {
+				cache.stats.Evictions += int64(count)
+				cache.stats.EvictedBytes += prunedSize
 			}
 			trace.T("jvproxy/cache", trace.PrioInfo,
-				"pruned %d data (%s total), cache is now %s",
-				count, byteSize(prunedSize), byteSize(totalBytes))
-			pruneMutex.Unlock()
+				"pruned %d data (%s total), cache is now %s in %d entries",
+				count, byteSize(prunedSize), byteSize(cache.totalBytes),
+				cache.totalEntries)
+			trace.T("jvproxy/cache", trace.PrioInfo,
+				"eviction statistics: %s", cache.stats)
+			cache.usageMutex.Unlock()
 			close(req.wait)
 		}
 	}
 }
+
+// getIndexEntry returns the index entry for the data with the given
+// hash, or nil if the data is not in the index.
+func (cache *ldbCache) getIndexEntry(hash []byte) *pb.Entry {
+	raw, err := cache.index.Get(hash, nil)
+	if err != nil {
+		return nil
+	}
+	data := &pb.Entry{}
+	err = proto.Unmarshal(raw, data)
+	if err != nil {
+		return nil
+	}
+	return data
+}
+
+// useCount returns the number of times the data with the given hash
+// has been used, according to the index.  If the data is not in the
+// index, 0 is returned.
+func (cache *ldbCache) useCount(hash []byte) int {
+	return int(cache.getIndexEntry(hash).GetUseCount())
+}
+
+// recordUse records a use of the content with the given hash in the
+// index, where the content was read from elsewhere, e.g. from the
+// memory tier of a TieredCache.
+func (cache *ldbCache) recordUse(hash []byte) {
+	data := cache.getIndexEntry(hash)
+	if data == nil || data.GetDropped() {
+		return
+	}
+	size := data.GetSize()
+	if data.GetEncoding() != "" {
+		size = data.GetContentSize()
+	}
+	cache.countUse(size, true)
+	cache.submitSample(&sample{
+		hash:    hash,
+		useTime: time.Now().Unix(),
+		size:    data.GetSize(),
+	})
+}
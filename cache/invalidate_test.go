@@ -0,0 +1,51 @@
+package cache
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *MySuite) TestInvalidate(c *C) {
+	tempDir, err := ioutil.TempDir("", "jvproxy-test")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(tempDir)
+
+	cache, err := NewLevelDBCache(tempDir, nil)
+	c.Assert(err, IsNil)
+	defer cache.Close()
+
+	store := func(url, lang string) {
+		meta := &MetaData{
+			StatusCode: 200,
+			Header:     http.Header{},
+		}
+		meta.Header.Set("Vary", "Accept-Language")
+		meta.Header.Set("Accept-Language", lang)
+		entry := cache.StoreStart(url, meta)
+		n, err := io.Copy(ioutil.Discard,
+			entry.Reader(strings.NewReader(url+" "+lang)))
+		c.Assert(err, IsNil)
+		entry.Commit(n)
+	}
+	count := func(url, lang string) int {
+		req, _ := http.NewRequest("GET", url, nil)
+		req.Header.Set("Accept-Language", lang)
+		return len(cache.Retrieve(req))
+	}
+
+	store("http://example.com/a", "en")
+	store("http://example.com/a", "de")
+	store("http://example.com/ab", "en")
+	c.Assert(count("http://example.com/a", "en"), Equals, 1)
+	c.Assert(count("http://example.com/a", "de"), Equals, 1)
+
+	cache.Invalidate("http://example.com/a")
+	c.Assert(count("http://example.com/a", "en"), Equals, 0)
+	c.Assert(count("http://example.com/a", "de"), Equals, 0)
+	c.Assert(count("http://example.com/ab", "en"), Equals, 1)
+}
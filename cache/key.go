@@ -0,0 +1,172 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+
+	"github.com/seehuhn/trace"
+	"github.com/syndtr/goleveldb/leveldb"
+	"golang.org/x/crypto/sha3"
+)
+
+// The keys of the metadata records identify a URL together with the
+// values of the request header fields nominated by the Vary header of
+// the response.  A key consists of the following components:
+//
+//	url hash     urlHashLen bytes
+//	url          4 byte length, followed by the URL
+//	field count  2 bytes
+//	fields       for each field: 4 byte length and the field name,
+//	             4 byte length and the normalized value
+//
+// All integers are big-endian.  The key starts with keyPrefix(url), so
+// that all records for a URL can be found by a prefix scan.  Since the
+// URL is length-prefixed, the scan never matches records for a
+// different URL.
+const urlHashLen = 8
+
+var errBadKey = errors.New("cache: malformed key")
+
+// keyPrefix returns the common prefix of the keys for all records
+// stored for `url`.
+func keyPrefix(url string) []byte {
+	res := make([]byte, urlHashLen, urlHashLen+4+len(url))
+	sha3.ShakeSum128(res, []byte(url))
+	res = appendString(res, url)
+	return res
+}
+
+func appendString(buf []byte, s string) []byte {
+	var n [4]byte
+	binary.BigEndian.PutUint32(n[:], uint32(len(s)))
+	buf = append(buf, n[:]...)
+	return append(buf, s...)
+}
+
+// urlToKey returns the key for the response described by `meta`,
+// obtained from `url`.  The key includes the values of the request
+// header fields nominated by the Vary header of the response,
+// normalized using `vary`.
+func urlToKey(url string, meta *MetaData, vary VaryNormalizers) []byte {
+	fields := getVaryFields(meta.Header)
+	values := vary.getNormalizedHeaders(fields, meta.varyHeader(), meta.Header)
+	return encodeKey(url, fields, values)
+}
+
+func encodeKey(url string, fields, values []string) []byte {
+	res := keyPrefix(url)
+	n := len(fields)
+	res = append(res, byte(n/256), byte(n%256))
+	for i, name := range fields {
+		res = appendString(res, name)
+		res = appendString(res, values[i])
+	}
+	return res
+}
+
+// keyToURL decodes a key constructed by urlToKey.
+func keyToURL(key []byte) (url string, fields []string, values []string, err error) {
+	if len(key) < urlHashLen {
+		return "", nil, nil, errBadKey
+	}
+	urlHash, key := key[:urlHashLen], key[urlHashLen:]
+	readString := func() (string, bool) {
+		if len(key) < 4 {
+			return "", false
+		}
+		n := binary.BigEndian.Uint32(key)
+		if uint64(len(key)-4) < uint64(n) {
+			return "", false
+		}
+		s := string(key[4 : 4+n])
+		key = key[4+n:]
+		return s, true
+	}
+
+	url, ok := readString()
+	if !ok || len(key) < 2 {
+		return "", nil, nil, errBadKey
+	}
+	n := int(binary.BigEndian.Uint16(key))
+	key = key[2:]
+	for i := 0; i < n; i++ {
+		name, ok1 := readString()
+		value, ok2 := readString()
+		if !ok1 || !ok2 {
+			return "", nil, nil, errBadKey
+		}
+		fields = append(fields, name)
+		values = append(values, value)
+	}
+	if len(key) > 0 || !bytes.Equal(keyPrefix(url)[:urlHashLen], urlHash) {
+		return "", nil, nil, errBadKey
+	}
+	return url, fields, values, nil
+}
+
+// keyToURLV1 decodes a key in the format used before keys were
+// length-prefixed: the URL, a zero byte, the 2 byte field count and
+// the field names and values, separated by zero bytes.  This format
+// cannot represent URLs or values which contain zero bytes.
+func keyToURLV1(key []byte) (url string, fields []string, values []string, err error) {
+	pos := bytes.IndexByte(key, 0)
+	if pos < 0 || len(key) < pos+3 {
+		return "", nil, nil, errBadKey
+	}
+	url, key = string(key[:pos]), key[pos+1:]
+	n := int(key[0])*256 + int(key[1])
+	key = key[2:]
+	if n == 0 {
+		if len(key) > 0 {
+			return "", nil, nil, errBadKey
+		}
+		return url, nil, nil, nil
+	}
+	parts := bytes.Split(key, []byte{0})
+	if len(parts) != 2*n {
+		return "", nil, nil, errBadKey
+	}
+	for i := 0; i < n; i++ {
+		fields = append(fields, string(parts[2*i]))
+		values = append(values, string(parts[2*i+1]))
+	}
+	return url, fields, values, nil
+}
+
+// convertKey returns the current form of a key in the old format, or
+// nil if the key is current or cannot be decoded.
+func convertKey(key []byte) []byte {
+	_, _, _, err := keyToURL(key)
+	if err == nil {
+		return nil
+	}
+	url, fields, values, err := keyToURLV1(key)
+	if err != nil {
+		return nil
+	}
+	return encodeKey(url, fields, values)
+}
+
+// migrateKeys converts the keys of all metadata records to the current
+// format.  This is called when the cache is opened.
+func (cache *ldbCache) migrateKeys() error {
+	batch := new(leveldb.Batch)
+	iter := cache.meta.NewIterator(nil, nil)
+	for iter.Next() {
+		newKey := convertKey(iter.Key())
+		if newKey == nil {
+			continue
+		}
+		batch.Delete(append([]byte{}, iter.Key()...))
+		batch.Put(newKey, append([]byte{}, iter.Value()...))
+	}
+	iter.Release()
+	err := iter.Error()
+	if err != nil || batch.Len() == 0 {
+		return err
+	}
+	trace.T("jvproxy/cache", trace.PrioInfo,
+		"converting %d metadata keys", batch.Len()/2)
+	return cache.meta.Write(batch, nil)
+}
@@ -0,0 +1,167 @@
+package cache
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	. "gopkg.in/check.v1"
+)
+
+// keyV1 encodes a key in the format used before keys were
+// length-prefixed.
+func keyV1(url string, fields, values []string) []byte {
+	res := append([]byte(url), 0)
+	n := len(fields)
+	res = append(res, byte(n/256), byte(n%256))
+	for i, name := range fields {
+		res = append(res, name...)
+		res = append(res, 0)
+		res = append(res, values[i]...)
+		if i < n-1 {
+			res = append(res, 0)
+		}
+	}
+	return res
+}
+
+func (s *MySuite) TestKeyCollisions(c *C) {
+	// zero bytes no longer break the encoding
+	h := http.Header{}
+	h.Set("Vary", "A")
+	h.Set("A", "x\000y")
+	key := urlToKey("http://example.com/a\000b", &MetaData{Header: h}, defaultVaryNormalizers)
+	url, fields, values, err := keyToURL(key)
+	c.Assert(err, IsNil)
+	c.Check(url, Equals, "http://example.com/a\000b")
+	c.Check(fields, DeepEquals, []string{"A"})
+	c.Check(values, DeepEquals, []string{"x\000y"})
+
+	// a prefix scan for a URL does not find longer URLs
+	c.Check(bytes.HasPrefix(key, keyPrefix("http://example.com/a")), Equals, false)
+	c.Check(bytes.HasPrefix(key, keyPrefix("http://example.com/a\000b")), Equals, true)
+
+	_, _, _, err = keyToURL(key[:len(key)-1])
+	c.Check(err, NotNil)
+	_, _, _, err = keyToURL(keyV1("http://example.com/", nil, nil))
+	c.Check(err, NotNil)
+}
+
+func (s *MySuite) TestKeyMigration(c *C) {
+	tempDir, err := ioutil.TempDir("", "jvproxy-test")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(tempDir)
+
+	h := http.Header{}
+	h.Set("Vary", "Accept-Language")
+	h.Set("Accept-Language", "de")
+	store, err := NewLevelDBCache(tempDir, nil)
+	c.Assert(err, IsNil)
+	storeString(c, store, "http://example.com/", h, "Hallo")
+	h.Set("Accept-Language", "en")
+	storeString(c, store, "http://example.com/", h, "Hello")
+	storeString(c, store, "http://example.com/other", http.Header{}, "other")
+	c.Assert(store.Close(), IsNil)
+
+	// convert the keys to the old format
+	meta, err := leveldb.OpenFile(filepath.Join(tempDir, metaDirName), nil)
+	c.Assert(err, IsNil)
+	batch := new(leveldb.Batch)
+	iter := meta.NewIterator(nil, nil)
+	for iter.Next() {
+		url, fields, values, err := keyToURL(iter.Key())
+		c.Assert(err, IsNil)
+		batch.Delete(append([]byte{}, iter.Key()...))
+		batch.Put(keyV1(url, fields, values), append([]byte{}, iter.Value()...))
+	}
+	iter.Release()
+	c.Assert(iter.Error(), IsNil)
+	c.Assert(meta.Write(batch, nil), IsNil)
+	c.Assert(meta.Close(), IsNil)
+
+	report, err := Check(tempDir, false)
+	c.Assert(err, IsNil)
+	c.Check(report.OK(), Equals, true, Commentf("%s", report))
+	c.Check(report.OldMeta, Equals, 3)
+
+	// the keys are converted when the cache is opened
+	store, err = NewLevelDBCache(tempDir, nil)
+	c.Assert(err, IsNil)
+	for _, lang := range []string{"de", "en"} {
+		req, _ := http.NewRequest("GET", "http://example.com/", nil)
+		req.Header.Set("Accept-Language", lang)
+		entries := store.Retrieve(req)
+		c.Assert(entries, HasLen, 1)
+		c.Check(readBody(c, entries[0]), Equals, map[string]string{
+			"de": "Hallo",
+			"en": "Hello",
+		}[lang])
+	}
+	store.Invalidate("http://example.com/other")
+	req, _ := http.NewRequest("GET", "http://example.com/other", nil)
+	c.Check(store.Retrieve(req), HasLen, 0)
+	c.Assert(store.Close(), IsNil)
+
+	report, err = Check(tempDir, false)
+	c.Assert(err, IsNil)
+	c.Check(report.MetaRecords, Equals, 2)
+	c.Check(report.OldMeta, Equals, 0)
+}
+
+func FuzzKeys(f *testing.F) {
+	f.Add("http://example.com/", "", "", "", "")
+	f.Add("http://example.com/a\000b", "Accept", "text/html", "Accept-Language", "")
+	f.Add("", "\000", "\000\000", "A", "B")
+	f.Fuzz(func(t *testing.T, url, name1, value1, name2, value2 string) {
+		cases := [][2][]string{
+			{nil, nil},
+			{{name1}, {value1}},
+			{{name1, name2}, {value1, value2}},
+		}
+		for _, test := range cases {
+			fields, values := test[0], test[1]
+			key := encodeKey(url, fields, values)
+			if !bytes.HasPrefix(key, keyPrefix(url)) {
+				t.Fatalf("key %q does not start with the URL prefix", key)
+			}
+			url2, fields2, values2, err := keyToURL(key)
+			if err != nil {
+				t.Fatalf("cannot decode %q: %s", key, err)
+			}
+			if url2 != url || !reflect.DeepEqual(fields2, fields) ||
+				!reflect.DeepEqual(values2, values) {
+				t.Fatalf("%q: got %q %q %q", key, url2, fields2, values2)
+			}
+		}
+	})
+}
+
+func FuzzKeyToURL(f *testing.F) {
+	f.Add(urlToKey("http://example.com/", &MetaData{}, defaultVaryNormalizers))
+	f.Add(keyV1("http://example.com/", []string{"A"}, []string{"a"}))
+	f.Add([]byte{})
+	f.Fuzz(func(t *testing.T, key []byte) {
+		url, fields, values, err := keyToURL(key)
+		if err == nil {
+			// the encoding is unique
+			key2 := encodeKey(url, fields, values)
+			if !bytes.Equal(key2, key) {
+				t.Fatalf("%q decodes to %q %q %q, which encodes as %q",
+					key, url, fields, values, key2)
+			}
+		}
+
+		newKey := convertKey(key)
+		if newKey != nil {
+			_, _, _, err := keyToURL(newKey)
+			if err != nil {
+				t.Fatalf("converted key %q cannot be decoded: %s", newKey, err)
+			}
+		}
+	})
+}
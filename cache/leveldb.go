@@ -1,13 +1,14 @@
 package cache
 
 import (
-	"bytes"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/golang/protobuf/proto"
@@ -26,10 +27,25 @@ const (
 
 const hashLen = 32
 
+// A sample reports a use or a change of stored data to the cache
+// manager.  `useTime` is zero if the data was not used, `expiry` is
+// nil if the responses using the data did not change, and `format` is
+// only set for newly stored data.  `refs` is the change in the number
+// of metadata records using the data.  If `size` is -1, the sample
+// only changes an existing index entry.  For samples which add
+// references, `generation` is set to the generation of the index entry
+// by the cache manager, or left at zero if the reference could not be
+// counted.  If `wait` is not nil, it is closed once the index has been
+// updated.
 type sample struct {
-	hash    []byte
-	useTime int64
-	size    int64
+	hash       []byte
+	useTime    int64
+	size       int64
+	expiry     *expiry
+	format     *storedFormat
+	refs       int32
+	generation int64
+	wait       chan<- struct{}
 }
 
 type ldbCache struct {
@@ -38,14 +54,56 @@ type ldbCache struct {
 	index   *leveldb.DB
 	meta    *leveldb.DB
 
-	submit chan *sample
+	submit  chan *sample
+	sweep   chan *sweepRequest
+	corrupt chan []byte
+
+	// done is closed by Close, to stop the background goroutines
+	// tracked by wg.
+	done      chan struct{}
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+	closeErr  error
+
+	partialMutex sync.Mutex
+
+	// metaMutex serialises changes to the metadata records, so that
+	// the reference counts in the index stay correct.
+	metaMutex sync.Mutex
+
+	pendingMutex sync.Mutex
+	pending      map[string]*pendingEntry
+
+	usageMutex      sync.Mutex
+	usageCond       *sync.Cond
+	options         LevelDBOptions
+	totalBytes      int64
+	totalEntries    int64
+	partialBytes    int64
+	integrityErrors int64
+	policy          EvictionPolicy
+	stats           EvictionStats
+
+	// generation is the most recent generation assigned to an index
+	// entry, see newGeneration.
+	generation int64
 }
 
 // NewLevelDBCache creates a new `Cache` object, with on-disk backing
 // store in the directory `baseDir`.  If an existing cache is
 // discovered in `baseDir`, this cache is used, otherwise a new cache
-// is created.
-func NewLevelDBCache(baseDir string) (Cache, error) {
+// is created.  The size limits of the cache are given by `opts`; if
+// this is nil, DefaultLevelDBOptions is used.  The returned Cache
+// also implements the Configurable interface.
+func NewLevelDBCache(baseDir string, opts *LevelDBOptions) (Cache, error) {
+	if opts == nil {
+		opts = &DefaultLevelDBOptions
+	}
+	err := opts.check()
+	if err != nil {
+		return nil, err
+	}
+
 	// create store directory hierarchy
 	directories := []string{
 		baseDir,
@@ -60,6 +118,10 @@ func NewLevelDBCache(baseDir string) (Cache, error) {
 	directories = append(directories, metaDir)
 	newDir := filepath.Join(baseDir, newDirName)
 	directories = append(directories, newDir)
+	partialDir := filepath.Join(baseDir, partialDirName)
+	directories = append(directories, partialDir)
+	quarantineDir := filepath.Join(baseDir, quarantineDirName)
+	directories = append(directories, quarantineDir)
 
 	didCreate := false
 	for _, dirName := range directories {
@@ -90,23 +152,149 @@ func NewLevelDBCache(baseDir string) (Cache, error) {
 		index:   index,
 		meta:    meta,
 		submit:  make(chan *sample, 16),
+		sweep:   make(chan *sweepRequest),
+		corrupt: make(chan []byte),
+		done:    make(chan struct{}),
+		pending: make(map[string]*pendingEntry),
+		options: *opts,
+	}
+	res.usageCond = sync.NewCond(&res.usageMutex)
+	res.setPolicy(opts.Policy)
+	err = res.migrateKeys()
+	if err == nil {
+		err = res.migrateMeta()
+	}
+	if err == nil {
+		err = res.countReferences()
 	}
-	go res.manageIndex()
+	if err != nil {
+		index.Close()
+		meta.Close()
+		return nil, err
+	}
+	res.countPartial()
+	res.wg.Add(1)
+	go func() {
+		defer res.wg.Done()
+		res.manageIndex()
+	}()
 
 	return res, nil
 }
 
+// Close implements the corresponding method of the Cache interface.
+// The background goroutines are stopped, samples already submitted
+// are recorded in the index, and both databases are closed.  After
+// Close returns, the cache directory can be opened again.
 func (cache *ldbCache) Close() error {
-	return cache.meta.Close()
+	cache.closeOnce.Do(func() {
+		close(cache.done)
+		cache.usageMutex.Lock()
+		cache.usageCond.Broadcast()
+		cache.usageMutex.Unlock()
+		cache.wg.Wait()
+
+		err1 := cache.index.Close()
+		err2 := cache.meta.Close()
+		if err1 != nil {
+			cache.closeErr = err1
+		} else {
+			cache.closeErr = err2
+		}
+	})
+	return cache.closeErr
+}
+
+// isClosed checks whether Close has been called.
+func (cache *ldbCache) isClosed() bool {
+	select {
+	case <-cache.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// submitSample passes `s` to the cache manager.  Samples submitted
+// after the cache has been closed are ignored.
+func (cache *ldbCache) submitSample(s *sample) {
+	select {
+	case cache.submit <- s:
+	case <-cache.done:
+	}
+}
+
+// linkContent moves new content into the content store.  If the same
+// content is stored already, the existing file is used, and `s` is
+// changed to describe the existing file.  The return value indicates
+// whether the content is available.
+func (cache *ldbCache) linkContent(fname string, s *sample) bool {
+	storeName := cache.getStoreName(s.hash)
+	err := os.Link(fname, storeName)
+	if err == nil {
+		trace.T("jvproxy/cache", trace.PrioDebug,
+			"new cache entry %s", storeName)
+		return true
+	}
+	if !os.IsExist(err) {
+		trace.T("jvproxy/cache", trace.PrioError,
+			"cannot create %s: %s", storeName, err.Error())
+		return false
+	}
+
+	// The content is shared with other stored responses.
+	fi, err := os.Stat(storeName)
+	if err != nil {
+		return false
+	}
+	s.size = fi.Size()
+	s.format = nil
+	trace.T("jvproxy/cache", trace.PrioDebug,
+		"reusing cache entry %s", storeName)
+	return true
+}
+
+// storeMeta stores the metadata record for new content, after the
+// reference has been added to the index.
+func (cache *ldbCache) storeMeta(key, value []byte) {
+	old, err := cache.putMeta(key, value)
+	if err != nil {
+		trace.T("jvproxy/cache", trace.PrioError,
+			"cannot store cache entry in leveldb: %s", err.Error())
+		cache.releaseRef(metaRecordRef(value))
+		return
+	}
+	if old.hash != nil {
+		cache.releaseRef(old)
+	}
+}
+
+// storeSample passes a sample which adds a reference to the cache
+// manager, and waits until the index has been updated.  The return
+// value is the generation of the index entry which counts the
+// reference, or 0 if the reference was not counted.  Readers find the
+// content-coding in the index, so the metadata must only be stored
+// afterwards.
+func (cache *ldbCache) storeSample(s *sample) int64 {
+	wait := make(chan struct{})
+	s.wait = wait
+	select {
+	case cache.submit <- s:
+		select {
+		case <-wait:
+			return s.generation
+		case <-cache.done:
+		}
+	case <-cache.done:
+	}
+	return 0
 }
 
 func (cache *ldbCache) Retrieve(req *http.Request) []*Entry {
 	res := make([]*Entry, 0, 1)
 
 	url := req.URL.String()
-	keyPfx := make([]byte, len(url)+1)
-	copy(keyPfx, url)
-	limits := util.BytesPrefix(keyPfx)
+	limits := util.BytesPrefix(keyPrefix(url))
 	iter := cache.meta.NewIterator(limits, nil)
 	defer func() {
 		iter.Release()
@@ -116,126 +304,215 @@ func (cache *ldbCache) Retrieve(req *http.Request) []*Entry {
 				"error while using levelDB iterator: %s", err.Error())
 		}
 	}()
+	vary := cache.varyNormalizers()
 	for iter.Next() {
-		key := iter.Key()
-		_, fields, values := keyToURL(key)
-		if !varyHeadersMatch(fields, values, req.Header) {
+		_, fields, values, err := keyToURL(iter.Key())
+		if err != nil {
 			continue
 		}
-
-		value := iter.Value()
-		contentHash := value[:hashLen]
-		metaData := decodeMetaData(value[hashLen:])
-		if metaData == nil {
+		record, _ := parseMetaRecord(iter.Value())
+		if record == nil {
+			trace.T("jvproxy/cache", trace.PrioError,
+				"cannot decode metadata record for %s", url)
 			continue
 		}
+		metaData := metaDataFromPB(record)
+		if !vary.varyHeadersMatch(fields, values, req.Header, metaData.Header) {
+			continue
+		}
+		contentHash := record.ContentHash
 
 		entry := &Entry{
 			MetaData: *metaData,
 			GetBody: func() io.ReadCloser {
-				fname := cache.getStoreName(contentHash)
-				body, err := os.Open(fname)
-				if err == nil {
-					fi, err := body.Stat()
-					if err != nil {
-						trace.T("jvproxy/cache", trace.PrioError,
-							"cannot stat %s: %s", fname, err.Error())
-						return nil
-					}
-					cache.submit <- &sample{
-						hash:    contentHash,
-						useTime: time.Now().Unix(),
-						size:    fi.Size(),
-					}
-				} else {
-					if !os.IsNotExist(err) {
-						trace.T("jvproxy/cache", trace.PrioError,
-							"cannot read %s: %s", fname, err.Error())
-					}
-				}
-				return body
+				return cache.openContent(contentHash, true)
 			},
 			CacheID: contentHash,
 			Source:  "cache",
 		}
+		data := cache.getIndexEntry(contentHash)
+		entry.Dropped = data.GetDropped()
+		entry.Encoding = data.GetEncoding()
+		// Compressed bytes cannot be checked while they are
+		// sent, so with VerifyReads the body is always
+		// decompressed.
+		if entry.Encoding != "" && !cache.Options().VerifyReads {
+			entry.GetEncodedBody = func() io.ReadCloser {
+				return cache.openContent(contentHash, false)
+			}
+		}
 
 		res = append(res, entry)
 	}
+
+	for _, p := range cache.getPending(url) {
+		_, fields, values, err := keyToURL(p.key)
+		if err == nil && vary.varyHeadersMatch(fields, values, req.Header, p.meta.Header) {
+			res = append(res, cache.pendingToEntry(p))
+		}
+	}
 	return res
 }
 
+// openContent opens the stored content with the given hash, and
+// records the use in the index.  If `decode` is set, compressed
+// content is decompressed while it is read.  If the content has been
+// removed, nil is returned.
+func (cache *ldbCache) openContent(hash []byte, decode bool) io.ReadCloser {
+	fname := cache.getStoreName(hash)
+	file, err := os.Open(fname)
+	if err != nil {
+		// The content may have been removed by the pruning code
+		// or by sweepExpired.
+		if !os.IsNotExist(err) {
+			trace.T("jvproxy/cache", trace.PrioError,
+				"cannot read %s: %s", fname, err.Error())
+		}
+		return nil
+	}
+	fi, err := file.Stat()
+	if err != nil {
+		trace.T("jvproxy/cache", trace.PrioError,
+			"cannot stat %s: %s", fname, err.Error())
+		file.Close()
+		return nil
+	}
+
+	size := fi.Size()
+	encoding := ""
+	if data := cache.getIndexEntry(hash); data.GetEncoding() != "" {
+		encoding = data.GetEncoding()
+		size = data.GetContentSize()
+	}
+	var body readSeekCloser = file
+	if encoding != "" && decode {
+		body, err = newDecodingReader(file, encoding, size)
+		if err != nil {
+			trace.T("jvproxy/cache", trace.PrioError,
+				"cannot decode %s: %s", fname, err.Error())
+			file.Close()
+			return nil
+		}
+	}
+
+	cache.countUse(size, true)
+	cache.submitSample(&sample{
+		hash:    hash,
+		useTime: time.Now().Unix(),
+		size:    fi.Size(),
+	})
+	if encoding != "" && !decode {
+		return body
+	}
+	if cache.Options().VerifyReads {
+		return newVerifyingReader(cache, body, fname, hash, size)
+	}
+	return body
+}
+
 func (cache *ldbCache) StoreStart(url string, meta *MetaData) StoreCont {
+	maxSize := cache.Options().MaxObjectSize
+	if maxSize > 0 {
+		size, err := strconv.ParseInt(meta.Header.Get("Content-Length"), 10, 64)
+		if err == nil && size > maxSize {
+			trace.T("jvproxy/cache", trace.PrioDebug,
+				"not storing %s, %s is too large", url, byteSize(size))
+			return &nullEntry{}
+		}
+	}
+
 	store, err := ioutil.TempFile(cache.newDir, "")
 	if err != nil {
 		panic(err)
 	}
+	key := urlToKey(url, meta, cache.varyNormalizers())
+	pending := newPendingEntry(cache, key, meta, store.Name())
+	cache.addPending(pending)
 	return &ldbEntry{
 		cache:    cache,
 		store:    store,
 		hash:     sha3.NewShake128(),
 		metaData: meta.encode(),
-		key:      urlToKey(url, meta.Header),
+		expiry:   getExpiry(meta),
+		encoding: cache.Options().encodingFor(meta.Header),
+		key:      key,
+		pending:  pending,
 	}
 }
 
 func (cache *ldbCache) Update(url string, entry *Entry) {
-	key := urlToKey(url, entry.Header)
-	rawMeta := entry.MetaData.encode()
-	value := make([]byte, hashLen+len(rawMeta))
-	copy(value[:hashLen], entry.CacheID)
-	copy(value[hashLen:], rawMeta)
-	cache.meta.Put(key, value, nil)
-}
-
-func (cache *ldbCache) getStoreName(hash []byte) string {
-	a := fmt.Sprintf("%02x", hash[0])
-	b := fmt.Sprintf("%x", hash[1:])
-	return filepath.Join(cache.baseDir, a, b)
+	if len(entry.CacheID) != hashLen {
+		// The entry is still being stored, see pending.go.
+		return
+	}
+	key := urlToKey(url, &entry.MetaData, cache.varyNormalizers())
+
+	// Revalidation changes the expiry time recorded in the index.
+	// The updated record normally replaces a record for the same
+	// content, so that the reference count does not change.
+	gen := cache.storeSample(&sample{
+		hash:   entry.CacheID,
+		size:   -1,
+		expiry: getExpiry(&entry.MetaData),
+		refs:   1,
+	})
+	if gen == 0 {
+		// The content has been removed from the index.
+		return
+	}
+	value := newMetaRecord(entry.CacheID, gen, entry.MetaData.encode())
+	old, err := cache.putMeta(key, value)
+	if err != nil {
+		trace.T("jvproxy/cache", trace.PrioError,
+			"cannot update cache entry in leveldb: %s", err.Error())
+		cache.releaseRef(contentRef{entry.CacheID, gen})
+		return
+	}
+	if old.hash != nil {
+		cache.releaseRef(old)
+	}
 }
 
-func urlToKey(url string, header http.Header) []byte {
-	// TODO(voss): check that url contains no '\0' bytes?  To be safe,
-	// maybe encode strings with leading length (using the
-	// encoding/binary module)?
-	var res []byte
-	res = append(res, []byte(url)...)
-	res = append(res, 0)
-
-	varyFields := getVaryFields(header)
-	n := len(varyFields)
-	res = append(res, byte(n/256), byte(n%256))
-	varyValues := getNormalizedHeaders(varyFields, header)
-	for i, name := range varyFields {
-		res = append(res, name...)
-		res = append(res, 0)
-		res = append(res, varyValues[i]...)
-		if i < n-1 {
-			res = append(res, 0)
+// Invalidate implements the corresponding method of the Cache
+// interface.  The metadata is removed here, and the references to the
+// content are released.  Content files are removed by the cache
+// manager, once they are no longer used by any other URL.
+func (cache *ldbCache) Invalidate(url string) {
+	cache.metaMutex.Lock()
+	iter := cache.meta.NewIterator(util.BytesPrefix(keyPrefix(url)), nil)
+	batch := new(leveldb.Batch)
+	var refs []contentRef
+	for iter.Next() {
+		batch.Delete(append([]byte(nil), iter.Key()...))
+		if ref := metaRecordRef(iter.Value()); ref.hash != nil {
+			refs = append(refs, ref)
 		}
 	}
-	return res
-}
+	iter.Release()
+	err := iter.Error()
+	if err == nil {
+		err = cache.meta.Write(batch, nil)
+	}
+	cache.metaMutex.Unlock()
+	if err != nil {
+		trace.T("jvproxy/cache", trace.PrioError,
+			"cannot invalidate %s: %s", url, err.Error())
+		return
+	}
 
-func keyToURL(key []byte) (url string, fields []string, values []string) {
-	pos := bytes.IndexByte(key, '\000')
-	url, key = string(key[:pos]), key[pos+1:]
-	n := int(key[0])*256 + int(key[1])
-	key = key[2:]
-	for i := 0; i < n; i++ {
-		pos = bytes.IndexByte(key, '\000')
-		var name string
-		name, key = string(key[:pos]), key[pos+1:]
-		fields = append(fields, name)
-		var value []byte
-		if i < n-1 {
-			pos = bytes.IndexByte(key, '\000')
-			value, key = key[:pos], key[pos+1:]
-		} else {
-			value = key
-		}
-		values = append(values, string(value))
+	for _, ref := range refs {
+		cache.releaseRef(ref)
+	}
+	if n := batch.Len(); n > 0 {
+		trace.T("jvproxy/cache", trace.PrioDebug,
+			"invalidated %d entries for %s", n, url)
 	}
-	return
+}
+
+func (cache *ldbCache) getStoreName(hash []byte) string {
+	a := fmt.Sprintf("%02x", hash[0])
+	b := fmt.Sprintf("%x", hash[1:])
+	return filepath.Join(cache.baseDir, a, b)
 }
 
 func (meta *MetaData) encode() []byte {
@@ -248,6 +525,11 @@ func (meta *MetaData) encode() []byte {
 	}
 	data.ResponseTime = proto.Int64(meta.ResponseTime.UnixNano())
 	data.ResponseDelay = proto.Int64(int64(meta.ResponseDelay))
+	for key, vals := range meta.VaryHeader {
+		for _, val := range vals {
+			data.VaryHeader = append(data.VaryHeader, key, val)
+		}
+	}
 	raw, err := proto.Marshal(data)
 	if err != nil {
 		panic(err)
@@ -264,7 +546,10 @@ func decodeMetaData(raw []byte) *MetaData {
 			err.Error())
 		return nil
 	}
+	return metaDataFromPB(data)
+}
 
+func metaDataFromPB(data *pb.Meta) *MetaData {
 	meta := &MetaData{
 		StatusCode:    int(data.GetStatusCode()),
 		Header:        make(http.Header),
@@ -274,6 +559,12 @@ func decodeMetaData(raw []byte) *MetaData {
 	for i := 0; i < len(data.Header); i += 2 {
 		meta.Header.Add(data.Header[i], data.Header[i+1])
 	}
+	if len(data.VaryHeader) > 0 {
+		meta.VaryHeader = make(http.Header)
+		for i := 0; i+1 < len(data.VaryHeader); i += 2 {
+			meta.VaryHeader.Add(data.VaryHeader[i], data.VaryHeader[i+1])
+		}
+	}
 	return meta
 }
 
@@ -282,18 +573,36 @@ type ldbEntry struct {
 	store    *os.File
 	hash     sha3.ShakeHash
 	metaData []byte
+	expiry   *expiry
+	encoding string
 	key      []byte
+	pending  *pendingEntry
 }
 
 func (entry *ldbEntry) Reader(r io.Reader) io.Reader {
-	return io.TeeReader(io.TeeReader(r, entry.hash), entry.store)
+	w := &pendingWriter{
+		file:    entry.store,
+		pending: entry.pending,
+	}
+	return io.TeeReader(io.TeeReader(r, entry.hash), w)
+}
+
+// Follow implements the StoreFollower interface.
+func (entry *ldbEntry) Follow() io.ReadCloser {
+	return entry.pending.open()
 }
 
 func (entry *ldbEntry) Commit(size int64) {
 	now := time.Now()
 
 	tmpName := entry.store.Name()
+	var stored []byte
 	defer func() {
+		// Readers which are still following the temporary file
+		// keep their file handles, and can read to the end.
+		entry.cache.removePending(entry.pending)
+		entry.pending.commit(stored)
+
 		err := os.Remove(tmpName)
 		if err != nil {
 			trace.T("jvproxy/cache", trace.PrioError,
@@ -306,42 +615,57 @@ func (entry *ldbEntry) Commit(size int64) {
 		return
 	}
 
-	hash := make([]byte, hashLen+len(entry.metaData))
-	contentHash := hash[:hashLen]
-	_, err = io.ReadFull(entry.hash, contentHash)
-	if err != nil {
-		panic(err)
-	}
-	copy(hash[hashLen:], entry.metaData)
-
-	storeName := entry.cache.getStoreName(contentHash)
-	err = os.Link(tmpName, storeName)
-	if err == nil {
+	maxSize := entry.cache.Options().MaxObjectSize
+	if maxSize > 0 && size > maxSize {
 		trace.T("jvproxy/cache", trace.PrioDebug,
-			"new cache entry %s", storeName)
-	} else {
-		if !os.IsExist(err) {
-			trace.T("jvproxy/cache", trace.PrioError,
-				"cannot create %s: %s", storeName, err.Error())
-		}
+			"not storing %s, too large", byteSize(size))
 		return
 	}
 
-	err = entry.cache.meta.Put(entry.key, hash, nil)
+	contentHash := make([]byte, hashLen)
+	_, err = io.ReadFull(entry.hash, contentHash)
 	if err != nil {
-		trace.T("jvproxy/cache", trace.PrioError,
-			"cannot store cache entry in leveldb: %s", err.Error())
-		return
+		panic(err)
 	}
 
-	entry.cache.submit <- &sample{
+	// The hash is computed from the uncompressed body, so that
+	// identical bodies are stored only once, whether compressed
+	// or not.
+	s := &sample{
 		hash:    contentHash,
 		useTime: now.Unix(),
 		size:    size,
+		expiry:  entry.expiry,
+		format:  &storedFormat{size: size},
+		refs:    1,
 	}
+	srcName := tmpName
+	if entry.encoding != "" {
+		name, n := entry.cache.compressContent(tmpName, size, entry.encoding)
+		if name != "" {
+			defer os.Remove(name)
+			srcName = name
+			s.size = n
+			s.format.encoding = entry.encoding
+		}
+	}
+
+	if !entry.cache.linkContent(srcName, s) {
+		return
+	}
+	entry.cache.countUse(size, false)
+	gen := entry.cache.storeSample(s)
+	if gen == 0 {
+		return
+	}
+	entry.cache.storeMeta(entry.key, newMetaRecord(contentHash, gen, entry.metaData))
+	stored = contentHash
 }
 
 func (entry *ldbEntry) Discard() {
+	entry.cache.removePending(entry.pending)
+	entry.pending.finish(ErrIncomplete)
+
 	tmpName := entry.store.Name()
 	entry.store.Close()
 	err := os.Remove(tmpName)
@@ -1,16 +1,23 @@
 package cache
 
 import (
+	"fmt"
+	"io/ioutil"
 	"net/http"
+	"os"
+	"path/filepath"
 	"time"
 
+	"github.com/syndtr/goleveldb/leveldb"
+
 	. "gopkg.in/check.v1"
 )
 
 func (s *MySuite) TestKeys(c *C) {
 	testURL := "http://example.com/test"
-	key := urlToKey(testURL, nil)
-	url, fields, values := keyToURL(key)
+	key := urlToKey(testURL, &MetaData{}, defaultVaryNormalizers)
+	url, fields, values, err := keyToURL(key)
+	c.Assert(err, IsNil)
 	c.Assert(url, Equals, testURL)
 	c.Assert(fields, HasLen, 0)
 	c.Assert(values, HasLen, 0)
@@ -20,8 +27,9 @@ func (s *MySuite) TestKeys(c *C) {
 	h.Add("A", "first,  second")
 	h.Add("A", "third")
 	h.Add("C", "another")
-	key = urlToKey(testURL, h)
-	url, fields, values = keyToURL(key)
+	key = urlToKey(testURL, &MetaData{Header: h}, defaultVaryNormalizers)
+	url, fields, values, err = keyToURL(key)
+	c.Assert(err, IsNil)
 	c.Assert(url, Equals, testURL)
 	c.Assert(fields, DeepEquals, []string{"A", "B", "C"})
 	c.Assert(values, DeepEquals, []string{"first,second,third", "", "another"})
@@ -38,3 +46,43 @@ func (s *MySuite) TestMetaDataEncoding(c *C) {
 	meta2 := decodeMetaData(raw)
 	c.Assert(meta, DeepEquals, meta2)
 }
+
+func (s *MySuite) TestCloseReopen(c *C) {
+	tempDir, err := ioutil.TempDir("", "jvproxy-test")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(tempDir)
+
+	for i := 0; i < 3; i++ {
+		cache, err := NewLevelDBCache(tempDir, nil)
+		c.Assert(err, IsNil)
+		for j := 0; j < 2; j++ {
+			url := fmt.Sprintf("http://example.com/%d/%d", i, j)
+			storeString(c, cache, url, http.Header{}, url)
+		}
+		c.Assert(cache.Close(), IsNil)
+		c.Assert(cache.Close(), IsNil)
+
+		// All samples must be recorded in the index by Close.
+		index, err := leveldb.OpenFile(filepath.Join(tempDir, indexDirName), nil)
+		c.Assert(err, IsNil)
+		iter := index.NewIterator(nil, nil)
+		n := 0
+		for iter.Next() {
+			n++
+		}
+		iter.Release()
+		c.Assert(index.Close(), IsNil)
+		c.Check(n, Equals, 2*(i+1))
+	}
+
+	cache, err := NewLevelDBCache(tempDir, nil)
+	c.Assert(err, IsNil)
+	defer cache.Close()
+	waitForUsage(c, cache.(Configurable), func(u LevelDBUsage) bool {
+		return u.Entries == 6
+	})
+	req, _ := http.NewRequest("GET", "http://example.com/0/1", nil)
+	entries := cache.Retrieve(req)
+	c.Assert(entries, HasLen, 1)
+	c.Check(readBody(c, entries[0]), Equals, "http://example.com/0/1")
+}
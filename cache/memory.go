@@ -0,0 +1,308 @@
+package cache
+
+import (
+	"bytes"
+	"container/list"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// MemoryCache is a Cache which keeps responses in memory.  When the
+// total size of the stored responses exceeds the byte budget, the
+// least recently used responses are removed.  All methods are safe
+// for concurrent use.
+type MemoryCache struct {
+	// VaryNormalizers gives the normalizers for the request header
+	// fields nominated by the Vary header field of a response.  If
+	// this is nil, DefaultVaryNormalizers is used.  This must not be
+	// changed once the cache is in use.
+	VaryNormalizers VaryNormalizers
+
+	mutex    sync.Mutex
+	maxBytes int64
+	size     int64
+	lru      *list.List // of *memEntry, most recently used first
+	urls     map[string]map[string]*list.Element
+	nextID   uint64
+	stats    MemoryStats
+}
+
+type memEntry struct {
+	url  string
+	key  string
+	id   []byte
+	meta *MetaData
+	body []byte
+	size int64
+}
+
+// MemoryStats summarises the state and use of a MemoryCache.
+type MemoryStats struct {
+	Entries   int
+	Bytes     int64
+	MaxBytes  int64
+	Hits      int64
+	Misses    int64
+	Stores    int64
+	Evictions int64
+}
+
+func (s MemoryStats) String() string {
+	ratio := 0.0
+	if s.Hits+s.Misses > 0 {
+		ratio = float64(s.Hits) / float64(s.Hits+s.Misses)
+	}
+	return fmt.Sprintf("%d entries, %s of %s used, %d hits, %d misses (%.1f%%), %d stores, %d evictions",
+		s.Entries, byteSize(s.Bytes), byteSize(s.MaxBytes),
+		s.Hits, s.Misses, 100*ratio, s.Stores, s.Evictions)
+}
+
+// NewMemoryCache creates a new, empty MemoryCache which uses at most
+// `maxBytes` bytes for stored responses.
+func NewMemoryCache(maxBytes int64) *MemoryCache {
+	return &MemoryCache{
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		urls:     make(map[string]map[string]*list.Element),
+	}
+}
+
+// Retrieve implements the corresponding method of the Cache interface.
+func (cache *MemoryCache) Retrieve(req *http.Request) []*Entry {
+	url := req.URL.String()
+
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	vary := cache.VaryNormalizers.orDefault()
+	var res []*Entry
+	for key, elem := range cache.urls[url] {
+		_, fields, values, err := keyToURL([]byte(key))
+		meta := elem.Value.(*memEntry).meta
+		if err != nil || !vary.varyHeadersMatch(fields, values, req.Header, meta.Header) {
+			continue
+		}
+		cache.lru.MoveToFront(elem)
+		res = append(res, elem.Value.(*memEntry).toEntry())
+	}
+	if len(res) > 0 {
+		cache.stats.Hits++
+	} else {
+		cache.stats.Misses++
+	}
+	return res
+}
+
+func (e *memEntry) toEntry() *Entry {
+	body := e.body
+	return &Entry{
+		MetaData: *e.meta.clone(),
+		GetBody: func() io.ReadCloser {
+			return memBody{bytes.NewReader(body)}
+		},
+		CacheID: e.id,
+		Source:  "cache",
+	}
+}
+
+// memBody is the io.ReadCloser returned by Entry.GetBody for entries
+// of a MemoryCache.  It also implements io.Seeker.
+type memBody struct {
+	*bytes.Reader
+}
+
+func (memBody) Close() error {
+	return nil
+}
+
+// StoreStart implements the corresponding method of the Cache
+// interface.
+func (cache *MemoryCache) StoreStart(url string, meta *MetaData) StoreCont {
+	return cache.storeStartID(url, meta, nil, 0)
+}
+
+// storeStartID is like StoreStart, but uses `id` as the CacheID of
+// the new entry.  If `id` is nil, a new ID is allocated.  Bodies
+// larger than `limit` bytes are not stored; if `limit` is zero, the
+// byte budget of the cache is used as the limit.
+func (cache *MemoryCache) storeStartID(url string, meta *MetaData, id []byte, limit int64) *memStoreCont {
+	if limit <= 0 || limit > cache.maxBytes {
+		limit = cache.maxBytes
+	}
+	return &memStoreCont{
+		cache: cache,
+		url:   url,
+		key:   string(urlToKey(url, meta, cache.VaryNormalizers.orDefault())),
+		meta:  meta.clone(),
+		id:    id,
+		limit: limit,
+	}
+}
+
+// StorePartial implements the corresponding method of the Cache
+// interface.  Partial responses are not stored by a MemoryCache.
+func (cache *MemoryCache) StorePartial(string, *MetaData, int64, int64) StoreCont {
+	return &nullEntry{}
+}
+
+// Invalidate implements the corresponding method of the Cache
+// interface.
+func (cache *MemoryCache) Invalidate(url string) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	for _, elem := range cache.urls[url] {
+		cache.remove(elem)
+	}
+}
+
+// Update implements the corresponding method of the Cache interface.
+func (cache *MemoryCache) Update(url string, entry *Entry) {
+	key := string(urlToKey(url, &entry.MetaData, cache.VaryNormalizers.orDefault()))
+
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	for _, elem := range cache.urls[url] {
+		e := elem.Value.(*memEntry)
+		if !bytes.Equal(e.id, entry.CacheID) {
+			continue
+		}
+		cache.remove(elem)
+		meta := entry.MetaData.clone()
+		cache.insert(&memEntry{
+			url:  url,
+			key:  key,
+			id:   e.id,
+			meta: meta,
+			body: e.body,
+			size: entrySize(key, meta, e.body),
+		})
+		return
+	}
+}
+
+// Close implements the corresponding method of the Cache interface.
+// All stored responses are discarded.
+func (cache *MemoryCache) Close() error {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	cache.lru.Init()
+	cache.urls = make(map[string]map[string]*list.Element)
+	cache.size = 0
+	return nil
+}
+
+// Stats returns information about the current state of the cache.
+func (cache *MemoryCache) Stats() MemoryStats {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	res := cache.stats
+	res.Entries = cache.lru.Len()
+	res.Bytes = cache.size
+	res.MaxBytes = cache.maxBytes
+	return res
+}
+
+// insert adds a new entry, replacing any existing entry with the same
+// key, and evicts least recently used entries until the cache is
+// within its byte budget.  The caller must hold cache.mutex.
+func (cache *MemoryCache) insert(e *memEntry) {
+	variants := cache.urls[e.url]
+	if variants == nil {
+		variants = make(map[string]*list.Element)
+		cache.urls[e.url] = variants
+	} else if old, ok := variants[e.key]; ok {
+		cache.remove(old)
+	}
+	variants[e.key] = cache.lru.PushFront(e)
+	cache.size += e.size
+
+	for cache.size > cache.maxBytes {
+		cache.remove(cache.lru.Back())
+		cache.stats.Evictions++
+	}
+}
+
+// remove deletes an entry from the cache.  The caller must hold
+// cache.mutex.
+func (cache *MemoryCache) remove(elem *list.Element) {
+	e := cache.lru.Remove(elem).(*memEntry)
+	cache.size -= e.size
+	variants := cache.urls[e.url]
+	delete(variants, e.key)
+	if len(variants) == 0 {
+		delete(cache.urls, e.url)
+	}
+}
+
+// entrySize estimates the memory used by a stored response.
+func entrySize(key string, meta *MetaData, body []byte) int64 {
+	size := len(key) + len(body)
+	for name, vals := range meta.Header {
+		for _, val := range vals {
+			size += len(name) + len(val)
+		}
+	}
+	return int64(size)
+}
+
+type memStoreCont struct {
+	cache    *MemoryCache
+	url      string
+	key      string
+	meta     *MetaData
+	id       []byte
+	limit    int64
+	buf      bytes.Buffer
+	tooLarge bool
+}
+
+func (entry *memStoreCont) Reader(r io.Reader) io.Reader {
+	return io.TeeReader(r, entry)
+}
+
+func (entry *memStoreCont) Write(p []byte) (int, error) {
+	if !entry.tooLarge {
+		if int64(entry.buf.Len()+len(p)) > entry.limit {
+			entry.tooLarge = true
+			entry.buf = bytes.Buffer{}
+		} else {
+			entry.buf.Write(p)
+		}
+	}
+	return len(p), nil
+}
+
+func (entry *memStoreCont) Commit(size int64) {
+	body := entry.buf.Bytes()
+	if entry.tooLarge || int64(len(body)) != size {
+		return
+	}
+	e := &memEntry{
+		url:  entry.url,
+		key:  entry.key,
+		id:   entry.id,
+		meta: entry.meta,
+		body: body,
+		size: entrySize(entry.key, entry.meta, body),
+	}
+	if e.size > entry.cache.maxBytes {
+		return
+	}
+
+	cache := entry.cache
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	if e.id == nil {
+		cache.nextID++
+		e.id = []byte(strconv.FormatUint(cache.nextID, 16))
+	}
+	cache.insert(e)
+	cache.stats.Stores++
+}
+
+func (entry *memStoreCont) Discard() {
+	entry.buf = bytes.Buffer{}
+}
@@ -0,0 +1,104 @@
+package cache
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	. "gopkg.in/check.v1"
+)
+
+func storeString(c *C, cache Cache, url string, header http.Header, body string) {
+	meta := &MetaData{
+		StatusCode: 200,
+		Header:     header,
+	}
+	entry := cache.StoreStart(url, meta)
+	n, err := io.Copy(ioutil.Discard, entry.Reader(strings.NewReader(body)))
+	c.Assert(err, IsNil)
+	entry.Commit(n)
+}
+
+func readBody(c *C, entry *Entry) string {
+	body := entry.GetBody()
+	c.Assert(body, NotNil)
+	defer body.Close()
+	data, err := ioutil.ReadAll(body)
+	c.Assert(err, IsNil)
+	return string(data)
+}
+
+func (s *MySuite) TestMemoryCache(c *C) {
+	cache := NewMemoryCache(1000)
+	defer cache.Close()
+
+	url := "http://example.com/"
+	req, _ := http.NewRequest("GET", url, nil)
+	c.Assert(cache.Retrieve(req), HasLen, 0)
+
+	h := http.Header{}
+	h.Set("Vary", "Accept-Language")
+	h.Set("Accept-Language", "en")
+	storeString(c, cache, url, h, "hello")
+	h = http.Header{}
+	h.Set("Vary", "Accept-Language")
+	h.Set("Accept-Language", "de")
+	storeString(c, cache, url, h, "hallo")
+
+	req.Header.Set("Accept-Language", "de")
+	entries := cache.Retrieve(req)
+	c.Assert(entries, HasLen, 1)
+	c.Assert(readBody(c, entries[0]), Equals, "hallo")
+	_, isSeeker := entries[0].GetBody().(io.Seeker)
+	c.Assert(isSeeker, Equals, true)
+
+	entries[0].Header.Set("X-Updated", "yes")
+	cache.Update(url, entries[0])
+	entries = cache.Retrieve(req)
+	c.Assert(entries, HasLen, 1)
+	c.Assert(entries[0].Header.Get("X-Updated"), Equals, "yes")
+	c.Assert(readBody(c, entries[0]), Equals, "hallo")
+
+	stats := cache.Stats()
+	c.Assert(stats.Entries, Equals, 2)
+	c.Assert(stats.Hits, Equals, int64(2))
+	c.Assert(stats.Misses, Equals, int64(1))
+	c.Assert(stats.Stores, Equals, int64(2))
+
+	cache.Invalidate(url)
+	c.Assert(cache.Retrieve(req), HasLen, 0)
+	c.Assert(cache.Stats().Bytes, Equals, int64(0))
+}
+
+func (s *MySuite) TestMemoryCacheEviction(c *C) {
+	cache := NewMemoryCache(100)
+	defer cache.Close()
+
+	get := func(url string) int {
+		req, _ := http.NewRequest("GET", url, nil)
+		return len(cache.Retrieve(req))
+	}
+
+	body := strings.Repeat("x", 25)
+	storeString(c, cache, "http://a/", http.Header{}, body)
+	storeString(c, cache, "http://b/", http.Header{}, body)
+	c.Assert(get("http://a/"), Equals, 1)
+	storeString(c, cache, "http://c/", http.Header{}, body)
+
+	// "b" is the least recently used entry
+	c.Assert(get("http://b/"), Equals, 0)
+	c.Assert(get("http://a/"), Equals, 1)
+	c.Assert(get("http://c/"), Equals, 1)
+	c.Assert(cache.Stats().Evictions, Equals, int64(1))
+	c.Assert(cache.Stats().Bytes <= 100, Equals, true)
+
+	storeString(c, cache, "http://large/", http.Header{}, strings.Repeat("x", 200))
+	c.Assert(get("http://large/"), Equals, 0)
+	c.Assert(get("http://a/"), Equals, 1)
+
+	entry := cache.StoreStart("http://d/", &MetaData{Header: http.Header{}})
+	io.Copy(ioutil.Discard, entry.Reader(strings.NewReader(body)))
+	entry.Discard()
+	c.Assert(get("http://d/"), Equals, 0)
+}
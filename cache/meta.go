@@ -0,0 +1,104 @@
+package cache
+
+import (
+	"github.com/golang/protobuf/proto"
+	"github.com/seehuhn/jvproxy/cache/pb"
+	"github.com/seehuhn/trace"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// metaVersion is the format version of the metadata records.  The
+// value of a record is an encoded pb.Meta message, with Version set
+// to metaVersion and ContentHash giving the hash of the response body.
+// Generation gives the generation of the index entry which counts the
+// reference, see contentRef.  In version 1, which had no version
+// field, the value was the content hash, followed by the encoded
+// pb.Meta message.
+const metaVersion = 2
+
+// newMetaRecord returns the value of a metadata record for the
+// response body with the given hash, where the reference is counted in
+// the given generation of the index entry.  `rawMeta` is the output of
+// MetaData.encode.
+func newMetaRecord(hash []byte, generation int64, rawMeta []byte) []byte {
+	data := &pb.Meta{}
+	err := proto.Unmarshal(rawMeta, data)
+	if err != nil {
+		panic(err)
+	}
+	data.Version = proto.Int32(metaVersion)
+	data.ContentHash = append([]byte{}, hash...)
+	data.Generation = proto.Int64(generation)
+	raw, err := proto.Marshal(data)
+	if err != nil {
+		panic(err)
+	}
+	return raw
+}
+
+// parseMetaRecord decodes the value of a metadata record.  Records in
+// the version 1 format are converted; in this case `current` is
+// false.  If the value cannot be decoded, nil is returned.
+func parseMetaRecord(value []byte) (data *pb.Meta, current bool) {
+	data = &pb.Meta{}
+	err := proto.Unmarshal(value, data)
+	if err == nil && data.GetVersion() == metaVersion &&
+		len(data.ContentHash) == hashLen {
+		return data, true
+	}
+
+	if len(value) < hashLen {
+		return nil, false
+	}
+	data = &pb.Meta{}
+	err = proto.Unmarshal(value[hashLen:], data)
+	if err != nil || data.Version != nil {
+		return nil, false
+	}
+	data.Version = proto.Int32(metaVersion)
+	data.ContentHash = append([]byte{}, value[:hashLen]...)
+	return data, false
+}
+
+// metaRecordHash returns the content hash stored in a metadata record,
+// or nil if the record cannot be decoded.
+func metaRecordHash(value []byte) []byte {
+	data, _ := parseMetaRecord(value)
+	return data.GetContentHash()
+}
+
+// metaRecordRef returns the reference to the content stored in a
+// metadata record.  If the record cannot be decoded, the hash in the
+// result is nil.
+func metaRecordRef(value []byte) contentRef {
+	data, _ := parseMetaRecord(value)
+	return contentRef{data.GetContentHash(), data.GetGeneration()}
+}
+
+// migrateMeta converts all metadata records to the current format.
+// Records which cannot be decoded are left unchanged, these are
+// removed by Check.  This is called when the cache is opened.
+func (cache *ldbCache) migrateMeta() error {
+	batch := new(leveldb.Batch)
+	iter := cache.meta.NewIterator(nil, nil)
+	for iter.Next() {
+		data, current := parseMetaRecord(iter.Value())
+		if data == nil || current {
+			continue
+		}
+		raw, err := proto.Marshal(data)
+		if err != nil {
+			panic(err)
+		}
+		batch.Put(append([]byte{}, iter.Key()...), raw)
+	}
+	iter.Release()
+	err := iter.Error()
+	if err != nil || batch.Len() == 0 {
+		return err
+	}
+	trace.T("jvproxy/cache", trace.PrioInfo,
+		"converting %d metadata records to version %d",
+		batch.Len(), metaVersion)
+	return cache.meta.Write(batch, nil)
+}
@@ -0,0 +1,197 @@
+package cache
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/seehuhn/jvproxy/cache/pb"
+	"github.com/syndtr/goleveldb/leveldb"
+	. "gopkg.in/check.v1"
+)
+
+// metaHashes returns the content hashes of all metadata records, and
+// the number of records which are not in the current format.
+func metaHashes(c *C, meta *leveldb.DB) ([][]byte, int) {
+	var hashes [][]byte
+	old := 0
+	iter := meta.NewIterator(nil, nil)
+	for iter.Next() {
+		data, current := parseMetaRecord(iter.Value())
+		c.Assert(data, NotNil)
+		hashes = append(hashes, data.GetContentHash())
+		if !current {
+			old++
+		}
+	}
+	iter.Release()
+	c.Assert(iter.Error(), IsNil)
+	return hashes, old
+}
+
+func (s *MySuite) TestMetaRecord(c *C) {
+	hash := make([]byte, hashLen)
+	hash[0] = 1
+	meta := &MetaData{StatusCode: 200, Header: http.Header{}}
+	meta.Header.Set("Content-Type", "text/plain")
+
+	value := newMetaRecord(hash, 7, meta.encode())
+	data, current := parseMetaRecord(value)
+	c.Assert(data, NotNil)
+	c.Check(current, Equals, true)
+	c.Check(data.GetContentHash(), DeepEquals, hash)
+	c.Check(metaRecordRef(value), DeepEquals, contentRef{hash, 7})
+	c.Check(metaDataFromPB(data).Header.Get("Content-Type"), Equals, "text/plain")
+
+	meta.VaryHeader = http.Header{"Accept-Encoding": {"gzip, br"}}
+	data, _ = parseMetaRecord(newMetaRecord(hash, 7, meta.encode()))
+	c.Assert(data, NotNil)
+	c.Check(metaDataFromPB(data).VaryHeader, DeepEquals, meta.VaryHeader)
+
+	old := append(append([]byte{}, hash...), meta.encode()...)
+	data, current = parseMetaRecord(old)
+	c.Assert(data, NotNil)
+	c.Check(current, Equals, false)
+	c.Check(data.GetContentHash(), DeepEquals, hash)
+	c.Check(int(data.GetStatusCode()), Equals, 200)
+
+	c.Check(metaRecordHash([]byte("short")), IsNil)
+}
+
+func (s *MySuite) TestPruneMetadata(c *C) {
+	tempDir, err := ioutil.TempDir("", "jvproxy-test")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(tempDir)
+
+	store, err := NewLevelDBCache(tempDir, nil)
+	c.Assert(err, IsNil)
+	cache := store.(*ldbCache)
+
+	for i := 0; i < 4; i++ {
+		url := fmt.Sprintf("http://example.com/%d", i)
+		storeString(c, store, url, http.Header{}, url)
+	}
+	waitForUsage(c, cache, func(u LevelDBUsage) bool {
+		return u.Entries == 4
+	})
+
+	// Remove content behind the back of the cache manager, to
+	// leave orphaned metadata records.
+	var removed [][]byte
+	for _, i := range []int{1, 3} {
+		req, _ := http.NewRequest("GET", fmt.Sprintf("http://example.com/%d", i), nil)
+		entries := store.Retrieve(req)
+		c.Assert(entries, HasLen, 1)
+		removed = append(removed, entries[0].CacheID)
+	}
+	for _, hash := range removed {
+		size := cache.getIndexEntry(hash).GetSize()
+		cache.deleteIndexEntry(hash)
+		c.Assert(os.Remove(cache.getStoreName(hash)), IsNil)
+		cache.usageMutex.Lock()
+		cache.totalBytes -= size
+		cache.totalEntries--
+		cache.usageMutex.Unlock()
+	}
+
+	cache.pruneMetadata()
+	hashes, _ := metaHashes(c, cache.meta)
+	c.Check(hashes, HasLen, 2)
+	for _, hash := range hashes {
+		c.Check(cache.getIndexEntry(hash), NotNil)
+	}
+	for i := 0; i < 4; i++ {
+		url := fmt.Sprintf("http://example.com/%d", i)
+		req, _ := http.NewRequest("GET", url, nil)
+		entries := store.Retrieve(req)
+		if i%2 == 1 {
+			c.Check(entries, HasLen, 0)
+			continue
+		}
+		c.Assert(entries, HasLen, 1)
+		c.Check(readBody(c, entries[0]), Equals, url)
+	}
+
+	// records for evicted data are removed by the pruner
+	opts := cache.Options()
+	opts.MaxEntries = 1
+	c.Assert(cache.SetOptions(opts), IsNil)
+	waitForUsage(c, cache, func(u LevelDBUsage) bool {
+		return u.Entries <= 1
+	})
+	cache.pruneMetadata()
+	hashes, _ = metaHashes(c, cache.meta)
+	c.Check(len(hashes) <= 1, Equals, true)
+	for _, hash := range hashes {
+		c.Check(cache.getIndexEntry(hash), NotNil)
+	}
+
+	c.Assert(store.Close(), IsNil)
+	report, err := Check(tempDir, false)
+	c.Assert(err, IsNil)
+	c.Check(report.OK(), Equals, true, Commentf("%s", report))
+}
+
+func (s *MySuite) TestMetaMigration(c *C) {
+	tempDir, err := ioutil.TempDir("", "jvproxy-test")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(tempDir)
+
+	store, err := NewLevelDBCache(tempDir, nil)
+	c.Assert(err, IsNil)
+	storeString(c, store, "http://example.com/a", http.Header{}, "a")
+	storeString(c, store, "http://example.com/b", http.Header{}, "b")
+	c.Assert(store.Close(), IsNil)
+
+	// convert the records to the version 1 format
+	metaDir := filepath.Join(tempDir, metaDirName)
+	meta, err := leveldb.OpenFile(metaDir, nil)
+	c.Assert(err, IsNil)
+	batch := new(leveldb.Batch)
+	iter := meta.NewIterator(nil, nil)
+	for iter.Next() {
+		data := &pb.Meta{}
+		c.Assert(proto.Unmarshal(iter.Value(), data), IsNil)
+		hash := data.ContentHash
+		data.Version = nil
+		data.ContentHash = nil
+		raw, err := proto.Marshal(data)
+		c.Assert(err, IsNil)
+		batch.Put(append([]byte{}, iter.Key()...), append(hash, raw...))
+	}
+	iter.Release()
+	c.Assert(iter.Error(), IsNil)
+	c.Assert(meta.Write(batch, nil), IsNil)
+	_, old := metaHashes(c, meta)
+	c.Check(old, Equals, 2)
+	c.Assert(meta.Close(), IsNil)
+
+	report, err := Check(tempDir, false)
+	c.Assert(err, IsNil)
+	c.Check(report.OK(), Equals, true, Commentf("%s", report))
+	c.Check(report.OldMeta, Equals, 2)
+
+	// the records are converted when the cache is opened
+	store, err = NewLevelDBCache(tempDir, nil)
+	c.Assert(err, IsNil)
+	cache := store.(*ldbCache)
+	hashes, old := metaHashes(c, cache.meta)
+	c.Check(hashes, HasLen, 2)
+	c.Check(old, Equals, 0)
+	for _, name := range []string{"a", "b"} {
+		req, _ := http.NewRequest("GET", "http://example.com/"+name, nil)
+		entries := store.Retrieve(req)
+		c.Assert(entries, HasLen, 1)
+		c.Check(readBody(c, entries[0]), Equals, name)
+		c.Check(cache.getIndexEntry(entries[0].CacheID).GetRefCount(), Equals, int32(1))
+	}
+	c.Assert(store.Close(), IsNil)
+
+	report, err = Check(tempDir, false)
+	c.Assert(err, IsNil)
+	c.Check(report.OK(), Equals, true, Commentf("%s", report))
+	c.Check(report.OldMeta, Equals, 0)
+}
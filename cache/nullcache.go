@@ -15,6 +15,12 @@ func (cache *NullCache) StoreStart(string, *MetaData) StoreCont {
 	return &nullEntry{}
 }
 
+func (cache *NullCache) StorePartial(string, *MetaData, int64, int64) StoreCont {
+	return &nullEntry{}
+}
+
+func (cache *NullCache) Invalidate(url string) {}
+
 func (cache *NullCache) Update(url string, entry *Entry) {}
 
 func (cache *NullCache) Close() error {
@@ -0,0 +1,225 @@
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// LevelDBOptions sets the size limits of the cache created by
+// NewLevelDBCache.  Zero values mean that the corresponding limit is
+// not used.
+type LevelDBOptions struct {
+	// MaxBytes is the maximal total size of the stored response
+	// bodies.
+	MaxBytes int64
+
+	// MaxEntries is the maximal number of stored response bodies.
+	MaxEntries int64
+
+	// MaxObjectSize is the size of the largest response body which
+	// is stored.
+	MaxObjectSize int64
+
+	// MinFreeBytes is the amount of free space which is kept
+	// available on the volume holding the cache.
+	MinFreeBytes int64
+
+	// MaxStaleness is the time after which expired data is removed
+	// from the cache.  For responses which can be revalidated, only
+	// the body is removed, and the metadata is kept.  Zero disables
+	// the removal of expired data.
+	MaxStaleness time.Duration
+
+	// VerifyReads enables checking the hash of stored content
+	// while it is read.  Corrupt content is moved into the
+	// "quarantine" directory, and the response body is cut off
+	// before the end.  Byte ranges are not checked.
+	VerifyReads bool
+
+	// Policy is the name of the eviction policy, see
+	// EvictionPolicies.  If empty, DefaultEvictionPolicy is used.
+	Policy string
+
+	// Compression maps media types to the content-coding used to
+	// store response bodies of this type, e.g. "text/html" to
+	// "gzip".  Keys of the form "text/*" match all subtypes, an
+	// empty content-coding excludes a subtype from this.  The
+	// available content-codings are listed by Codecs.  Bodies are
+	// only stored compressed if this saves space.  The map must not
+	// be modified after the options have been passed to the cache.
+	Compression map[string]string
+
+	// VaryNormalizers gives the normalizers for the request header
+	// fields nominated by the Vary header field of a response.  If
+	// this is nil, DefaultVaryNormalizers is used.  The normalizers
+	// cannot be represented in JSON, so this field is left out of
+	// the encoded options.
+	VaryNormalizers VaryNormalizers `json:"-"`
+}
+
+// DefaultLevelDBOptions are used by NewLevelDBCache, if no options are
+// given.
+var DefaultLevelDBOptions = LevelDBOptions{
+	MaxBytes:     49 * 1024 * 1024,
+	MaxStaleness: 7 * 24 * time.Hour,
+}
+
+// When any of the limits is exceeded, entries are removed until the
+// usage is below pruneFraction times the limit.
+const pruneFraction = 48.0 / 49.0
+
+// freeSpaceCheckInterval gives how often the free space on the cache
+// volume is checked.
+const freeSpaceCheckInterval = 10 * time.Second
+
+func (opts *LevelDBOptions) check() error {
+	if opts.MaxBytes < 0 || opts.MaxEntries < 0 ||
+		opts.MaxObjectSize < 0 || opts.MinFreeBytes < 0 ||
+		opts.MaxStaleness < 0 {
+		return errors.New("cache: negative limits are not allowed")
+	}
+	for mediaType, encoding := range opts.Compression {
+		if encoding == "" {
+			continue
+		}
+		_, err := getCodec(encoding)
+		if err != nil {
+			return fmt.Errorf("%s (for %s)", err, mediaType)
+		}
+	}
+	_, err := NewEvictionPolicy(opts.Policy)
+	return err
+}
+
+// LevelDBUsage describes the resources used by a LevelDB cache.
+type LevelDBUsage struct {
+	Bytes     int64
+	Entries   int64
+	FreeBytes int64 // -1 if unknown
+
+	// PartialBytes is the number of bytes stored for incomplete
+	// bodies.  These count towards the MaxBytes limit, but are not
+	// included in Bytes.
+	PartialBytes int64
+
+	// IntegrityErrors counts the corrupt content files found while
+	// reading, see LevelDBOptions.VerifyReads.
+	IntegrityErrors int64
+}
+
+// Configurable is implemented by caches with size limits which can be
+// changed at run time, i.e. by the cache returned by NewLevelDBCache.
+type Configurable interface {
+	Options() LevelDBOptions
+	SetOptions(opts LevelDBOptions) error
+	Usage() LevelDBUsage
+	EvictionStats() EvictionStats
+	DedupStats() DedupStats
+}
+
+// Options returns the current size limits of the cache.
+func (cache *ldbCache) Options() LevelDBOptions {
+	cache.usageMutex.Lock()
+	defer cache.usageMutex.Unlock()
+	return cache.options
+}
+
+// varyNormalizers returns the normalizers for the request header
+// fields nominated by the Vary header field of a response.
+func (cache *ldbCache) varyNormalizers() VaryNormalizers {
+	return cache.Options().VaryNormalizers.orDefault()
+}
+
+// SetOptions changes the size limits of the cache.  If the new limits
+// are exceeded, entries are removed in the background.  If the
+// eviction policy is changed, the eviction statistics are reset.
+func (cache *ldbCache) SetOptions(opts LevelDBOptions) error {
+	err := opts.check()
+	if err != nil {
+		return err
+	}
+	cache.usageMutex.Lock()
+	if opts.Policy != cache.options.Policy {
+		cache.setPolicy(opts.Policy)
+	}
+	cache.options = opts
+	cache.usageCond.Signal()
+	cache.usageMutex.Unlock()
+	return nil
+}
+
+// Usage returns the resources currently used by the cache.
+func (cache *ldbCache) Usage() LevelDBUsage {
+	cache.usageMutex.Lock()
+	defer cache.usageMutex.Unlock()
+	return LevelDBUsage{
+		Bytes:     cache.totalBytes,
+		Entries:   cache.totalEntries,
+		FreeBytes: freeSpace(cache.baseDir),
+
+		PartialBytes:    cache.partialBytes,
+		IntegrityErrors: cache.integrityErrors,
+	}
+}
+
+// overLimit checks whether the cache exceeds any of the limits, where
+// each limit is multiplied by `fraction`.  `freed` is the number of
+// bytes removed since `free` was determined.  The caller must hold
+// cache.usageMutex.
+func (cache *ldbCache) overLimit(fraction float64, free, freed int64) bool {
+	opts := &cache.options
+	used := cache.totalBytes + cache.partialBytes
+	if opts.MaxBytes > 0 &&
+		float64(used) > fraction*float64(opts.MaxBytes) {
+		return true
+	}
+	if opts.MaxEntries > 0 &&
+		float64(cache.totalEntries) > fraction*float64(opts.MaxEntries) {
+		return true
+	}
+	if opts.MinFreeBytes > 0 && free >= 0 && used > 0 {
+		// Removing data increases the free space, so here the
+		// limit is scaled the other way round.
+		return float64(free+freed) < float64(opts.MinFreeBytes)/fraction
+	}
+	return false
+}
+
+// EvictionStats returns the hit and eviction counts for the current
+// eviction policy.
+func (cache *ldbCache) EvictionStats() EvictionStats {
+	cache.usageMutex.Lock()
+	defer cache.usageMutex.Unlock()
+	return cache.stats
+}
+
+// setPolicy installs a new instance of the named eviction policy.  The
+// name must have been checked before.  The caller must hold
+// cache.usageMutex.
+func (cache *ldbCache) setPolicy(name string) {
+	policy, err := NewEvictionPolicy(name)
+	if err != nil {
+		panic(err)
+	}
+	cache.policy = policy
+	cache.stats = EvictionStats{
+		Policy: policy.Name(),
+		Since:  time.Now(),
+	}
+}
+
+// countUse records a use of `size` bytes of stored data in the
+// eviction statistics.  `hit` indicates whether the data was read
+// from the cache, rather than newly stored.
+func (cache *ldbCache) countUse(size int64, hit bool) {
+	cache.usageMutex.Lock()
+	if hit {
+		cache.stats.Hits++
+		cache.stats.HitBytes += size
+	} else {
+		cache.stats.Misses++
+		cache.stats.MissBytes += size
+	}
+	cache.usageMutex.Unlock()
+}
@@ -0,0 +1,67 @@
+package cache
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+func waitForUsage(c *C, cache Configurable, cond func(LevelDBUsage) bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond(cache.Usage()) {
+		if time.Now().After(deadline) {
+			c.Fatalf("timeout, usage is %+v", cache.Usage())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (s *MySuite) TestLevelDBOptions(c *C) {
+	tempDir, err := ioutil.TempDir("", "jvproxy-test")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(tempDir)
+
+	_, err = NewLevelDBCache(tempDir, &LevelDBOptions{MaxBytes: -1})
+	c.Assert(err, NotNil)
+
+	cache, err := NewLevelDBCache(tempDir, &LevelDBOptions{
+		MaxEntries:    4,
+		MaxObjectSize: 100,
+	})
+	c.Assert(err, IsNil)
+	defer cache.Close()
+	conf := cache.(Configurable)
+
+	for i := 0; i < 6; i++ {
+		url := fmt.Sprintf("http://example.com/%d", i)
+		storeString(c, cache, url, http.Header{}, url)
+	}
+	waitForUsage(c, conf, func(u LevelDBUsage) bool {
+		return u.Entries <= 4
+	})
+
+	large := string(make([]byte, 200))
+	storeString(c, cache, "http://example.com/large", http.Header{}, large)
+	req, _ := http.NewRequest("GET", "http://example.com/large", nil)
+	c.Assert(cache.Retrieve(req), HasLen, 0)
+
+	opts := conf.Options()
+	c.Assert(opts.MaxEntries, Equals, int64(4))
+	opts.MaxEntries = 0
+	opts.MaxBytes = 30
+	c.Assert(conf.SetOptions(opts), IsNil)
+	waitForUsage(c, conf, func(u LevelDBUsage) bool {
+		return u.Bytes <= 30
+	})
+
+	opts.MaxBytes = 0
+	opts.MinFreeBytes = 1 << 62
+	c.Assert(conf.SetOptions(opts), IsNil)
+	waitForUsage(c, conf, func(u LevelDBUsage) bool {
+		return u.Entries == 0
+	})
+}
@@ -0,0 +1,447 @@
+package cache
+
+import (
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/seehuhn/jvproxy/cache/pb"
+	"github.com/seehuhn/trace"
+	"golang.org/x/crypto/sha3"
+)
+
+const (
+	partialDirName = "partial"
+	rangesSuffix   = ".ranges"
+)
+
+// partialMaxAge is the time after which an incomplete body in the
+// "partial" directory is removed, if no more parts have been received.
+const partialMaxAge = 24 * time.Hour
+
+// addRange adds the interval [start, end) to the sorted list of
+// disjoint intervals `ranges`.  The intervals are stored as pairs of
+// start and end positions.  Overlapping and adjacent intervals are
+// merged.
+func addRange(ranges []int64, start, end int64) []int64 {
+	if start >= end {
+		return ranges
+	}
+	var res []int64
+	i := 0
+	for i < len(ranges) && ranges[i+1] < start {
+		res = append(res, ranges[i], ranges[i+1])
+		i += 2
+	}
+	for i < len(ranges) && ranges[i] <= end {
+		if ranges[i] < start {
+			start = ranges[i]
+		}
+		if ranges[i+1] > end {
+			end = ranges[i+1]
+		}
+		i += 2
+	}
+	res = append(res, start, end)
+	res = append(res, ranges[i:]...)
+	return res
+}
+
+// StorePartial implements the corresponding method of the Cache
+// interface.  Parts of a body are collected in a sparse file in the
+// "partial" directory, until the complete body is available.  Parts
+// are only combined if they share the same entity tag.
+func (cache *ldbCache) StorePartial(url string, meta *MetaData, offset, total int64) StoreCont {
+	if maxSize := cache.Options().MaxObjectSize; maxSize > 0 && total > maxSize {
+		return &nullEntry{}
+	}
+
+	key := urlToKey(url, meta, cache.varyNormalizers())
+
+	id := make([]byte, 16)
+	h := sha3.NewShake128()
+	h.Write(key)
+	h.Write([]byte{0})
+	h.Write([]byte(meta.Header.Get("Etag")))
+	h.Read(id)
+	fname := filepath.Join(cache.baseDir, partialDirName, hex.EncodeToString(id))
+
+	store, err := os.OpenFile(fname, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		trace.T("jvproxy/cache", trace.PrioError,
+			"cannot open %s: %s", fname, err.Error())
+		return &nullEntry{}
+	}
+	info, err := store.Stat()
+	if err != nil {
+		trace.T("jvproxy/cache", trace.PrioError,
+			"cannot stat %s: %s", fname, err.Error())
+		store.Close()
+		return &nullEntry{}
+	}
+	return &ldbPartialEntry{
+		cache:    cache,
+		store:    store,
+		info:     info,
+		w:        &offsetWriter{store, offset},
+		metaData: meta.encode(),
+		key:      key,
+		offset:   offset,
+		total:    total,
+	}
+}
+
+type ldbPartialEntry struct {
+	cache    *ldbCache
+	store    *os.File
+	info     os.FileInfo
+	w        *offsetWriter
+	metaData []byte
+	key      []byte
+	offset   int64
+	total    int64
+}
+
+func (entry *ldbPartialEntry) Reader(r io.Reader) io.Reader {
+	return io.TeeReader(r, entry.w)
+}
+
+func (entry *ldbPartialEntry) Commit(size int64) {
+	entry.record(size)
+}
+
+// Discard implements the corresponding method of the StoreCont
+// interface.  Since all parts share a strong validator, the bytes
+// received before the transfer was interrupted are still valid, and
+// are kept.
+func (entry *ldbPartialEntry) Discard() {
+	entry.record(entry.w.pos - entry.offset)
+}
+
+// record adds the `size` bytes written at entry.offset to the list of
+// ranges received, and combines the parts once the body is complete.
+func (entry *ldbPartialEntry) record(size int64) {
+	fname := entry.store.Name()
+	err := entry.store.Close()
+	if err != nil {
+		return
+	}
+
+	cache := entry.cache
+	cache.partialMutex.Lock()
+	defer cache.partialMutex.Unlock()
+
+	// The parts may have been removed while this part was received.
+	fi, err := os.Stat(fname)
+	if err != nil || !os.SameFile(fi, entry.info) {
+		trace.T("jvproxy/cache", trace.PrioDebug,
+			"parts of %s removed while storing", fname)
+		return
+	}
+
+	rangesName := fname + rangesSuffix
+	state := readPartialState(rangesName)
+	oldSize := coveredBytes(state.Ranges)
+	if state.GetTotal() != entry.total {
+		state.Ranges = nil
+	}
+	state.Key = entry.key
+	state.Meta = entry.metaData
+	state.Total = proto.Int64(entry.total)
+	state.Ranges = addRange(state.Ranges, entry.offset, entry.offset+size)
+
+	if len(state.Ranges) == 2 && state.Ranges[0] == 0 &&
+		state.Ranges[1] >= entry.total {
+		cache.completePartial(fname, state)
+		cache.removePartialFiles(fname)
+		cache.addPartialBytes(-oldSize)
+		return
+	}
+	if len(state.Ranges) == 0 {
+		cache.removePartialFiles(fname)
+		cache.addPartialBytes(-oldSize)
+		return
+	}
+
+	raw, err := proto.Marshal(state)
+	if err != nil {
+		panic(err)
+	}
+	err = ioutil.WriteFile(rangesName, raw, 0644)
+	if err != nil {
+		trace.T("jvproxy/cache", trace.PrioError,
+			"cannot write %s: %s", rangesName, err.Error())
+		cache.removePartialFiles(fname)
+		cache.addPartialBytes(-oldSize)
+		return
+	}
+	cache.addPartialBytes(coveredBytes(state.Ranges) - oldSize)
+}
+
+// readPartialState reads the list of ranges received for an
+// incomplete body.  If the file is missing or cannot be decoded, an
+// empty list is returned.
+func readPartialState(rangesName string) *pb.Partial {
+	state := &pb.Partial{}
+	raw, err := ioutil.ReadFile(rangesName)
+	if err != nil {
+		return state
+	}
+	err = proto.Unmarshal(raw, state)
+	if err != nil || !validRanges(state) {
+		trace.T("jvproxy/cache", trace.PrioError,
+			"cannot decode %s", rangesName)
+		return &pb.Partial{}
+	}
+	return state
+}
+
+// validRanges checks whether the ranges in `state` are sorted,
+// disjoint and within the complete body.
+func validRanges(state *pb.Partial) bool {
+	r := state.Ranges
+	if len(r)%2 != 0 {
+		return false
+	}
+	var last int64
+	for i := 0; i < len(r); i += 2 {
+		if r[i] < last || r[i+1] <= r[i] || r[i+1] > state.GetTotal() {
+			return false
+		}
+		last = r[i+1]
+	}
+	return true
+}
+
+// coveredBytes returns the number of bytes in the list of disjoint
+// intervals `ranges`.
+func coveredBytes(ranges []int64) int64 {
+	var res int64
+	for i := 0; i+1 < len(ranges); i += 2 {
+		res += ranges[i+1] - ranges[i]
+	}
+	return res
+}
+
+// addPartialBytes changes the number of bytes recorded for incomplete
+// bodies.  These count towards the size limits of the cache.
+func (cache *ldbCache) addPartialBytes(n int64) {
+	if n == 0 {
+		return
+	}
+	cache.usageMutex.Lock()
+	cache.partialBytes += n
+	if n > 0 && cache.overLimit(1, -1, 0) {
+		cache.usageCond.Signal()
+	}
+	cache.usageMutex.Unlock()
+}
+
+// removePartialFiles removes the sparse file `fname` and the
+// corresponding list of ranges.  The caller must hold
+// cache.partialMutex.
+func (cache *ldbCache) removePartialFiles(fname string) {
+	for _, name := range []string{fname, fname + rangesSuffix} {
+		err := os.Remove(name)
+		if err != nil && !os.IsNotExist(err) {
+			trace.T("jvproxy/cache", trace.PrioError,
+				"cannot remove %s: %s", name, err.Error())
+		}
+	}
+}
+
+// A partialFile describes an incomplete body in the "partial"
+// directory.
+type partialFile struct {
+	name    string // the sparse file, without the directory
+	size    int64  // bytes received, according to the list of ranges
+	modTime time.Time
+	ranges  bool // whether the list of ranges exists
+}
+
+// listPartial returns the incomplete bodies in the "partial"
+// directory, the least recently changed first.  Lists of ranges
+// without a sparse file are reported with an empty name.
+func (cache *ldbCache) listPartial() ([]*partialFile, error) {
+	dir := filepath.Join(cache.baseDir, partialDirName)
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	parts := make(map[string]*partialFile)
+	get := func(name string) *partialFile {
+		p := parts[name]
+		if p == nil {
+			p = &partialFile{name: name}
+			parts[name] = p
+		}
+		return p
+	}
+	for _, fi := range files {
+		name := fi.Name()
+		isRanges := strings.HasSuffix(name, rangesSuffix)
+		p := get(strings.TrimSuffix(name, rangesSuffix))
+		if fi.ModTime().After(p.modTime) {
+			p.modTime = fi.ModTime()
+		}
+		if isRanges {
+			p.ranges = true
+			state := readPartialState(filepath.Join(dir, name))
+			p.size = coveredBytes(state.Ranges)
+		}
+	}
+	res := make([]*partialFile, 0, len(parts))
+	for _, p := range parts {
+		res = append(res, p)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].modTime.Before(res[j].modTime)
+	})
+	return res, nil
+}
+
+// countPartial initialises the number of bytes used by incomplete
+// bodies.
+func (cache *ldbCache) countPartial() {
+	cache.partialMutex.Lock()
+	defer cache.partialMutex.Unlock()
+	parts, err := cache.listPartial()
+	if err != nil {
+		trace.T("jvproxy/cache", trace.PrioError,
+			"cannot read partial directory: %s", err.Error())
+		return
+	}
+	var size int64
+	for _, p := range parts {
+		size += p.size
+	}
+	cache.addPartialBytes(size)
+}
+
+// removeOldPartial removes incomplete bodies for which no parts have
+// been received for partialMaxAge, and, if `limit` is set, more
+// incomplete bodies until the cache is within its limits again.  The
+// least recently changed bodies are removed first.
+func (cache *ldbCache) removeOldPartial(limit bool) {
+	cache.partialMutex.Lock()
+	defer cache.partialMutex.Unlock()
+	parts, err := cache.listPartial()
+	if err != nil {
+		trace.T("jvproxy/cache", trace.PrioError,
+			"cannot read partial directory: %s", err.Error())
+		return
+	}
+
+	dir := filepath.Join(cache.baseDir, partialDirName)
+	cutoff := time.Now().Add(-partialMaxAge)
+	count := 0
+	var size int64
+	for _, p := range parts {
+		if !p.modTime.Before(cutoff) {
+			if !limit {
+				break
+			}
+			cache.usageMutex.Lock()
+			over := cache.overLimit(pruneFraction, freeSpace(cache.baseDir), 0)
+			cache.usageMutex.Unlock()
+			if !over {
+				break
+			}
+		}
+		cache.removePartialFiles(filepath.Join(dir, p.name))
+		cache.addPartialBytes(-p.size)
+		count++
+		size += p.size
+	}
+	if count > 0 {
+		trace.T("jvproxy/cache", trace.PrioInfo,
+			"removed %d incomplete bodies (%s)", count, byteSize(size))
+	}
+}
+
+// completePartial moves a completely received body from the
+// "partial" directory into the content store and records the
+// metadata.
+func (cache *ldbCache) completePartial(fname string, state *pb.Partial) {
+	total := state.GetTotal()
+	err := os.Truncate(fname, total)
+	if err != nil {
+		trace.T("jvproxy/cache", trace.PrioError,
+			"cannot truncate %s: %s", fname, err.Error())
+		return
+	}
+
+	f, err := os.Open(fname)
+	if err != nil {
+		trace.T("jvproxy/cache", trace.PrioError,
+			"cannot open %s: %s", fname, err.Error())
+		return
+	}
+	hash := sha3.NewShake128()
+	_, err = io.CopyN(hash, f, total)
+	f.Close()
+	if err != nil {
+		trace.T("jvproxy/cache", trace.PrioError,
+			"cannot read %s: %s", fname, err.Error())
+		return
+	}
+
+	contentHash := make([]byte, hashLen)
+	_, err = io.ReadFull(hash, contentHash)
+	if err != nil {
+		panic(err)
+	}
+
+	s := &sample{
+		hash:    contentHash,
+		useTime: time.Now().Unix(),
+		size:    total,
+		format:  &storedFormat{size: total},
+		refs:    1,
+	}
+	encoding := ""
+	if meta := decodeMetaData(state.Meta); meta != nil {
+		s.expiry = getExpiry(meta)
+		encoding = cache.Options().encodingFor(meta.Header)
+	}
+	srcName := fname
+	if encoding != "" {
+		name, n := cache.compressContent(fname, total, encoding)
+		if name != "" {
+			defer os.Remove(name)
+			srcName = name
+			s.size = n
+			s.format.encoding = encoding
+		}
+	}
+
+	if !cache.linkContent(srcName, s) {
+		return
+	}
+	trace.T("jvproxy/cache", trace.PrioDebug,
+		"combined partial responses for %s", fname)
+	cache.countUse(total, false)
+	gen := cache.storeSample(s)
+	if gen == 0 {
+		return
+	}
+	cache.storeMeta(state.Key, newMetaRecord(contentHash, gen, state.Meta))
+}
+
+// offsetWriter writes to an os.File, starting at a given position.
+type offsetWriter struct {
+	file *os.File
+	pos  int64
+}
+
+func (w *offsetWriter) Write(p []byte) (int, error) {
+	n, err := w.file.WriteAt(p, w.pos)
+	w.pos += int64(n)
+	return n, err
+}
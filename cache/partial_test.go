@@ -0,0 +1,122 @@
+package cache
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *MySuite) TestAddRange(c *C) {
+	var r []int64
+	r = addRange(r, 10, 20)
+	c.Assert(r, DeepEquals, []int64{10, 20})
+	r = addRange(r, 30, 40)
+	c.Assert(r, DeepEquals, []int64{10, 20, 30, 40})
+	r = addRange(r, 0, 5)
+	c.Assert(r, DeepEquals, []int64{0, 5, 10, 20, 30, 40})
+	r = addRange(r, 20, 30)
+	c.Assert(r, DeepEquals, []int64{0, 5, 10, 40})
+	r = addRange(r, 50, 50)
+	c.Assert(r, DeepEquals, []int64{0, 5, 10, 40})
+	r = addRange(r, 3, 60)
+	c.Assert(r, DeepEquals, []int64{0, 60})
+}
+
+func (s *MySuite) TestStorePartial(c *C) {
+	tempDir, err := ioutil.TempDir("", "jvproxy-test")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(tempDir)
+
+	cache, err := NewLevelDBCache(tempDir, nil)
+	c.Assert(err, IsNil)
+	defer cache.Close()
+
+	url := "http://example.com/large.iso"
+	meta := &MetaData{
+		StatusCode: 200,
+		Header:     http.Header{},
+	}
+	meta.Header.Set("Etag", "\"abc\"")
+	body := "0123456789abcdefghij"
+
+	store := func(start, end int) {
+		entry := cache.StorePartial(url, meta, int64(start), int64(len(body)))
+		n, err := io.Copy(ioutil.Discard,
+			entry.Reader(strings.NewReader(body[start:end])))
+		c.Assert(err, IsNil)
+		entry.Commit(n)
+	}
+
+	req, _ := http.NewRequest("GET", url, nil)
+	store(10, 20)
+	c.Assert(cache.Retrieve(req), HasLen, 0)
+	store(0, 12)
+	entries := cache.Retrieve(req)
+	c.Assert(entries, HasLen, 1)
+	c.Assert(entries[0].StatusCode, Equals, 200)
+	r := entries[0].GetBody()
+	data, err := ioutil.ReadAll(r)
+	r.Close()
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, body)
+}
+
+func (s *MySuite) TestPartialUsage(c *C) {
+	tempDir, err := ioutil.TempDir("", "jvproxy-test")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(tempDir)
+
+	store, err := NewLevelDBCache(tempDir, nil)
+	c.Assert(err, IsNil)
+
+	url := "http://example.com/large.iso"
+	meta := &MetaData{
+		StatusCode: 200,
+		Header:     http.Header{},
+	}
+	meta.Header.Set("Etag", "\"abc\"")
+
+	// an interrupted transfer keeps the bytes received so far
+	entry := store.StorePartial(url, meta, 10, 100)
+	buf := make([]byte, 7)
+	_, err = io.ReadFull(entry.Reader(strings.NewReader("0123456789")), buf)
+	c.Assert(err, IsNil)
+	entry.Discard()
+	c.Check(store.(Configurable).Usage().PartialBytes, Equals, int64(7))
+
+	entry = store.StorePartial(url, meta, 0, 100)
+	n, err := io.Copy(ioutil.Discard,
+		entry.Reader(strings.NewReader("0123456789abc")))
+	c.Assert(err, IsNil)
+	entry.Commit(n)
+	c.Check(store.(Configurable).Usage().PartialBytes, Equals, int64(17))
+	store.Close()
+
+	// the parts are counted when the cache is opened again
+	store, err = NewLevelDBCache(tempDir, nil)
+	c.Assert(err, IsNil)
+	c.Check(store.(Configurable).Usage().PartialBytes, Equals, int64(17))
+
+	// old parts are removed
+	ldb := store.(*ldbCache)
+	dir := filepath.Join(tempDir, partialDirName)
+	files, err := ioutil.ReadDir(dir)
+	c.Assert(err, IsNil)
+	c.Assert(files, HasLen, 2)
+	old := time.Now().Add(-2 * partialMaxAge)
+	for _, fi := range files {
+		c.Assert(os.Chtimes(filepath.Join(dir, fi.Name()), old, old), IsNil)
+	}
+	ldb.removeOldPartial(false)
+	c.Check(ldb.Usage().PartialBytes, Equals, int64(0))
+	files, err = ioutil.ReadDir(dir)
+	c.Assert(err, IsNil)
+	c.Check(files, HasLen, 0)
+	store.Close()
+}
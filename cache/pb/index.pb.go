@@ -8,10 +8,12 @@ Package pb is a generated protocol buffer package.
 It is generated from these files:
 	index.proto
 	metadata.proto
+	partial.proto
 
 It has these top-level messages:
 	Entry
 	Meta
+	Partial
 */
 package pb
 
@@ -25,10 +27,18 @@ var _ = fmt.Errorf
 var _ = math.Inf
 
 type Entry struct {
-	LastUsed         *int64 `protobuf:"varint,1,opt,name=lastUsed" json:"lastUsed,omitempty"`
-	Size             *int64 `protobuf:"varint,2,opt,name=size" json:"size,omitempty"`
-	UseCount         *int32 `protobuf:"varint,3,opt,name=useCount" json:"useCount,omitempty"`
-	XXX_unrecognized []byte `json:"-"`
+	LastUsed         *int64  `protobuf:"varint,1,opt,name=lastUsed" json:"lastUsed,omitempty"`
+	Size             *int64  `protobuf:"varint,2,opt,name=size" json:"size,omitempty"`
+	UseCount         *int32  `protobuf:"varint,3,opt,name=useCount" json:"useCount,omitempty"`
+	FirstUsed        *int64  `protobuf:"varint,4,opt,name=firstUsed" json:"firstUsed,omitempty"`
+	Expires          *int64  `protobuf:"varint,5,opt,name=expires" json:"expires,omitempty"`
+	Validator        *bool   `protobuf:"varint,6,opt,name=validator" json:"validator,omitempty"`
+	Dropped          *bool   `protobuf:"varint,7,opt,name=dropped" json:"dropped,omitempty"`
+	Encoding         *string `protobuf:"bytes,8,opt,name=encoding" json:"encoding,omitempty"`
+	ContentSize      *int64  `protobuf:"varint,9,opt,name=contentSize" json:"contentSize,omitempty"`
+	RefCount         *int32  `protobuf:"varint,10,opt,name=refCount" json:"refCount,omitempty"`
+	Generation       *int64  `protobuf:"varint,11,opt,name=generation" json:"generation,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
 }
 
 func (m *Entry) Reset()                    { *m = Entry{} }
@@ -57,16 +67,79 @@ func (m *Entry) GetUseCount() int32 {
 	return 0
 }
 
+func (m *Entry) GetFirstUsed() int64 {
+	if m != nil && m.FirstUsed != nil {
+		return *m.FirstUsed
+	}
+	return 0
+}
+
+func (m *Entry) GetExpires() int64 {
+	if m != nil && m.Expires != nil {
+		return *m.Expires
+	}
+	return 0
+}
+
+func (m *Entry) GetValidator() bool {
+	if m != nil && m.Validator != nil {
+		return *m.Validator
+	}
+	return false
+}
+
+func (m *Entry) GetDropped() bool {
+	if m != nil && m.Dropped != nil {
+		return *m.Dropped
+	}
+	return false
+}
+
+func (m *Entry) GetEncoding() string {
+	if m != nil && m.Encoding != nil {
+		return *m.Encoding
+	}
+	return ""
+}
+
+func (m *Entry) GetContentSize() int64 {
+	if m != nil && m.ContentSize != nil {
+		return *m.ContentSize
+	}
+	return 0
+}
+
+func (m *Entry) GetRefCount() int32 {
+	if m != nil && m.RefCount != nil {
+		return *m.RefCount
+	}
+	return 0
+}
+
+func (m *Entry) GetGeneration() int64 {
+	if m != nil && m.Generation != nil {
+		return *m.Generation
+	}
+	return 0
+}
+
 func init() {
 	proto.RegisterType((*Entry)(nil), "pb.Entry")
 }
 
 var fileDescriptor0 = []byte{
-	// 95 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x09, 0x6e, 0x88, 0x02, 0xff, 0xe2, 0xe2, 0xce, 0xcc, 0x4b, 0x49,
-	0xad, 0xd0, 0x2b, 0x28, 0xca, 0x2f, 0xc9, 0x17, 0x62, 0x2a, 0x48, 0x52, 0xb2, 0xe4, 0x62, 0x75,
-	0xcd, 0x2b, 0x29, 0xaa, 0x14, 0x12, 0xe0, 0xe2, 0xc8, 0x49, 0x2c, 0x2e, 0x09, 0x2d, 0x4e, 0x4d,
-	0x91, 0x60, 0x54, 0x60, 0xd4, 0x60, 0x16, 0xe2, 0xe1, 0x62, 0x29, 0xce, 0xac, 0x4a, 0x95, 0x60,
-	0x02, 0xf3, 0x80, 0xf2, 0xa5, 0xc5, 0xa9, 0xce, 0xf9, 0xa5, 0x79, 0x25, 0x12, 0xcc, 0x40, 0x11,
-	0x56, 0x40, 0x00, 0x00, 0x00, 0xff, 0xff, 0x7b, 0xce, 0x91, 0xcd, 0x4c, 0x00, 0x00, 0x00,
+	// 196 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x09, 0x6e, 0x88, 0x02, 0xff, 0x34, 0xce, 0x51, 0x4e, 0xc3, 0x30,
+	0x0c, 0xc6, 0x71, 0x65, 0x5b, 0x59, 0xea, 0x22, 0xd1, 0x85, 0x17, 0x3f, 0x56, 0x3c, 0xf5, 0x89,
+	0x4b, 0x20, 0x4e, 0x80, 0x38, 0x40, 0x58, 0xbc, 0x29, 0xd2, 0x64, 0x47, 0x8e, 0x87, 0x0a, 0x87,
+	0xe4, 0x4c, 0xa8, 0x81, 0x3d, 0xfa, 0xd3, 0xdf, 0xd2, 0x0f, 0x86, 0xcc, 0x89, 0x96, 0xe7, 0xa2,
+	0x62, 0x12, 0x36, 0xe5, 0xe3, 0xe9, 0xc7, 0x41, 0xf7, 0xca, 0xa6, 0x5f, 0x61, 0x04, 0x7f, 0x89,
+	0xd5, 0xde, 0x2b, 0x25, 0x74, 0x93, 0x9b, 0xb7, 0xe1, 0x1e, 0x76, 0x35, 0x7f, 0x13, 0x6e, 0xda,
+	0x35, 0x82, 0xbf, 0x56, 0x7a, 0x91, 0x2b, 0x1b, 0x6e, 0x27, 0x37, 0x77, 0xe1, 0x00, 0xfd, 0x29,
+	0xeb, 0xff, 0xcb, 0xae, 0x45, 0x0f, 0xb0, 0xa7, 0xa5, 0x64, 0xa5, 0x8a, 0x5d, 0x1b, 0x0e, 0xd0,
+	0x7f, 0xc6, 0x4b, 0x4e, 0xd1, 0x44, 0xf1, 0x6e, 0x72, 0xb3, 0x5f, 0x9b, 0xa4, 0x52, 0x0a, 0x25,
+	0xdc, 0xb7, 0x61, 0x04, 0x4f, 0x7c, 0x94, 0x94, 0xf9, 0x8c, 0x7e, 0x72, 0x73, 0x1f, 0x1e, 0x61,
+	0x38, 0x0a, 0x1b, 0xb1, 0xbd, 0xad, 0x80, 0xfe, 0x06, 0x50, 0x3a, 0xfd, 0x01, 0xa0, 0x01, 0x02,
+	0xc0, 0x99, 0x98, 0x34, 0x5a, 0x16, 0xc6, 0x61, 0xad, 0x7e, 0x07, 0x00, 0xb8, 0x2c, 0xc5, 0x63,
+	0xe2, 0x00, 0x00, 0x00,
 }
@@ -18,6 +18,10 @@ type Meta struct {
 	Header           []string `protobuf:"bytes,2,rep,name=Header" json:"Header,omitempty"`
 	ResponseTime     *int64   `protobuf:"varint,3,opt,name=ResponseTime" json:"ResponseTime,omitempty"`
 	ResponseDelay    *int64   `protobuf:"varint,4,opt,name=ResponseDelay" json:"ResponseDelay,omitempty"`
+	Version          *int32   `protobuf:"varint,5,opt,name=Version" json:"Version,omitempty"`
+	ContentHash      []byte   `protobuf:"bytes,6,opt,name=ContentHash" json:"ContentHash,omitempty"`
+	VaryHeader       []string `protobuf:"bytes,7,rep,name=VaryHeader" json:"VaryHeader,omitempty"`
+	Generation       *int64   `protobuf:"varint,8,opt,name=Generation" json:"Generation,omitempty"`
 	XXX_unrecognized []byte   `json:"-"`
 }
 
@@ -54,18 +58,49 @@ func (m *Meta) GetResponseDelay() int64 {
 	return 0
 }
 
+func (m *Meta) GetVersion() int32 {
+	if m != nil && m.Version != nil {
+		return *m.Version
+	}
+	return 0
+}
+
+func (m *Meta) GetContentHash() []byte {
+	if m != nil {
+		return m.ContentHash
+	}
+	return nil
+}
+
+func (m *Meta) GetVaryHeader() []string {
+	if m != nil {
+		return m.VaryHeader
+	}
+	return nil
+}
+
+func (m *Meta) GetGeneration() int64 {
+	if m != nil && m.Generation != nil {
+		return *m.Generation
+	}
+	return 0
+}
+
 func init() {
 	proto.RegisterType((*Meta)(nil), "pb.Meta")
 }
 
 var fileDescriptor1 = []byte{
-	// 123 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x09, 0x6e, 0x88, 0x02, 0xff, 0xe2, 0xe2, 0xcb, 0x4d, 0x2d, 0x49,
-	0x4c, 0x49, 0x2c, 0x49, 0xd4, 0x2b, 0x28, 0xca, 0x2f, 0xc9, 0x17, 0x62, 0x2a, 0x48, 0x52, 0x0a,
-	0xe7, 0x62, 0xf1, 0x05, 0x8a, 0x0a, 0x09, 0x71, 0x71, 0x05, 0x97, 0x24, 0x96, 0x94, 0x16, 0x3b,
-	0xe7, 0xa7, 0xa4, 0x4a, 0x30, 0x2a, 0x30, 0x6a, 0xb0, 0x0a, 0xf1, 0x71, 0xb1, 0x79, 0xa4, 0x26,
-	0xa6, 0xa4, 0x16, 0x49, 0x30, 0x29, 0x30, 0x6b, 0x70, 0x0a, 0x89, 0x70, 0xf1, 0x04, 0xa5, 0x16,
-	0x17, 0xe4, 0xe7, 0x15, 0xa7, 0x86, 0x64, 0xe6, 0xa6, 0x4a, 0x30, 0x03, 0x55, 0x31, 0x0b, 0x89,
-	0x72, 0xf1, 0xc2, 0x44, 0x5d, 0x52, 0x73, 0x12, 0x2b, 0x25, 0x58, 0x40, 0xc2, 0x80, 0x00, 0x00,
-	0x00, 0xff, 0xff, 0xc5, 0x96, 0x61, 0xff, 0x6d, 0x00, 0x00, 0x00,
+	// 174 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x09, 0x6e, 0x88, 0x02, 0xff, 0x34, 0xcd, 0xbd, 0x0a, 0xc2, 0x30,
+	0x14, 0xc5, 0x71, 0xd2, 0x4f, 0xbd, 0xd6, 0x0a, 0x51, 0x21, 0x63, 0x70, 0xca, 0xe4, 0x4b, 0x54,
+	0xb0, 0x8b, 0x8b, 0x4a, 0xf7, 0x2b, 0xbd, 0x60, 0xc1, 0x26, 0x25, 0xb9, 0x0e, 0x7d, 0x20, 0xdf,
+	0x53, 0x5a, 0x74, 0x3d, 0x70, 0xfe, 0x3f, 0x28, 0x7b, 0x62, 0x6c, 0x91, 0xf1, 0x38, 0x78, 0xc7,
+	0x4e, 0x46, 0xc3, 0xe3, 0xf0, 0x11, 0x90, 0x5c, 0x88, 0x51, 0x4a, 0x80, 0x1b, 0x23, 0xbf, 0x43,
+	0xe5, 0x5a, 0x52, 0x42, 0x0b, 0x93, 0xca, 0x12, 0xb2, 0x9a, 0xb0, 0x25, 0xaf, 0x22, 0x1d, 0x9b,
+	0xa5, 0xdc, 0x41, 0x71, 0xa5, 0x30, 0x38, 0x1b, 0xe8, 0xde, 0xf5, 0xa4, 0x62, 0x2d, 0x4c, 0x2c,
+	0xf7, 0xb0, 0xfe, 0xaf, 0x27, 0x7a, 0xe1, 0xa8, 0x92, 0x79, 0xde, 0x40, 0xde, 0x90, 0x0f, 0x9d,
+	0xb3, 0x2a, 0x9d, 0x6b, 0x5b, 0x58, 0x55, 0xce, 0x32, 0x59, 0xae, 0x31, 0x3c, 0x55, 0xa6, 0x85,
+	0x29, 0x26, 0xb6, 0x41, 0x3f, 0xfe, 0x98, 0x7c, 0x66, 0x24, 0xc0, 0x99, 0x2c, 0x79, 0xe4, 0xe9,
+	0xbc, 0x98, 0x6a, 0xdf, 0x01, 0x00, 0xff, 0x9c, 0x32, 0x23, 0xbc, 0x00, 0x00, 0x00,
 }
@@ -0,0 +1,70 @@
+// Code generated by protoc-gen-go.
+// source: partial.proto
+// DO NOT EDIT!
+
+package pb
+
+import proto "github.com/golang/protobuf/proto"
+import fmt "fmt"
+import math "math"
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ = proto.Marshal
+var _ = fmt.Errorf
+var _ = math.Inf
+
+type Partial struct {
+	Key              []byte  `protobuf:"bytes,1,opt,name=key" json:"key,omitempty"`
+	Meta             []byte  `protobuf:"bytes,2,opt,name=meta" json:"meta,omitempty"`
+	Total            *int64  `protobuf:"varint,3,opt,name=total" json:"total,omitempty"`
+	Ranges           []int64 `protobuf:"varint,4,rep,name=ranges" json:"ranges,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (m *Partial) Reset()                    { *m = Partial{} }
+func (m *Partial) String() string            { return proto.CompactTextString(m) }
+func (*Partial) ProtoMessage()               {}
+func (*Partial) Descriptor() ([]byte, []int) { return fileDescriptor2, []int{0} }
+
+func (m *Partial) GetKey() []byte {
+	if m != nil {
+		return m.Key
+	}
+	return nil
+}
+
+func (m *Partial) GetMeta() []byte {
+	if m != nil {
+		return m.Meta
+	}
+	return nil
+}
+
+func (m *Partial) GetTotal() int64 {
+	if m != nil && m.Total != nil {
+		return *m.Total
+	}
+	return 0
+}
+
+func (m *Partial) GetRanges() []int64 {
+	if m != nil {
+		return m.Ranges
+	}
+	return nil
+}
+
+func init() {
+	proto.RegisterType((*Partial)(nil), "pb.Partial")
+}
+
+var fileDescriptor2 = []byte{
+	// 102 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x09, 0x6e, 0x88, 0x02, 0xff, 0xe2, 0xe2, 0x2d, 0x48, 0x2c, 0x2a,
+	0xc9, 0x4c, 0xcc, 0xd1, 0x2b, 0x28, 0xca, 0x2f, 0xc9, 0x17, 0x62, 0x2a, 0x48, 0x52, 0x72, 0xe6,
+	0x62, 0x0f, 0x80, 0x08, 0x0a, 0x71, 0x73, 0x31, 0x67, 0xa7, 0x56, 0x4a, 0x30, 0x2a, 0x30, 0x6a,
+	0xf0, 0x08, 0xf1, 0x70, 0xb1, 0xe4, 0xa6, 0x96, 0x24, 0x4a, 0x30, 0x81, 0x79, 0xbc, 0x5c, 0xac,
+	0x25, 0xf9, 0x25, 0x89, 0x39, 0x12, 0xcc, 0x0a, 0x8c, 0x1a, 0xcc, 0x42, 0x7c, 0x5c, 0x6c, 0x45,
+	0x89, 0x79, 0xe9, 0xa9, 0xc5, 0x12, 0x2c, 0x0a, 0xcc, 0x1a, 0xcc, 0x80, 0x01, 0x00, 0xf9, 0x4c,
+	0xd4, 0x62, 0x58, 0x00, 0x00, 0x00,
+}
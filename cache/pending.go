@@ -0,0 +1,219 @@
+package cache
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/seehuhn/trace"
+)
+
+// ErrIncomplete is returned when reading the body of a cache entry
+// which was still being stored, if storing the body is aborted.
+var ErrIncomplete = errors.New("cache: response body is incomplete")
+
+// A pendingEntry represents a response body which is in the process
+// of being written to a temporary file in the "new" directory.  Other
+// requests for the same key can read the body while it is still being
+// written.
+type pendingEntry struct {
+	cache    *ldbCache
+	key      []byte
+	meta     *MetaData
+	fileName string
+
+	mutex   sync.Mutex
+	cond    *sync.Cond
+	written int64
+	done    bool
+	err     error
+	hash    []byte
+}
+
+func newPendingEntry(cache *ldbCache, key []byte, meta *MetaData, fileName string) *pendingEntry {
+	p := &pendingEntry{
+		cache:    cache,
+		key:      key,
+		meta:     meta.clone(),
+		fileName: fileName,
+	}
+	p.cond = sync.NewCond(&p.mutex)
+	return p
+}
+
+// grow records that `n` more bytes have been written to the temporary
+// file.
+func (p *pendingEntry) grow(n int) {
+	p.mutex.Lock()
+	p.written += int64(n)
+	p.cond.Broadcast()
+	p.mutex.Unlock()
+}
+
+// finish signals that no more data will be written.  If `err` is
+// non-nil, readers which reach the end of the data see this error
+// instead of io.EOF.
+func (p *pendingEntry) finish(err error) {
+	p.mutex.Lock()
+	p.done = true
+	p.err = err
+	p.cond.Broadcast()
+	p.mutex.Unlock()
+}
+
+// commit signals that the body has been written completely.  If the
+// body was added to the content store, `hash` is the content hash;
+// readers which open the entry after the temporary file has been
+// removed then read the stored content instead.
+func (p *pendingEntry) commit(hash []byte) {
+	p.mutex.Lock()
+	p.done = true
+	p.hash = hash
+	p.cond.Broadcast()
+	p.mutex.Unlock()
+}
+
+// wait blocks until more than `pos` bytes have been written, or until
+// the writer has finished.  The return value is nil if more data is
+// available, and io.EOF or the writer's error otherwise.
+func (p *pendingEntry) wait(pos int64) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for p.written <= pos && !p.done {
+		p.cond.Wait()
+	}
+	if p.written > pos {
+		return nil
+	}
+	if p.err != nil {
+		return p.err
+	}
+	return io.EOF
+}
+
+// clone returns a copy of `meta` which does not share the header map
+// with the original.
+func (meta *MetaData) clone() *MetaData {
+	res := *meta
+	res.Header = make(http.Header, len(meta.Header))
+	for key, vals := range meta.Header {
+		res.Header[key] = append([]string(nil), vals...)
+	}
+	if meta.VaryHeader != nil {
+		res.VaryHeader = make(http.Header, len(meta.VaryHeader))
+		for key, vals := range meta.VaryHeader {
+			res.VaryHeader[key] = append([]string(nil), vals...)
+		}
+	}
+	return &res
+}
+
+// pendingWriter writes to the temporary file of a pending entry and
+// wakes up the readers.
+type pendingWriter struct {
+	file    *os.File
+	pending *pendingEntry
+}
+
+func (w *pendingWriter) Write(buf []byte) (int, error) {
+	n, err := w.file.Write(buf)
+	w.pending.grow(n)
+	return n, err
+}
+
+// pendingReader reads the body of a pending entry, blocking when it
+// catches up with the writer.
+type pendingReader struct {
+	file    *os.File
+	pending *pendingEntry
+	pos     int64
+}
+
+func (r *pendingReader) Read(buf []byte) (int, error) {
+	for {
+		n, err := r.file.Read(buf)
+		r.pos += int64(n)
+		if n > 0 {
+			return n, nil
+		}
+		if err != nil && err != io.EOF {
+			return 0, err
+		}
+		err = r.pending.wait(r.pos)
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (r *pendingReader) Close() error {
+	return r.file.Close()
+}
+
+func (cache *ldbCache) addPending(p *pendingEntry) {
+	cache.pendingMutex.Lock()
+	cache.pending[string(p.key)] = p
+	cache.pendingMutex.Unlock()
+}
+
+func (cache *ldbCache) removePending(p *pendingEntry) {
+	cache.pendingMutex.Lock()
+	if cache.pending[string(p.key)] == p {
+		delete(cache.pending, string(p.key))
+	}
+	cache.pendingMutex.Unlock()
+}
+
+// getPending returns all entries for `url` which are in the process of
+// being stored.
+func (cache *ldbCache) getPending(url string) []*pendingEntry {
+	keyPfx := string(keyPrefix(url))
+	var res []*pendingEntry
+	cache.pendingMutex.Lock()
+	for key, p := range cache.pending {
+		if strings.HasPrefix(key, keyPfx) {
+			res = append(res, p)
+		}
+	}
+	cache.pendingMutex.Unlock()
+	return res
+}
+
+// pendingToEntry converts a pending entry into an Entry for use by
+// Cache.Retrieve.
+func (cache *ldbCache) pendingToEntry(p *pendingEntry) *Entry {
+	return &Entry{
+		MetaData: *p.meta.clone(),
+		GetBody:  p.open,
+		Source:   "cache",
+	}
+}
+
+// open returns a reader which follows the temporary file.  If the
+// writer has finished and removed the file in the meantime, the stored
+// content is used instead, or nil is returned if the body was not
+// stored.
+func (p *pendingEntry) open() io.ReadCloser {
+	file, err := os.Open(p.fileName)
+	if err != nil {
+		if os.IsNotExist(err) {
+			p.mutex.Lock()
+			hash := p.hash
+			p.mutex.Unlock()
+			if hash != nil {
+				return p.cache.openContent(hash, true)
+			}
+		} else {
+			trace.T("jvproxy/cache", trace.PrioError,
+				"cannot read %s: %s", p.fileName, err.Error())
+		}
+		return nil
+	}
+	return &pendingReader{
+		file:    file,
+		pending: p,
+	}
+}
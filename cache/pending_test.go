@@ -0,0 +1,97 @@
+package cache
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *MySuite) TestPendingEntry(c *C) {
+	tempDir, err := ioutil.TempDir("", "jvproxy-test")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(tempDir)
+
+	cache, err := NewLevelDBCache(tempDir, nil)
+	c.Assert(err, IsNil)
+	defer cache.Close()
+
+	meta := &MetaData{
+		StatusCode: 200,
+		Header:     http.Header{},
+	}
+
+	for _, commit := range []bool{true, false} {
+		url := "http://example.com/large"
+		if !commit {
+			url += "-discarded"
+		}
+		req, _ := http.NewRequest("GET", url, nil)
+
+		pr, pw := io.Pipe()
+		entry := cache.StoreStart(url, meta)
+		writerDone := make(chan struct{})
+		go func() {
+			n, err := io.Copy(ioutil.Discard, entry.Reader(pr))
+			if err == nil && commit {
+				entry.Commit(n)
+			} else {
+				entry.Discard()
+			}
+			close(writerDone)
+		}()
+
+		pw.Write([]byte("hello "))
+		entries := cache.Retrieve(req)
+		c.Assert(entries, HasLen, 1)
+		body := entries[0].GetBody()
+		c.Assert(body, NotNil)
+
+		buf := make([]byte, 100)
+		n, err := body.Read(buf)
+		c.Assert(err, IsNil)
+		c.Assert(string(buf[:n]), Equals, "hello ")
+
+		readDone := make(chan string)
+		var readErr error
+		go func() {
+			rest, err := ioutil.ReadAll(body)
+			readErr = err
+			readDone <- string(rest)
+		}()
+		pw.Write([]byte("world"))
+		if commit {
+			pw.Close()
+		} else {
+			pw.CloseWithError(io.ErrUnexpectedEOF)
+		}
+		rest := <-readDone
+		<-writerDone
+		body.Close()
+
+		// readers opened after the writer has finished
+		late := entry.(StoreFollower).Follow()
+		if commit {
+			c.Assert(late, NotNil)
+			data, err := ioutil.ReadAll(late)
+			c.Check(err, IsNil)
+			c.Check(string(data), Equals, "hello world")
+			late.Close()
+		} else {
+			c.Check(late, IsNil)
+		}
+
+		c.Assert(rest, Equals, "world")
+		if commit {
+			c.Assert(readErr, IsNil)
+			entries = cache.Retrieve(req)
+			c.Assert(entries, HasLen, 1)
+			c.Assert(entries[0].CacheID, NotNil)
+		} else {
+			c.Assert(readErr, Equals, ErrIncomplete)
+			c.Assert(cache.Retrieve(req), HasLen, 0)
+		}
+	}
+}
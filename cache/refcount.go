@@ -0,0 +1,308 @@
+package cache
+
+import (
+	"os"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/seehuhn/jvproxy/cache/pb"
+	"github.com/seehuhn/trace"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// DedupStats describes how much space a LevelDB cache saves by
+// storing identical response bodies only once.  Sizes are given
+// before compression.
+type DedupStats struct {
+	// Bodies is the number of stored response bodies, References is
+	// the number of stored responses using these bodies.
+	Bodies     int64
+	References int64
+
+	// StoredBytes is the total size of the stored bodies,
+	// ReferencedBytes is the total size of the bodies of all stored
+	// responses.  SavedBytes is the difference of the two.
+	StoredBytes     int64
+	ReferencedBytes int64
+	SavedBytes      int64
+
+	// Ratio is ReferencedBytes divided by StoredBytes.
+	Ratio float64
+}
+
+// DedupStats scans the index and returns the deduplication
+// statistics of the cache.
+func (cache *ldbCache) DedupStats() DedupStats {
+	var res DedupStats
+	iter := cache.index.NewIterator(nil, nil)
+	for iter.Next() {
+		data := &pb.Entry{}
+		err := proto.Unmarshal(iter.Value(), data)
+		if err != nil || data.GetDropped() || data.GetRefCount() <= 0 {
+			continue
+		}
+		size := data.GetSize()
+		if data.ContentSize != nil {
+			size = data.GetContentSize()
+		}
+		refs := int64(data.GetRefCount())
+		res.Bodies++
+		res.References += refs
+		res.StoredBytes += size
+		res.ReferencedBytes += refs * size
+	}
+	iter.Release()
+	err := iter.Error()
+	if err != nil {
+		trace.T("jvproxy/cache", trace.PrioError,
+			"error while using levelDB iterator: %s", err.Error())
+	}
+	res.SavedBytes = res.ReferencedBytes - res.StoredBytes
+	res.Ratio = 1
+	if res.StoredBytes > 0 {
+		res.Ratio = float64(res.ReferencedBytes) / float64(res.StoredBytes)
+	}
+	return res
+}
+
+// contentRef identifies a reference from a metadata record to stored
+// content.  Every index entry is assigned a new generation when it is
+// created, and the reference only counts towards the entry if the
+// generations agree.  This way, releasing a reference to content which
+// has been removed from the index does not affect the reference count
+// if the same content is stored again later.
+type contentRef struct {
+	hash       []byte
+	generation int64
+}
+
+// newGeneration returns the generation for a new index entry.  This
+// must be called by the cache manager, or before the cache manager is
+// started.
+func (cache *ldbCache) newGeneration() int64 {
+	gen := time.Now().UnixNano()
+	if gen <= cache.generation {
+		gen = cache.generation + 1
+	}
+	cache.generation = gen
+	return gen
+}
+
+// countReferences sets the reference counts in the index to the
+// number of metadata records using each data.  Referenced data which
+// is missing from the index is added, and metadata records are
+// changed to refer to the current generation of the index entries.
+// This is called when the cache is opened, before the index is used
+// by any other goroutine.
+func (cache *ldbCache) countReferences() error {
+	refs := make(map[string]int32)
+	iter := cache.meta.NewIterator(nil, nil)
+	for iter.Next() {
+		if hash := metaRecordHash(iter.Value()); hash != nil {
+			refs[string(hash)]++
+		}
+	}
+	iter.Release()
+	err := iter.Error()
+	if err != nil {
+		return err
+	}
+
+	generations := make(map[string]int64)
+	batch := new(leveldb.Batch)
+	iter = cache.index.NewIterator(nil, nil)
+	for iter.Next() {
+		hash := string(iter.Key())
+		n := refs[hash]
+		delete(refs, hash)
+		data := &pb.Entry{}
+		err := proto.Unmarshal(iter.Value(), data)
+		if err != nil {
+			continue
+		}
+		if data.GetGeneration() != 0 {
+			generations[hash] = data.GetGeneration()
+			if data.RefCount != nil && data.GetRefCount() == n {
+				continue
+			}
+		} else {
+			data.Generation = proto.Int64(cache.newGeneration())
+			generations[hash] = data.GetGeneration()
+		}
+		data.RefCount = proto.Int32(n)
+		raw, err := proto.Marshal(data)
+		if err != nil {
+			panic(err)
+		}
+		batch.Put([]byte(hash), raw)
+	}
+	iter.Release()
+	err = iter.Error()
+	if err != nil {
+		return err
+	}
+
+	for hash, n := range refs {
+		fi, err := os.Stat(cache.getStoreName([]byte(hash)))
+		if err != nil {
+			continue
+		}
+		useTime := fi.ModTime().Unix()
+		gen := cache.newGeneration()
+		generations[hash] = gen
+		raw, err := proto.Marshal(&pb.Entry{
+			FirstUsed:  proto.Int64(useTime),
+			LastUsed:   proto.Int64(useTime),
+			Size:       proto.Int64(fi.Size()),
+			UseCount:   proto.Int32(1),
+			RefCount:   proto.Int32(n),
+			Generation: proto.Int64(gen),
+		})
+		if err != nil {
+			panic(err)
+		}
+		batch.Put([]byte(hash), raw)
+	}
+
+	if batch.Len() > 0 {
+		trace.T("jvproxy/cache", trace.PrioInfo,
+			"updated %d reference counts", batch.Len())
+	}
+	err = cache.index.Write(batch, nil)
+	if err != nil {
+		return err
+	}
+
+	batch = new(leveldb.Batch)
+	iter = cache.meta.NewIterator(nil, nil)
+	for iter.Next() {
+		data, _ := parseMetaRecord(iter.Value())
+		if data == nil {
+			continue
+		}
+		gen, ok := generations[string(data.GetContentHash())]
+		if !ok || data.GetGeneration() == gen {
+			continue
+		}
+		data.Generation = proto.Int64(gen)
+		raw, err := proto.Marshal(data)
+		if err != nil {
+			panic(err)
+		}
+		batch.Put(append([]byte{}, iter.Key()...), raw)
+	}
+	iter.Release()
+	err = iter.Error()
+	if err != nil {
+		return err
+	}
+	if batch.Len() > 0 {
+		trace.T("jvproxy/cache", trace.PrioInfo,
+			"updated %d metadata records", batch.Len())
+	}
+	return cache.meta.Write(batch, nil)
+}
+
+// putMeta stores a metadata record.  If the record replaces an
+// existing record, the reference of the old record is returned, with
+// a nil hash if there was no old record.  The caller must already
+// have added a reference to the content of the new record, and must
+// release the reference to the old content.
+func (cache *ldbCache) putMeta(key, value []byte) (contentRef, error) {
+	cache.metaMutex.Lock()
+	defer cache.metaMutex.Unlock()
+	var oldRef contentRef
+	old, err := cache.meta.Get(key, nil)
+	if err == nil {
+		oldRef = metaRecordRef(old)
+	}
+	err = cache.meta.Put(key, value, nil)
+	if err != nil {
+		return contentRef{}, err
+	}
+	return oldRef, nil
+}
+
+// releaseRef reports a removed reference to the cache manager.
+func (cache *ldbCache) releaseRef(ref contentRef) {
+	cache.submitSample(&sample{
+		hash:       ref.hash,
+		size:       -1,
+		refs:       -1,
+		generation: ref.generation,
+	})
+}
+
+// changeEntry applies a sample without size information to the
+// existing index entry `data`.  Once the last reference to the data
+// has been released, the data is removed.  Released references are
+// ignored, unless they belong to the current generation of the entry.
+// This must be called by the cache manager.
+func (cache *ldbCache) changeEntry(s *sample, data *pb.Entry) {
+	if s.refs < 0 && s.generation != data.GetGeneration() {
+		trace.T("jvproxy/cache", trace.PrioDebug,
+			"ignoring reference to old generation of %x", s.hash)
+		return
+	}
+	if s.useTime > 0 {
+		data.LastUsed = proto.Int64(s.useTime)
+	}
+	if s.expiry != nil {
+		setExpiry(data, s.expiry)
+	}
+	if s.refs != 0 {
+		n := data.GetRefCount() + s.refs
+		if n <= 0 && s.refs < 0 {
+			cache.removeUnreferenced(s.hash, data)
+			return
+		}
+		if n < 0 {
+			n = 0
+		}
+		data.RefCount = proto.Int32(n)
+		s.generation = data.GetGeneration()
+	}
+	raw, err := proto.Marshal(data)
+	if err != nil {
+		panic(err)
+	}
+	err = cache.index.Put(s.hash, raw, nil)
+	if err != nil {
+		trace.T("jvproxy/cache", trace.PrioError,
+			"error while writing index entry: %s", err.Error())
+	}
+}
+
+// removeUnreferenced removes data which is no longer used by any
+// metadata record.  This must be called by the cache manager.
+func (cache *ldbCache) removeUnreferenced(hash []byte, data *pb.Entry) {
+	fname := cache.getStoreName(hash)
+	err := os.Remove(fname)
+	if err != nil && !os.IsNotExist(err) {
+		trace.T("jvproxy/cache", trace.PrioError,
+			"cannot remove %s: %s", fname, err.Error())
+		return
+	}
+	cache.deleteIndexEntry(hash)
+	if !data.GetDropped() {
+		cache.usageMutex.Lock()
+		cache.totalBytes -= data.GetSize()
+		cache.totalEntries--
+		cache.usageMutex.Unlock()
+	}
+	trace.T("jvproxy/cache", trace.PrioDebug,
+		"removed unreferenced data %s", fname)
+}
+
+// isUnreferenced checks whether the data described by `data` is not
+// used by any metadata record.  New data is only reported after it
+// has been unused for a while, since the reference for data which is
+// being stored may not have been recorded yet.
+func isUnreferenced(data *pb.Entry, now int64) bool {
+	return data.RefCount != nil && data.GetRefCount() == 0 &&
+		now-data.GetLastUsed() > int64(unreferencedGrace/time.Second)
+}
+
+// unreferencedGrace is the time after which unreferenced data is
+// evicted first.
+const unreferencedGrace = time.Minute
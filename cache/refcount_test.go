@@ -0,0 +1,156 @@
+package cache
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/seehuhn/jvproxy/cache/pb"
+	"github.com/syndtr/goleveldb/leveldb"
+	. "gopkg.in/check.v1"
+)
+
+// waitForRefs waits until the index records `n` references to the
+// data with the given hash, or until the data has been removed from
+// the index if `n` is zero.
+func waitForRefs(c *C, cache *ldbCache, hash []byte, n int32) {
+	for i := 0; i < 500; i++ {
+		data := cache.getIndexEntry(hash)
+		if (n == 0 && data == nil) || (data != nil && data.GetRefCount() == n) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Fatalf("timeout, index entry is %v", cache.getIndexEntry(hash))
+}
+
+func (s *MySuite) TestRefCounts(c *C) {
+	tempDir, err := ioutil.TempDir("", "jvproxy-test")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(tempDir)
+
+	store, err := NewLevelDBCache(tempDir, nil)
+	c.Assert(err, IsNil)
+	cache := store.(*ldbCache)
+
+	retrieve := func(name string) []*Entry {
+		req, _ := http.NewRequest("GET", "http://example.com/"+name, nil)
+		return store.Retrieve(req)
+	}
+	shared := strings.Repeat("shared ", 10)
+	for _, name := range []string{"a", "b", "c"} {
+		storeString(c, store, "http://example.com/"+name, http.Header{}, shared)
+	}
+	storeString(c, store, "http://example.com/d", http.Header{}, "unique")
+	waitForUsage(c, cache, func(u LevelDBUsage) bool {
+		return u.Entries == 2
+	})
+	id := retrieve("a")[0].CacheID
+	waitForRefs(c, cache, id, 3)
+	for _, name := range []string{"b", "c"} {
+		entries := retrieve(name)
+		c.Assert(entries, HasLen, 1)
+		c.Check(entries[0].CacheID, DeepEquals, id)
+		c.Check(readBody(c, entries[0]), Equals, shared)
+	}
+
+	stats := cache.DedupStats()
+	c.Check(stats.Bodies, Equals, int64(2))
+	c.Check(stats.References, Equals, int64(4))
+	c.Check(stats.StoredBytes, Equals, int64(len(shared)+6))
+	c.Check(stats.SavedBytes, Equals, int64(2*len(shared)))
+	c.Check(stats.Ratio > 1, Equals, true)
+
+	// invalidating one URL keeps the shared content
+	store.Invalidate("http://example.com/a")
+	waitForRefs(c, cache, id, 2)
+	c.Check(retrieve("a"), HasLen, 0)
+	c.Check(readBody(c, retrieve("b")[0]), Equals, shared)
+
+	// replacing a record with the same content keeps the count,
+	// replacing it with new content releases the reference
+	storeString(c, store, "http://example.com/b", http.Header{}, shared)
+	storeString(c, store, "http://example.com/c", http.Header{}, "new content")
+	waitForRefs(c, cache, id, 1)
+
+	// once the last reference is gone, the content is removed
+	store.Invalidate("http://example.com/b")
+	waitForRefs(c, cache, id, 0)
+	_, err = os.Stat(cache.getStoreName(id))
+	c.Check(os.IsNotExist(err), Equals, true)
+	waitForUsage(c, cache, func(u LevelDBUsage) bool {
+		return u.Entries == 2
+	})
+
+	// wrong counts are corrected when the cache is opened
+	idD := retrieve("d")[0].CacheID
+	c.Assert(store.Close(), IsNil)
+	index, err := leveldb.OpenFile(filepath.Join(tempDir, indexDirName), nil)
+	c.Assert(err, IsNil)
+	raw, err := index.Get(idD, nil)
+	c.Assert(err, IsNil)
+	data := &pb.Entry{}
+	c.Assert(proto.Unmarshal(raw, data), IsNil)
+	data.RefCount = proto.Int32(7)
+	raw, err = proto.Marshal(data)
+	c.Assert(err, IsNil)
+	c.Assert(index.Put(idD, raw, nil), IsNil)
+	c.Assert(index.Close(), IsNil)
+
+	store, err = NewLevelDBCache(tempDir, nil)
+	c.Assert(err, IsNil)
+	defer store.Close()
+	cache = store.(*ldbCache)
+	c.Check(cache.getIndexEntry(idD).GetRefCount(), Equals, int32(1))
+}
+
+func (s *MySuite) TestRefGenerations(c *C) {
+	tempDir, err := ioutil.TempDir("", "jvproxy-test")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(tempDir)
+
+	store, err := NewLevelDBCache(tempDir, nil)
+	c.Assert(err, IsNil)
+	defer store.Close()
+	cache := store.(*ldbCache)
+
+	retrieve := func(name string) []*Entry {
+		req, _ := http.NewRequest("GET", "http://example.com/"+name, nil)
+		return store.Retrieve(req)
+	}
+	shared := strings.Repeat("shared ", 10)
+	storeString(c, store, "http://example.com/a", http.Header{}, shared)
+	storeString(c, store, "http://example.com/c", http.Header{}, shared)
+	id := retrieve("a")[0].CacheID
+	waitForRefs(c, cache, id, 2)
+	oldGen := cache.getIndexEntry(id).GetGeneration()
+
+	// The content is pruned, and stored again for a different URL
+	// before the metadata records are pruned.
+	c.Assert(os.Remove(cache.getStoreName(id)), IsNil)
+	c.Assert(cache.index.Delete(id, nil), IsNil)
+	storeString(c, store, "http://example.com/b", http.Header{}, shared)
+	waitForRefs(c, cache, id, 1)
+	c.Check(cache.getIndexEntry(id).GetGeneration() > oldGen, Equals, true)
+
+	// Releasing the reference of the old record does not affect the
+	// new generation.  Storing another response waits for the cache
+	// manager, so the release has been processed afterwards.
+	store.Invalidate("http://example.com/a")
+	storeString(c, store, "http://example.com/d", http.Header{}, "sync")
+	c.Check(cache.getIndexEntry(id).GetRefCount(), Equals, int32(1))
+	_, err = os.Stat(cache.getStoreName(id))
+	c.Check(err, IsNil)
+
+	// Records for the old generation are pruned.
+	cache.pruneMetadata()
+	c.Check(retrieve("c"), HasLen, 0)
+	entries := retrieve("b")
+	c.Assert(entries, HasLen, 1)
+	c.Check(readBody(c, entries[0]), Equals, shared)
+	c.Check(cache.getIndexEntry(id).GetRefCount(), Equals, int32(1))
+}
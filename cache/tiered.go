@@ -0,0 +1,302 @@
+package cache
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"golang.org/x/crypto/sha3"
+)
+
+// Admission decides which responses are kept in the memory tier of a
+// TieredCache.
+type Admission struct {
+	// MaxSize is the size (in bytes) of the largest response body
+	// kept in the memory tier.  Zero means that only the byte budget
+	// of the memory tier limits the size.
+	MaxSize int64
+
+	// MinUses is the number of times a response stored in the disk
+	// tier must have been used, before it is promoted into the
+	// memory tier.  Newly stored responses are always written to
+	// both tiers.
+	MinUses int
+}
+
+// TieredCache is a Cache which keeps frequently used responses in a
+// MemoryCache, on top of a larger, slower cache (normally the LevelDB
+// cache).  New responses are written to both tiers.  Responses which
+// are only found in the disk tier are copied into the memory tier
+// while they are read, if the admission policy allows this.
+type TieredCache struct {
+	mem   *MemoryCache
+	disk  Cache
+	admit Admission
+
+	mutex sync.Mutex
+	stats TieredStats
+}
+
+// TieredStats summarises the use of a TieredCache.
+type TieredStats struct {
+	Memory     MemoryStats
+	MemoryHits int64
+	DiskHits   int64
+	Promotions int64
+}
+
+// NewTieredCache creates a new TieredCache, using `mem` as the memory
+// tier and `disk` as the disk tier.  Closing the TieredCache closes
+// both tiers.
+func NewTieredCache(mem *MemoryCache, disk Cache, admit Admission) *TieredCache {
+	return &TieredCache{
+		mem:   mem,
+		disk:  disk,
+		admit: admit,
+	}
+}
+
+// Retrieve implements the corresponding method of the Cache interface.
+func (cache *TieredCache) Retrieve(req *http.Request) []*Entry {
+	res := cache.mem.Retrieve(req)
+	if len(res) > 0 {
+		cache.mutex.Lock()
+		cache.stats.MemoryHits++
+		cache.mutex.Unlock()
+		for _, entry := range res {
+			cache.recordingUse(entry)
+		}
+		return res
+	}
+
+	res = cache.disk.Retrieve(req)
+	if len(res) == 0 {
+		return nil
+	}
+	cache.mutex.Lock()
+	cache.stats.DiskHits++
+	cache.mutex.Unlock()
+
+	url := req.URL.String()
+	for i, entry := range res {
+		if cache.shouldPromote(entry) {
+			res[i] = cache.promoting(url, entry)
+		}
+	}
+	return res
+}
+
+// shouldPromote applies the admission policy to an entry from the
+// disk tier.
+func (cache *TieredCache) shouldPromote(entry *Entry) bool {
+	if len(entry.CacheID) != hashLen {
+		// still being stored
+		return false
+	}
+	if cache.admit.MaxSize > 0 {
+		size, err := strconv.ParseInt(entry.Header.Get("Content-Length"), 10, 64)
+		if err == nil && size > cache.admit.MaxSize {
+			return false
+		}
+	}
+	if cache.admit.MinUses > 0 {
+		counter, ok := cache.disk.(interface {
+			useCount(hash []byte) int
+		})
+		if ok && counter.useCount(entry.CacheID) < cache.admit.MinUses {
+			return false
+		}
+	}
+	return true
+}
+
+// recordingUse changes `entry`, found in the memory tier, so that uses
+// of the body are also recorded in the index of the disk tier.  This
+// keeps the eviction policy and the admission policy of the disk tier
+// informed about responses served from memory.
+func (cache *TieredCache) recordingUse(entry *Entry) {
+	recorder, ok := cache.disk.(interface {
+		recordUse(hash []byte)
+	})
+	if !ok || len(entry.CacheID) != hashLen {
+		return
+	}
+	id := entry.CacheID
+	getBody := entry.GetBody
+	entry.GetBody = func() io.ReadCloser {
+		body := getBody()
+		if body != nil {
+			recorder.recordUse(id)
+		}
+		return body
+	}
+}
+
+// promoting returns a copy of `entry` where the body is copied into
+// the memory tier while it is read.
+func (cache *TieredCache) promoting(url string, entry *Entry) *Entry {
+	res := *entry
+	getBody := entry.GetBody
+	meta := entry.MetaData
+	res.GetBody = func() io.ReadCloser {
+		body := getBody()
+		if body == nil {
+			return nil
+		}
+		r := &promoteReader{
+			body:  body,
+			store: cache.mem.storeStartID(url, &meta, entry.CacheID, cache.admit.MaxSize),
+			cache: cache,
+		}
+		if _, ok := body.(io.Seeker); ok {
+			return &promoteSeeker{r}
+		}
+		return r
+	}
+	return &res
+}
+
+// promoteReader reads the body of an entry from the disk tier, and
+// stores a copy in the memory tier.
+type promoteReader struct {
+	body  io.ReadCloser
+	store *memStoreCont
+	n     int64
+	done  bool
+	cache *TieredCache
+}
+
+func (r *promoteReader) Read(p []byte) (int, error) {
+	n, err := r.body.Read(p)
+	if r.done {
+		return n, err
+	}
+	r.store.Write(p[:n])
+	r.n += int64(n)
+	if err == io.EOF {
+		r.store.Commit(r.n)
+		r.done = true
+		r.cache.mutex.Lock()
+		r.cache.stats.Promotions++
+		r.cache.mutex.Unlock()
+	} else if err != nil {
+		r.abort()
+	}
+	return n, err
+}
+
+func (r *promoteReader) abort() {
+	if !r.done {
+		r.store.Discard()
+		r.done = true
+	}
+}
+
+func (r *promoteReader) Close() error {
+	r.abort()
+	return r.body.Close()
+}
+
+// promoteSeeker is used instead of promoteReader, if the body from the
+// disk tier implements io.Seeker.  Seeking stops the promotion.
+type promoteSeeker struct {
+	*promoteReader
+}
+
+var errNotSeeker = errors.New("cache: body does not support seeking")
+
+func (r *promoteSeeker) Seek(offset int64, whence int) (int64, error) {
+	r.abort()
+	s, ok := r.body.(io.Seeker)
+	if !ok {
+		return 0, errNotSeeker
+	}
+	return s.Seek(offset, whence)
+}
+
+// StoreStart implements the corresponding method of the Cache
+// interface.  The response is written to both tiers.
+func (cache *TieredCache) StoreStart(url string, meta *MetaData) StoreCont {
+	return &tieredStoreCont{
+		disk: cache.disk.StoreStart(url, meta),
+		mem:  cache.mem.storeStartID(url, meta, nil, cache.admit.MaxSize),
+		hash: sha3.NewShake128(),
+	}
+}
+
+// StorePartial implements the corresponding method of the Cache
+// interface.  Partial responses are only stored in the disk tier.
+func (cache *TieredCache) StorePartial(url string, meta *MetaData, offset, total int64) StoreCont {
+	return cache.disk.StorePartial(url, meta, offset, total)
+}
+
+// Invalidate implements the corresponding method of the Cache
+// interface.
+func (cache *TieredCache) Invalidate(url string) {
+	cache.mem.Invalidate(url)
+	cache.disk.Invalidate(url)
+}
+
+// Update implements the corresponding method of the Cache interface.
+// Entries in both tiers use the same CacheID, so that the update
+// applies to both tiers.
+func (cache *TieredCache) Update(url string, entry *Entry) {
+	cache.mem.Update(url, entry)
+	cache.disk.Update(url, entry)
+}
+
+// Close implements the corresponding method of the Cache interface.
+func (cache *TieredCache) Close() error {
+	cache.mem.Close()
+	return cache.disk.Close()
+}
+
+// Stats returns information about the use of the cache.
+func (cache *TieredCache) Stats() TieredStats {
+	cache.mutex.Lock()
+	res := cache.stats
+	cache.mutex.Unlock()
+	res.Memory = cache.mem.Stats()
+	return res
+}
+
+type tieredStoreCont struct {
+	disk StoreCont
+	mem  *memStoreCont
+	hash sha3.ShakeHash
+}
+
+func (entry *tieredStoreCont) Reader(r io.Reader) io.Reader {
+	return io.TeeReader(entry.disk.Reader(r), io.MultiWriter(entry.hash, entry.mem))
+}
+
+// Follow implements the StoreFollower interface, by following the
+// body as it is written to the disk tier.  If the disk tier does not
+// support this, nil is returned.
+func (entry *tieredStoreCont) Follow() io.ReadCloser {
+	if f, ok := entry.disk.(StoreFollower); ok {
+		return f.Follow()
+	}
+	return nil
+}
+
+func (entry *tieredStoreCont) Commit(size int64) {
+	entry.disk.Commit(size)
+
+	// The memory tier uses the content hash as the CacheID, like
+	// the LevelDB cache does.
+	id := make([]byte, hashLen)
+	_, err := io.ReadFull(entry.hash, id)
+	if err != nil {
+		panic(err)
+	}
+	entry.mem.id = id
+	entry.mem.Commit(size)
+}
+
+func (entry *tieredStoreCont) Discard() {
+	entry.disk.Discard()
+	entry.mem.Discard()
+}
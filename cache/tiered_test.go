@@ -0,0 +1,76 @@
+package cache
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *MySuite) TestTieredCache(c *C) {
+	tempDir, err := ioutil.TempDir("", "jvproxy-test")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(tempDir)
+
+	disk, err := NewLevelDBCache(tempDir, nil)
+	c.Assert(err, IsNil)
+	mem := NewMemoryCache(1 << 20)
+	cache := NewTieredCache(mem, disk, Admission{MaxSize: 100})
+	defer cache.Close()
+
+	url := "http://example.com/small.json"
+	req, _ := http.NewRequest("GET", url, nil)
+	storeString(c, cache, url, http.Header{}, "{}")
+	c.Assert(mem.Stats().Entries, Equals, 1)
+	c.Assert(disk.Retrieve(req), HasLen, 1)
+
+	// promotion from the disk tier
+	mem.Invalidate(url)
+	entries := cache.Retrieve(req)
+	c.Assert(entries, HasLen, 1)
+	c.Assert(mem.Stats().Entries, Equals, 0)
+	c.Assert(readBody(c, entries[0]), Equals, "{}")
+	c.Assert(mem.Stats().Entries, Equals, 1)
+
+	entries = cache.Retrieve(req)
+	c.Assert(entries, HasLen, 1)
+	stats := cache.Stats()
+	c.Assert(stats.MemoryHits, Equals, int64(1))
+	c.Assert(stats.DiskHits, Equals, int64(1))
+	c.Assert(stats.Promotions, Equals, int64(1))
+
+	// memory hits are recorded in the disk tier
+	ldb := disk.(*ldbCache)
+	uses := ldb.useCount(entries[0].CacheID)
+	c.Assert(readBody(c, entries[0]), Equals, "{}")
+	deadline := time.Now().Add(5 * time.Second)
+	for ldb.useCount(entries[0].CacheID) <= uses {
+		if time.Now().After(deadline) {
+			c.Fatalf("memory hit not recorded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// updates apply to both tiers
+	entries[0].Header.Set("X-Updated", "yes")
+	cache.Update(url, entries[0])
+	c.Assert(mem.Retrieve(req)[0].Header.Get("X-Updated"), Equals, "yes")
+	c.Assert(disk.Retrieve(req)[0].Header.Get("X-Updated"), Equals, "yes")
+
+	// large responses stay on disk
+	url = "http://example.com/large"
+	req, _ = http.NewRequest("GET", url, nil)
+	h := http.Header{}
+	h.Set("Content-Length", "200")
+	storeString(c, cache, url, h, string(make([]byte, 200)))
+	c.Assert(mem.Retrieve(req), HasLen, 0)
+	entries = cache.Retrieve(req)
+	c.Assert(entries, HasLen, 1)
+	c.Assert(readBody(c, entries[0]), HasLen, 200)
+	c.Assert(mem.Retrieve(req), HasLen, 0)
+
+	cache.Invalidate("http://example.com/small.json")
+	c.Assert(mem.Stats().Entries, Equals, 0)
+}
@@ -4,6 +4,7 @@ import (
 	"net/http"
 	"net/textproto"
 	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/seehuhn/httputil"
@@ -25,22 +26,254 @@ func getVaryFields(header http.Header) []string {
 	return fields
 }
 
-func getNormalizedHeaders(fields []string, header http.Header) []string {
+// A VaryNormalizer reduces the value of a request header field,
+// which is nominated by the Vary header field of a response, to the
+// information which actually selects the response.  Requests with the
+// same normalized values share a stored variant, so normalizers which
+// discard irrelevant differences increase the hit rate.
+type VaryNormalizer interface {
+	// Normalize returns the normalized form of the request header
+	// value `value`, for selecting the stored response with header
+	// `resp`.  The value is already normalized using
+	// httputil.NormalizeHeader.
+	Normalize(value string, resp http.Header) string
+}
+
+// VaryNormalizerFunc allows to use an ordinary function as a
+// VaryNormalizer.
+type VaryNormalizerFunc func(value string, resp http.Header) string
+
+// Normalize calls f(value, resp).
+func (f VaryNormalizerFunc) Normalize(value string, resp http.Header) string {
+	return f(value, resp)
+}
+
+// VaryNormalizers maps the names of request header fields, in the
+// canonical form returned by textproto.CanonicalMIMEHeaderKey, to the
+// normalizers used for these fields.  The values of fields without a
+// normalizer are compared verbatim.  The normalized values are part of
+// the stored cache keys, so responses stored before the normalizer for
+// a field changes may no longer be found.
+type VaryNormalizers map[string]VaryNormalizer
+
+// DefaultVaryNormalizers returns the normalizers which are used if no
+// others are configured.  These cover the Accept-Encoding and
+// Accept-Language header fields.
+func DefaultVaryNormalizers() VaryNormalizers {
+	return VaryNormalizers{
+		"Accept-Encoding": VaryNormalizerFunc(normalizeAcceptEncoding),
+		"Accept-Language": VaryNormalizerFunc(normalizeAcceptLanguage),
+	}
+}
+
+// defaultVaryNormalizers is used by caches without configured
+// normalizers.  The map is never modified.
+var defaultVaryNormalizers = DefaultVaryNormalizers()
+
+// orDefault returns `n`, or the default normalizers if `n` is nil.
+func (n VaryNormalizers) orDefault() VaryNormalizers {
+	if n == nil {
+		return defaultVaryNormalizers
+	}
+	return n
+}
+
+func (n VaryNormalizers) normalizeHeader(name string, req, resp http.Header) string {
+	value := httputil.NormalizeHeader(strings.Join(req[name], ","))
+	normalizer := n[name]
+	if normalizer == nil {
+		return value
+	}
+	return normalizer.Normalize(value, resp)
+}
+
+func (n VaryNormalizers) getNormalizedHeaders(fields []string, req, resp http.Header) []string {
 	var res []string
 	for _, name := range fields {
-		normalized := httputil.NormalizeHeader(strings.Join(header[name], ","))
-		res = append(res, normalized)
+		res = append(res, n.normalizeHeader(name, req, resp))
 	}
 	return res
 }
 
-func varyHeadersMatch(fields, values []string, header http.Header) bool {
+func (n VaryNormalizers) varyHeadersMatch(fields, values []string, req, resp http.Header) bool {
 	for i, name := range fields {
-		expected := values[i]
-		received := httputil.NormalizeHeader(strings.Join(header[name], ","))
-		if received != expected {
+		if n.normalizeHeader(name, req, resp) != values[i] {
 			return false
 		}
 	}
 	return true
 }
+
+// VaryHeader returns the request header fields from `req` which are
+// nominated by the Vary header field in `resp`, for use as
+// MetaData.VaryHeader.  Fields missing from `req` are included with
+// an empty value.
+func VaryHeader(resp, req http.Header) http.Header {
+	fields := getVaryFields(resp)
+	if fields == nil || fields[0] == "*" {
+		return nil
+	}
+	res := make(http.Header, len(fields))
+	for _, name := range fields {
+		vals := req[name]
+		if len(vals) == 0 {
+			vals = []string{""}
+		}
+		res[name] = append([]string(nil), vals...)
+	}
+	return res
+}
+
+func (meta *MetaData) varyHeader() http.Header {
+	if meta.VaryHeader != nil {
+		return meta.VaryHeader
+	}
+	return meta.Header
+}
+
+// qItem is an element of a header field value with quality values,
+// like Accept-Encoding or Accept-Language (RFC 7231, section 5.3.1).
+type qItem struct {
+	name string
+	q    float64
+}
+
+// parseQList parses a header field value with quality values.  The
+// names are converted to lower case, and the items are sorted by
+// decreasing quality, keeping the order of items with equal quality.
+func parseQList(value string) []qItem {
+	var res []qItem
+	for _, item := range strings.Split(value, ",") {
+		params := strings.Split(item, ";")
+		name := strings.ToLower(strings.TrimSpace(params[0]))
+		if name == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if len(param) > 2 && strings.EqualFold(param[:2], "q=") {
+				if w, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = w
+				}
+			}
+		}
+		res = append(res, qItem{name, q})
+	}
+	sort.SliceStable(res, func(i, j int) bool {
+		return res[i].q > res[j].q
+	})
+	return res
+}
+
+// normalizeAcceptEncoding reduces Accept-Encoding to the
+// content-coding of the stored response, if this coding is acceptable
+// (RFC 7231, section 5.3.4).  Otherwise the value is left unchanged.
+func normalizeAcceptEncoding(value string, resp http.Header) string {
+	coding := strings.ToLower(httputil.NormalizeHeader(
+		strings.Join(resp["Content-Encoding"], ",")))
+	if coding == "" {
+		coding = "identity"
+	}
+	if value == "" {
+		// no preference
+		return coding
+	}
+	q, star := -1.0, -1.0
+	for _, item := range parseQList(value) {
+		switch item.name {
+		case coding:
+			if q < 0 {
+				q = item.q
+			}
+		case "*":
+			if star < 0 {
+				star = item.q
+			}
+		}
+	}
+	if q < 0 {
+		q = star
+	}
+	if q > 0 || (q < 0 && coding == "identity") {
+		return coding
+	}
+	return value
+}
+
+// normalizeAcceptLanguage reduces Accept-Language to the language of
+// the stored response, if this is the best match for the request.
+// Responses without Content-Language are selected by the verbatim
+// value.
+func normalizeAcceptLanguage(value string, resp http.Header) string {
+	lang := strings.ToLower(strings.TrimSpace(
+		strings.Split(resp.Get("Content-Language"), ",")[0]))
+	if lang == "" {
+		return value
+	}
+	if value == "" {
+		// no preference
+		return lang
+	}
+	items := parseQList(value)
+	if len(items) == 0 || items[0].q <= 0 {
+		return value
+	}
+	best := items[0].name
+	// basic filtering, see RFC 4647, section 3.3.1
+	if best == "*" || best == lang || strings.HasPrefix(lang, best+"-") {
+		return lang
+	}
+	return value
+}
+
+// UserAgentBuckets is a VaryNormalizer for the User-Agent header
+// field.  A value is reduced to the name of the first bucket where one
+// of the patterns occurs in the value, ignoring case.  An empty
+// pattern matches all values.  Values which match no bucket are left
+// unchanged.
+type UserAgentBuckets []UserAgentBucket
+
+// UserAgentBucket is an element of UserAgentBuckets.
+type UserAgentBucket struct {
+	Name     string
+	Patterns []string
+}
+
+// Normalize implements the VaryNormalizer interface.
+func (b UserAgentBuckets) Normalize(value string, _ http.Header) string {
+	lower := strings.ToLower(value)
+	for _, bucket := range b {
+		for _, pattern := range bucket.Patterns {
+			if strings.Contains(lower, strings.ToLower(pattern)) {
+				return bucket.Name
+			}
+		}
+	}
+	return value
+}
+
+// Values returns the normalized values of the request header fields
+// in `req` which are nominated by the Vary header field in `resp`.
+// Requests with equal values select the same stored response.  If `n`
+// is nil, the default normalizers are used.
+func (n VaryNormalizers) Values(resp, req http.Header) []string {
+	fields := getVaryFields(resp)
+	return n.orDefault().getNormalizedHeaders(fields, req, resp)
+}
+
+// Match checks whether a response with header `resp`, which was
+// obtained for a request with header `orig`, can be used to satisfy a
+// request with header `req`.  This is the case if all request header
+// fields nominated by the Vary header field of the response match
+// (RFC 7234, section 4.1), after normalization.  If `n` is nil, the
+// default normalizers are used.
+func (n VaryNormalizers) Match(resp, orig, req http.Header) bool {
+	fields := getVaryFields(resp)
+	if len(fields) == 1 && fields[0] == "*" {
+		return false
+	}
+	n = n.orDefault()
+	values := n.getNormalizedHeaders(fields, orig, resp)
+	return n.varyHeadersMatch(fields, values, req, resp)
+}
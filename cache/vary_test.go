@@ -1,7 +1,10 @@
 package cache
 
 import (
+	"io"
+	"io/ioutil"
 	"net/http"
+	"strings"
 
 	. "gopkg.in/check.v1"
 )
@@ -27,3 +30,143 @@ func (s *MySuite) TestVary(c *C) {
 	fields = getVaryFields(h)
 	c.Assert(fields, DeepEquals, []string{"Field-A", "Field-B", "Field-C"})
 }
+
+func (s *MySuite) TestVaryMatch(c *C) {
+	resp := http.Header{}
+	orig := http.Header{}
+	orig.Set("Accept-Language", "en")
+	req := http.Header{}
+	req.Set("Accept-Language", "de")
+	c.Assert(DefaultVaryNormalizers().Match(resp, orig, req), Equals, true)
+
+	resp.Set("Vary", "Accept-Language")
+	c.Assert(DefaultVaryNormalizers().Match(resp, orig, req), Equals, false)
+	req.Set("Accept-Language", "en")
+	c.Assert(DefaultVaryNormalizers().Match(resp, orig, req), Equals, true)
+
+	resp.Set("Vary", "*")
+	c.Assert(DefaultVaryNormalizers().Match(resp, orig, req), Equals, false)
+}
+
+func (s *MySuite) TestVaryNormalizers(c *C) {
+	gzipped := http.Header{}
+	gzipped.Set("Content-Encoding", "gzip")
+	plain := http.Header{}
+	for _, test := range []struct {
+		value    string
+		resp     http.Header
+		expected string
+	}{
+		{"gzip, deflate, br", gzipped, "gzip"},
+		{"gzip,br", gzipped, "gzip"},
+		{"", gzipped, "gzip"},
+		{"*", gzipped, "gzip"},
+		{"br", gzipped, "br"},
+		{"gzip;q=0, *", gzipped, "gzip;q=0, *"},
+		{"gzip, br", plain, "identity"},
+		{"identity;q=0", plain, "identity;q=0"},
+		{"*;q=0", plain, "*;q=0"},
+	} {
+		c.Check(normalizeAcceptEncoding(test.value, test.resp), Equals,
+			test.expected, Commentf("Accept-Encoding: %s", test.value))
+	}
+
+	german := http.Header{}
+	german.Set("Content-Language", "de-DE")
+	for _, test := range []struct {
+		value    string
+		resp     http.Header
+		expected string
+	}{
+		{"de-DE,de;q=0.9,en;q=0.8", german, "de-de"},
+		{"de, en;q=0.5", german, "de-de"},
+		{"en;q=0.5, DE", german, "de-de"},
+		{"", german, "de-de"},
+		{"en, de;q=0.5", german, "en, de;q=0.5"},
+		{"de-AT", german, "de-AT"},
+		{"de", plain, "de"},
+	} {
+		c.Check(normalizeAcceptLanguage(test.value, test.resp), Equals,
+			test.expected, Commentf("Accept-Language: %s", test.value))
+	}
+
+	buckets := UserAgentBuckets{
+		{Name: "mobile", Patterns: []string{"Mobile", "Android"}},
+		{Name: "bot", Patterns: []string{"bot"}},
+	}
+	c.Check(buckets.Normalize("Mozilla/5.0 (Linux; Android 14)", nil), Equals, "mobile")
+	c.Check(buckets.Normalize("Googlebot/2.1", nil), Equals, "bot")
+	c.Check(buckets.Normalize("curl/8.0", nil), Equals, "curl/8.0")
+
+	// the normalizers are used to select variants
+	vary := DefaultVaryNormalizers()
+	vary["User-Agent"] = buckets
+	resp := http.Header{}
+	resp.Set("Vary", "Accept-Encoding, User-Agent")
+	resp.Set("Content-Encoding", "gzip")
+	orig := http.Header{}
+	orig.Set("Accept-Encoding", "gzip, deflate, br")
+	orig.Set("User-Agent", "Mozilla/5.0 (iPhone) Mobile/15E148")
+	req := http.Header{}
+	req.Set("Accept-Encoding", "br, gzip")
+	req.Set("User-Agent", "Mozilla/5.0 (Linux; Android 14)")
+	c.Check(vary.Match(resp, orig, req), Equals, true)
+	c.Check(DefaultVaryNormalizers().Match(resp, orig, req), Equals, false)
+	req.Set("User-Agent", "curl/8.0")
+	c.Check(vary.Match(resp, orig, req), Equals, false)
+
+	// each cache uses its own normalizers
+	mem := NewMemoryCache(1 << 20)
+	mem.VaryNormalizers = vary
+	meta := &MetaData{
+		StatusCode: 200,
+		Header:     resp,
+		VaryHeader: VaryHeader(resp, orig),
+	}
+	entry := mem.StoreStart("http://example.com/", meta)
+	n, err := io.Copy(ioutil.Discard, entry.Reader(strings.NewReader("hello")))
+	c.Assert(err, IsNil)
+	entry.Commit(n)
+	retrieve := func(cache Cache, ua string) []*Entry {
+		r, _ := http.NewRequest("GET", "http://example.com/", nil)
+		r.Header.Set("Accept-Encoding", "gzip")
+		r.Header.Set("User-Agent", ua)
+		return cache.Retrieve(r)
+	}
+	c.Check(retrieve(mem, "Mozilla/5.0 (Linux; Android 14)"), HasLen, 1)
+	c.Check(retrieve(mem, "curl/8.0"), HasLen, 0)
+	c.Check(retrieve(NewMemoryCache(1<<20), "Mozilla/5.0 (Linux; Android 14)"), HasLen, 0)
+}
+
+func (s *MySuite) TestVaryHeader(c *C) {
+	resp := http.Header{}
+	req := http.Header{}
+	req.Set("Accept-Encoding", "gzip")
+	c.Check(VaryHeader(resp, req), IsNil)
+
+	resp.Set("Vary", "accept-encoding, User-Agent")
+	c.Check(VaryHeader(resp, req), DeepEquals, http.Header{
+		"Accept-Encoding": {"gzip"},
+		"User-Agent":      {""},
+	})
+
+	// the recorded request header selects the variant
+	cache := NewMemoryCache(1000)
+	defer cache.Close()
+	resp.Set("Vary", "Accept-Encoding")
+	resp.Set("Content-Encoding", "gzip")
+	entry := cache.StoreStart("http://example.com/", &MetaData{
+		StatusCode: 200,
+		Header:     resp,
+		VaryHeader: VaryHeader(resp, req),
+	})
+	body := strings.NewReader("compressed")
+	n, _ := io.Copy(ioutil.Discard, entry.Reader(body))
+	entry.Commit(n)
+
+	r, _ := http.NewRequest("GET", "http://example.com/", nil)
+	r.Header.Set("Accept-Encoding", "gzip, deflate, br")
+	c.Check(cache.Retrieve(r), HasLen, 1)
+	r.Header.Set("Accept-Encoding", "identity")
+	c.Check(cache.Retrieve(r), HasLen, 0)
+}
@@ -0,0 +1,228 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/seehuhn/trace"
+	"github.com/syndtr/goleveldb/leveldb"
+	"golang.org/x/crypto/sha3"
+)
+
+const quarantineDirName = "quarantine"
+
+// ErrCorrupt is returned by the body readers of a LevelDB cache with
+// LevelDBOptions.VerifyReads set, if the stored content does not match
+// its hash.
+var ErrCorrupt = errors.New("cache: stored content is corrupt")
+
+// readSeekCloser is implemented by the readers for stored content.
+type readSeekCloser interface {
+	io.Reader
+	io.Seeker
+	io.Closer
+}
+
+// verifyingReader hashes stored content while it is read.  For
+// compressed content, `file` is the decompressing reader, so that the
+// hash is computed from the uncompressed bytes.  The last byte is only
+// returned once the hash has been checked, so that corrupt content is
+// never delivered completely.  Byte ranges are not checked: once the
+// reader is used to seek within the content, verification stops, since
+// checking a range would mean reading the whole content.
+type verifyingReader struct {
+	cache *ldbCache
+	file  readSeekCloser
+	name  string
+	hash  []byte
+	size  int64
+
+	h        sha3.ShakeHash
+	pos      int64 // the position in the file
+	verified bool
+	skipped  bool // set after seeking, when the content is not checked
+	err      error
+}
+
+func newVerifyingReader(cache *ldbCache, file readSeekCloser, name string, hash []byte, size int64) *verifyingReader {
+	return &verifyingReader{
+		cache: cache,
+		file:  file,
+		name:  name,
+		hash:  hash,
+		size:  size,
+		h:     sha3.NewShake128(),
+	}
+}
+
+func (r *verifyingReader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	if r.verified || r.skipped {
+		return r.file.Read(p)
+	}
+	if r.pos >= r.size {
+		// Only happens for empty files.
+		r.finish()
+		if r.err != nil {
+			return 0, r.err
+		}
+		return 0, io.EOF
+	}
+
+	// Hold back the last byte until the hash has been checked.
+	limit := r.size - r.pos - 1
+	if limit < 1 {
+		limit = 1
+	}
+	if int64(len(p)) > limit {
+		p = p[:limit]
+	}
+	n, err := r.file.Read(p)
+	r.h.Write(p[:n])
+	r.pos += int64(n)
+	if err == io.EOF && r.pos < r.size {
+		r.fail("short read")
+		return n, r.err
+	} else if err != nil && err != io.EOF {
+		// For compressed content, this includes errors found
+		// by the decompressor.
+		r.fail(err.Error())
+		return n, r.err
+	}
+	if r.pos == r.size {
+		r.finish()
+		if r.err != nil {
+			// Cut off the response, before the last byte.
+			return 0, r.err
+		}
+		return n, nil
+	}
+	return n, nil
+}
+
+// finish checks the hash, after the whole file has been read.  Extra
+// data at the end of the file also counts as a mismatch.
+func (r *verifyingReader) finish() {
+	var extra [1]byte
+	n, _ := r.file.Read(extra[:])
+	if n > 0 {
+		r.fail("file is too long")
+		return
+	}
+	sum := make([]byte, hashLen)
+	r.h.Read(sum)
+	if !bytes.Equal(sum, r.hash) {
+		r.fail("hash mismatch")
+		return
+	}
+	r.verified = true
+}
+
+func (r *verifyingReader) fail(reason string) {
+	r.err = ErrCorrupt
+	trace.T("jvproxy/cache", trace.PrioError,
+		"content %s is corrupt: %s", r.name, reason)
+	r.cache.reportCorrupt(r.hash)
+}
+
+// Seek implements the io.Seeker interface.  Seeking to a different
+// position stops the verification of the content.
+func (r *verifyingReader) Seek(offset int64, whence int) (int64, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	if !r.verified && !r.skipped {
+		var target int64
+		switch whence {
+		case io.SeekStart:
+			target = offset
+		case io.SeekCurrent:
+			target = r.pos + offset
+		case io.SeekEnd:
+			target = r.size + offset
+		}
+		if target == r.pos {
+			return r.pos, nil
+		}
+		r.skipped = true
+	}
+	return r.file.Seek(offset, whence)
+}
+
+func (r *verifyingReader) Close() error {
+	return r.file.Close()
+}
+
+// reportCorrupt counts an integrity error and asks the cache manager to
+// remove the content with the given hash.
+func (cache *ldbCache) reportCorrupt(hash []byte) {
+	cache.usageMutex.Lock()
+	cache.integrityErrors++
+	cache.usageMutex.Unlock()
+
+	select {
+	case cache.corrupt <- hash:
+	case <-cache.done:
+	}
+}
+
+// quarantine moves the content with the given hash into the quarantine
+// directory, and removes the corresponding index entry and all
+// metadata records which refer to it.  This must be called by the
+// cache manager.
+func (cache *ldbCache) quarantine(hash []byte) {
+	fname := cache.getStoreName(hash)
+	qName := filepath.Join(cache.baseDir, quarantineDirName, hex.EncodeToString(hash))
+	err := os.Rename(fname, qName)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			trace.T("jvproxy/cache", trace.PrioError,
+				"cannot move %s to quarantine: %s", fname, err.Error())
+		}
+		// Either the content is gone already, or we cannot
+		// move it: in both cases the records need to go.
+		os.Remove(fname)
+	} else {
+		trace.T("jvproxy/cache", trace.PrioInfo,
+			"moved corrupt content %s to %s", fname, qName)
+	}
+
+	data := cache.getIndexEntry(hash)
+	if data != nil {
+		cache.deleteIndexEntry(hash)
+		if !data.GetDropped() {
+			cache.usageMutex.Lock()
+			cache.totalBytes -= data.GetSize()
+			cache.totalEntries--
+			cache.usageMutex.Unlock()
+		}
+	}
+
+	cache.metaMutex.Lock()
+	defer cache.metaMutex.Unlock()
+	batch := new(leveldb.Batch)
+	iter := cache.meta.NewIterator(nil, nil)
+	for iter.Next() {
+		if bytes.Equal(metaRecordHash(iter.Value()), hash) {
+			batch.Delete(append([]byte{}, iter.Key()...))
+		}
+	}
+	iter.Release()
+	err = iter.Error()
+	if err == nil {
+		err = cache.meta.Write(batch, nil)
+	}
+	if err != nil {
+		trace.T("jvproxy/cache", trace.PrioError,
+			"cannot remove metadata for corrupt content: %s", err.Error())
+		return
+	}
+	trace.T("jvproxy/cache", trace.PrioInfo,
+		"removed %d metadata records for corrupt content", batch.Len())
+}
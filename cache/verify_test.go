@@ -0,0 +1,101 @@
+package cache
+
+import (
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *MySuite) TestVerifyReads(c *C) {
+	tempDir, err := ioutil.TempDir("", "jvproxy-test")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(tempDir)
+
+	store, err := NewLevelDBCache(tempDir, &LevelDBOptions{VerifyReads: true})
+	c.Assert(err, IsNil)
+	defer store.Close()
+	cache := store.(*ldbCache)
+
+	retrieve := func(name string) []*Entry {
+		req, _ := http.NewRequest("GET", "http://example.com/"+name, nil)
+		return store.Retrieve(req)
+	}
+	bodies := map[string]string{
+		"good":   "some good content",
+		"bad":    "some bad content",
+		"seek":   "more bad content",
+		"short":  "truncated content",
+		"single": "x",
+	}
+	for name, body := range bodies {
+		storeString(c, store, "http://example.com/"+name, http.Header{}, body)
+	}
+	waitForUsage(c, cache, func(u LevelDBUsage) bool {
+		return u.Entries == int64(len(bodies))
+	})
+	ids := map[string][]byte{}
+	for name := range bodies {
+		entries := retrieve(name)
+		c.Assert(entries, HasLen, 1)
+		ids[name] = entries[0].CacheID
+	}
+
+	// intact content can be read and seeked
+	c.Check(readBody(c, retrieve("good")[0]), Equals, bodies["good"])
+	c.Check(readBody(c, retrieve("single")[0]), Equals, bodies["single"])
+	body := retrieve("good")[0].GetBody()
+	seeker, ok := body.(io.ReadSeeker)
+	c.Assert(ok, Equals, true)
+	_, err = seeker.Seek(5, io.SeekStart)
+	c.Assert(err, IsNil)
+	rest, err := ioutil.ReadAll(seeker)
+	c.Assert(err, IsNil)
+	c.Check(string(rest), Equals, "good content")
+	body.Close()
+
+	// damage the other files
+	for _, name := range []string{"bad", "seek"} {
+		fname := cache.getStoreName(ids[name])
+		err = ioutil.WriteFile(fname, []byte("Some bad content"[:len(bodies[name])]), 0644)
+		c.Assert(err, IsNil)
+	}
+	err = os.Truncate(cache.getStoreName(ids["short"]), 5)
+	c.Assert(err, IsNil)
+
+	for _, name := range []string{"bad", "short"} {
+		body = retrieve(name)[0].GetBody()
+		data, err := ioutil.ReadAll(body)
+		body.Close()
+		c.Check(err, Equals, ErrCorrupt)
+		c.Check(len(data) < len(bodies[name]), Equals, true)
+	}
+
+	// byte ranges are not checked
+	body = retrieve("seek")[0].GetBody()
+	_, err = body.(io.Seeker).Seek(0, io.SeekEnd)
+	c.Check(err, IsNil)
+	_, err = body.(io.Seeker).Seek(5, io.SeekStart)
+	c.Check(err, IsNil)
+	rest, err = ioutil.ReadAll(body)
+	body.Close()
+	c.Check(err, IsNil)
+	c.Check(string(rest), Equals, "bad content")
+
+	waitForUsage(c, cache, func(u LevelDBUsage) bool {
+		return u.Entries == 3
+	})
+	c.Check(cache.Usage().IntegrityErrors, Equals, int64(2))
+	for _, name := range []string{"bad", "short"} {
+		c.Check(retrieve(name), HasLen, 0)
+		qName := filepath.Join(tempDir, quarantineDirName, hex.EncodeToString(ids[name]))
+		_, err = os.Stat(qName)
+		c.Check(err, IsNil)
+	}
+	c.Check(retrieve("good"), HasLen, 1)
+	c.Check(retrieve("seek"), HasLen, 1)
+}
@@ -0,0 +1,34 @@
+// cachecheck verifies the consistency of a jvproxy disk cache and
+// optionally repairs it.  The proxy must not be running while the
+// check is performed.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/seehuhn/jvproxy/cache"
+)
+
+var repairFlag = flag.Bool("repair", false,
+	"remove broken data and rebuild the index")
+
+func main() {
+	flag.Parse()
+
+	baseDir := flag.Arg(0)
+	if baseDir == "" {
+		baseDir = "cache-root"
+	}
+	fmt.Println("checking cache at", baseDir)
+	report, err := cache.Check(baseDir, *repairFlag)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cannot check cache: %s\n", err.Error())
+		os.Exit(2)
+	}
+	fmt.Print(report)
+	if !report.OK() && !report.Repaired {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,152 @@
+package jvproxy
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/seehuhn/jvproxy/cache"
+	"github.com/seehuhn/trace"
+)
+
+// KeyNormalizer computes cache keys in a normalized form, so that
+// requests for equivalent URLs share cache entries.  The scheme and
+// host name are converted to lower case and default ports are
+// removed.  The Key method can be used as Proxy.KeyFunc.
+type KeyNormalizer struct {
+	// SortQuery, if set, sorts the query parameters by name.
+	// Parameters with the same name keep their relative order.
+	SortQuery bool
+
+	// StripParams lists query parameters which are removed from the
+	// key.  Entries are patterns in the syntax of path.Match, for
+	// example "utm_*".
+	StripParams []string
+
+	// IgnoreQuery lists host names for which the query string is
+	// removed from the key entirely.  Host names also match all
+	// subdomains.
+	IgnoreQuery []string
+}
+
+var defaultPorts = map[string]string{
+	"http":  "80",
+	"https": "443",
+}
+
+// Key returns the normalized cache key for `req`.
+func (n *KeyNormalizer) Key(req *http.Request) string {
+	u := *req.URL
+	u.Scheme = strings.ToLower(u.Scheme)
+	u.Host = strings.ToLower(u.Host)
+	u.Fragment = ""
+	u.RawFragment = ""
+
+	host, port, err := net.SplitHostPort(u.Host)
+	if err == nil && (port == "" || port == defaultPorts[u.Scheme]) {
+		if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		u.Host = host
+	}
+
+	if n.ignoreQuery(u.Hostname()) {
+		u.RawQuery = ""
+		u.ForceQuery = false
+	} else if n.SortQuery || len(n.StripParams) > 0 {
+		u.RawQuery = n.normalizeQuery(u.RawQuery)
+	}
+	return u.String()
+}
+
+func (n *KeyNormalizer) ignoreQuery(host string) bool {
+	for _, name := range n.IgnoreQuery {
+		name = strings.ToLower(name)
+		if host == name || strings.HasSuffix(host, "."+name) {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeQuery removes the parameters listed in n.StripParams from
+// the query string `query`, and sorts the remaining parameters if
+// requested.  The encoding of the parameters is not changed.
+func (n *KeyNormalizer) normalizeQuery(query string) string {
+	type param struct {
+		name, raw string
+	}
+	var params []param
+	for _, raw := range strings.Split(query, "&") {
+		if raw == "" {
+			continue
+		}
+		name := raw
+		if pos := strings.IndexByte(name, '='); pos >= 0 {
+			name = name[:pos]
+		}
+		if unescaped, err := url.QueryUnescape(name); err == nil {
+			name = unescaped
+		}
+		if n.strip(name) {
+			continue
+		}
+		params = append(params, param{name, raw})
+	}
+	if n.SortQuery {
+		sort.SliceStable(params, func(i, j int) bool {
+			return params[i].name < params[j].name
+		})
+	}
+	parts := make([]string, len(params))
+	for i, p := range params {
+		parts[i] = p.raw
+	}
+	return strings.Join(parts, "&")
+}
+
+func (n *KeyNormalizer) strip(name string) bool {
+	for _, pattern := range n.StripParams {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// cacheURL returns the URL under which responses to `req` are stored
+// in the cache.  If KeyFunc is set but does not return an absolute
+// URL, the request URL is used.
+func (proxy *Proxy) cacheURL(req *http.Request) *url.URL {
+	if proxy.KeyFunc == nil {
+		return req.URL
+	}
+	key := proxy.KeyFunc(req)
+	u, err := url.Parse(key)
+	if err != nil || !u.IsAbs() {
+		trace.T("jvproxy/handler", trace.PrioError,
+			"invalid cache key %q for %s", key, req.URL)
+		return req.URL
+	}
+	return u
+}
+
+// CacheKey returns the key under which responses to `req` are stored
+// in the cache.
+func (proxy *Proxy) CacheKey(req *http.Request) string {
+	return proxy.cacheURL(req).String()
+}
+
+// retrieve returns the cache entries stored for the key of `req`.
+func (proxy *Proxy) retrieve(req *http.Request) []*cache.Entry {
+	u := proxy.cacheURL(req)
+	if u != req.URL {
+		r := *req
+		r.URL = u
+		req = &r
+	}
+	return proxy.cache.Retrieve(req)
+}
@@ -0,0 +1,93 @@
+package jvproxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"github.com/seehuhn/jvproxy/cache"
+	. "gopkg.in/check.v1"
+)
+
+func (s *MySuite) TestKeyNormalizer(c *C) {
+	n := &KeyNormalizer{
+		SortQuery:   true,
+		StripParams: []string{"utm_*", "fbclid"},
+		IgnoreQuery: []string{"static.example.com"},
+	}
+	cases := []struct {
+		url, key string
+	}{
+		{"HTTP://Example.COM:80/Path", "http://example.com/Path"},
+		{"https://example.com:443/", "https://example.com/"},
+		{"https://example.com:80/", "https://example.com:80/"},
+		{"http://example.com:/", "http://example.com/"},
+		{"http://[::1]:80/", "http://[::1]/"},
+		{"http://example.com/?b=2&a=1&b=1", "http://example.com/?a=1&b=2&b=1"},
+		{"http://example.com/?utm_source=x&q=go&fbclid=y", "http://example.com/?q=go"},
+		{"http://example.com/?utm_source=x", "http://example.com/"},
+		{"http://example.com/?q=a%20b&&p", "http://example.com/?p&q=a%20b"},
+		{"http://static.example.com/x.css?v=3", "http://static.example.com/x.css"},
+		{"http://cdn.static.example.com/x.css?v=3", "http://cdn.static.example.com/x.css"},
+		{"http://example.com/x.css?v=3", "http://example.com/x.css?v=3"},
+	}
+	for _, test := range cases {
+		req, err := http.NewRequest("GET", test.url, nil)
+		c.Assert(err, IsNil)
+		c.Check(n.Key(req), Equals, test.key, Commentf("URL %s", test.url))
+	}
+
+	// without SortQuery, the order of parameters is kept
+	n = &KeyNormalizer{}
+	req, _ := http.NewRequest("GET", "http://example.com/?b=2&a=1&&c", nil)
+	c.Check(n.Key(req), Equals, "http://example.com/?b=2&a=1&&c")
+}
+
+func (s *MySuite) TestKeyFunc(c *C) {
+	var count int
+	upstream := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		count++
+		h := http.Header{}
+		h.Set("Cache-Control", "max-age=3600")
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Proto:      "HTTP/1.1",
+			Header:     h,
+			Body:       ioutil.NopCloser(strings.NewReader("hello")),
+			Request:    req,
+		}, nil
+	})
+	proxy := NewProxy("test", upstream, cache.NewMemoryCache(1<<20), true)
+	defer proxy.Close()
+	proxy.KeyFunc = (&KeyNormalizer{
+		SortQuery:   true,
+		StripParams: []string{"utm_*"},
+	}).Key
+
+	for _, url := range []string{
+		"http://example.com/?a=1&b=2",
+		"http://EXAMPLE.com:80/?b=2&a=1",
+		"http://example.com/?a=1&utm_medium=email&b=2",
+	} {
+		req, _ := http.NewRequest("GET", url, nil)
+		c.Check(proxy.CacheKey(req), Equals, "http://example.com/?a=1&b=2")
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, req)
+		c.Check(w.Body.String(), Equals, "hello")
+	}
+	c.Check(count, Equals, 1)
+
+	// unsafe requests invalidate the normalized key
+	rec := &invalidationRecorder{}
+	proxy2 := NewProxy("test", staticUpstream(http.StatusOK, ""), rec, true)
+	defer proxy2.Close()
+	proxy2.KeyFunc = proxy.KeyFunc
+	req, _ := http.NewRequest("POST", "http://Example.com/?b=2&a=1", nil)
+	proxy2.ServeHTTP(httptest.NewRecorder(), req)
+	c.Check(rec.urls, DeepEquals, []string{"http://example.com/?a=1&b=2"})
+
+	// invalid keys fall back to the request URL
+	proxy.KeyFunc = func(*http.Request) string { return "not a URL" }
+	c.Check(proxy.CacheKey(req), Equals, "http://Example.com/?b=2&a=1")
+}
@@ -0,0 +1,277 @@
+package jvproxy
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/seehuhn/jvproxy/cache"
+)
+
+// maxFlightBuffer is the size (in bytes) of the largest response body
+// which is kept in memory for sharing with followers.  This is only
+// used if the cache cannot provide the body while it is being stored.
+const maxFlightBuffer = 1 << 20
+
+// A flight represents an upstream request which is in progress on
+// behalf of one client (the "leader"), and whose response can be
+// shared with other clients requesting the same URL at the same time
+// (the "followers").  Once the response is known to be shareable, the
+// body is read from upstream and stored in the cache independently of
+// the clients.  The clients either follow the body as it is written
+// to the cache, or, if the cache does not support this, read it from
+// an in-memory copy.
+type flight struct {
+	ready     chan struct{}
+	resp      *cache.Entry
+	reqHeader http.Header
+	canStore  bool
+	once      sync.Once
+
+	// follow, if set, opens a reader for the body as it is stored in
+	// the cache.  Otherwise the body is kept in .data.
+	follow func() io.ReadCloser
+
+	mutex sync.Mutex
+	cond  *sync.Cond
+	data  []byte
+	done  bool
+	err   error
+}
+
+func newFlight() *flight {
+	f := &flight{
+		ready: make(chan struct{}),
+	}
+	f.cond = sync.NewCond(&f.mutex)
+	return f
+}
+
+// publish makes the response metadata available to the followers.
+// `reqHeader` are the request headers of the leader, for use in
+// checking the Vary header field of the response.
+func (f *flight) publish(resp *cache.Entry, reqHeader http.Header, canStore bool) {
+	f.once.Do(func() {
+		f.resp = resp
+		f.reqHeader = reqHeader
+		f.canStore = canStore
+		close(f.ready)
+	})
+}
+
+// Write appends data to the in-memory copy of the response body.
+func (f *flight) Write(p []byte) (int, error) {
+	f.mutex.Lock()
+	f.data = append(f.data, p...)
+	f.cond.Broadcast()
+	f.mutex.Unlock()
+	return len(p), nil
+}
+
+// finish signals that the response body has been read completely.  If
+// reading the body from upstream failed, `err` gives the error and
+// readers of the in-memory copy see this error instead of io.EOF.
+func (f *flight) finish(err error) {
+	f.publish(nil, nil, false)
+
+	f.mutex.Lock()
+	f.done = true
+	f.err = err
+	f.cond.Broadcast()
+	f.mutex.Unlock()
+}
+
+// usableFor checks whether the response obtained by the leader can
+// also be used for `req`.  This is only the case if the response can
+// be stored in the cache, and if the response would be selected for
+// `req` according to the Vary header field, normalized using `vary`.
+// This method blocks until the response metadata is available.
+func (f *flight) usableFor(req *http.Request, vary cache.VaryNormalizers) bool {
+	<-f.ready
+	return f.resp != nil && f.canStore &&
+		vary.Match(f.resp.Header, f.reqHeader, req.Header)
+}
+
+// open returns a reader for the response body.  If the body can no
+// longer be read, nil is returned.
+func (f *flight) open() io.ReadCloser {
+	if f.follow != nil {
+		return f.follow()
+	}
+	return &flightReader{f: f}
+}
+
+// entry returns a copy of the leader's response, for use by a
+// follower.  The returned body reader blocks until more data is
+// received from upstream.  If the body can no longer be read, nil is
+// returned.
+func (f *flight) entry() *cache.Entry {
+	body := f.open()
+	if body == nil {
+		return nil
+	}
+	res := &cache.Entry{
+		MetaData: f.resp.MetaData,
+		GetBody: func() io.ReadCloser {
+			return body
+		},
+		Source: "coalesced",
+	}
+	res.Header = make(http.Header)
+	copyHeader(res.Header, f.resp.Header)
+	return res
+}
+
+type flightReader struct {
+	f   *flight
+	pos int
+}
+
+func (r *flightReader) Read(p []byte) (int, error) {
+	f := r.f
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for r.pos >= len(f.data) && !f.done {
+		f.cond.Wait()
+	}
+	if r.pos < len(f.data) {
+		n := copy(p, f.data[r.pos:])
+		r.pos += n
+		return n, nil
+	}
+	if f.err != nil {
+		return 0, f.err
+	}
+	return 0, io.EOF
+}
+
+func (r *flightReader) Close() error {
+	return nil
+}
+
+// A flightGroup keeps track of the upstream requests in progress, so
+// that concurrent cache misses for the same URL can be collapsed into
+// one upstream request.
+type flightGroup struct {
+	mutex   sync.Mutex
+	flights map[string]*flight
+
+	// wait keeps track of the goroutines which store shared
+	// responses in the cache.
+	wait sync.WaitGroup
+
+	// joined, if set, is called whenever a client joins a flight
+	// which is already in progress.  This is used by the tests, and
+	// must not block.
+	joined func(key string)
+}
+
+// join returns the flight for `key`.  If no flight is in progress, a
+// new one is started and the caller becomes the leader.
+func (g *flightGroup) join(key string) (f *flight, isLeader bool) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if g.flights == nil {
+		g.flights = make(map[string]*flight)
+	}
+	f, ok := g.flights[key]
+	if ok {
+		if g.joined != nil {
+			g.joined(key)
+		}
+		return f, false
+	}
+	f = newFlight()
+	g.flights[key] = f
+	return f, true
+}
+
+// remove stops new clients from joining the flight `f`.
+func (g *flightGroup) remove(key string, f *flight) {
+	g.mutex.Lock()
+	if g.flights[key] == f {
+		delete(g.flights, key)
+	}
+	g.mutex.Unlock()
+}
+
+// fetch forwards `req` to the upstream server, after a cache miss.
+// Concurrent GET requests for the same URL are collapsed into one
+// upstream request.  If the caller becomes the leader for such a
+// request, the corresponding flight is returned as the second return
+// value; the caller must then either pass the response to .share(), or
+// call .publish() and .finish() on the flight and remove it from
+// proxy.flights.
+func (proxy *Proxy) fetch(req *http.Request, cacheInfo *decision, log *LogEntry) (*cache.Entry, *flight) {
+	if req.Method != "GET" || !cacheInfo.canStore || cacheInfo.hasAuthorization ||
+		req.Header.Get("Range") != "" {
+		log.CacheResult += "MISS"
+		return proxy.requestFromUpstream(req, nil), nil
+	}
+
+	f, isLeader := proxy.flights.join(log.CacheKey)
+	if isLeader {
+		log.CacheResult += "MISS"
+		return proxy.requestFromUpstream(req, nil), f
+	}
+
+	if f.usableFor(req, proxy.VaryNormalizers) {
+		if res := f.entry(); res != nil {
+			log.CacheResult += "COALESCED"
+			cacheInfo.canStore = false
+			return res, nil
+		}
+	}
+	log.CacheResult += "MISS"
+	log.Comments = append(log.Comments, "coalesce:unusable")
+	return proxy.requestFromUpstream(req, nil), nil
+}
+
+// share makes the response `resp`, obtained by the leader of flight
+// `f`, available to the followers.  The response body is copied from
+// upstream into the cache entry `entry` by a separate goroutine, so
+// that the clients cannot slow down or interrupt the transfer.  The
+// return value is the body reader for the leader's client.  If the
+// response cannot be shared, nil is returned and the caller remains
+// responsible for `entry` and `f`.
+func (proxy *Proxy) share(f *flight, req *http.Request, resp *cache.Entry, entry cache.StoreCont, key string) io.ReadCloser {
+	var body io.ReadCloser
+	if follower, ok := entry.(cache.StoreFollower); ok {
+		// This reader is opened before any data is stored, so it
+		// cannot miss the temporary file.
+		body = follower.Follow()
+		if body != nil {
+			f.follow = follower.Follow
+		}
+	}
+	var dst io.Writer = ioutil.Discard
+	if body == nil {
+		size, err := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
+		if err != nil || size > maxFlightBuffer {
+			return nil
+		}
+		body = &flightReader{f: f}
+		dst = f
+	}
+	f.publish(resp, req.Header, true)
+
+	upstream := resp.GetBody()
+	proxy.flights.wait.Add(1)
+	go func() {
+		defer proxy.flights.wait.Done()
+		n, err := io.Copy(dst, entry.Reader(upstream))
+		upstream.Close()
+		if err != nil {
+			entry.Discard()
+		} else {
+			entry.Commit(n)
+		}
+		// Once the response is committed, new requests for the URL
+		// will be served from the cache.
+		proxy.flights.remove(key, f)
+		f.finish(err)
+	}()
+	return body
+}
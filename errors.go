@@ -0,0 +1,283 @@
+package jvproxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/seehuhn/jvproxy/cache"
+	"github.com/seehuhn/trace"
+)
+
+// ErrorKind classifies the ways in which a request to an upstream
+// server can fail.
+type ErrorKind int
+
+// These are the possible values for ErrorKind.
+const (
+	ErrOther ErrorKind = iota
+	ErrDNS
+	ErrConnectionRefused
+	ErrTLS
+	ErrTimeout
+	ErrMalformed
+	ErrNotCached
+)
+
+var errorKindNames = map[ErrorKind]string{
+	ErrOther:             "upstream-error",
+	ErrDNS:               "dns-failure",
+	ErrConnectionRefused: "connection-refused",
+	ErrTLS:               "tls-failure",
+	ErrTimeout:           "timeout",
+	ErrMalformed:         "malformed-response",
+	ErrNotCached:         "not-cached",
+}
+
+var errorKindDescriptions = map[ErrorKind]string{
+	ErrOther:             "The upstream server could not be reached.",
+	ErrDNS:               "The name of the upstream server could not be resolved.",
+	ErrConnectionRefused: "The upstream server refused the connection.",
+	ErrTLS:               "The secure connection to the upstream server failed.",
+	ErrTimeout:           "The upstream server did not respond in time.",
+	ErrMalformed:         "The upstream server sent an invalid response.",
+	ErrNotCached:         "The response is not available from the cache.",
+}
+
+func (kind ErrorKind) String() string {
+	return errorKindNames[kind]
+}
+
+// A GatewayError describes a failed attempt to forward a request to
+// the upstream server.
+type GatewayError struct {
+	Kind ErrorKind
+	ID   string
+	URL  string
+	Err  error
+
+	// MustRevalidate is set if a stale cached response was
+	// available, but could not be used because of a must-revalidate
+	// or proxy-revalidate directive.
+	MustRevalidate bool
+}
+
+func newGatewayError(url string, err error) *GatewayError {
+	return &GatewayError{
+		Kind: classifyError(err),
+		ID:   newErrorID(),
+		URL:  url,
+		Err:  err,
+	}
+}
+
+// newNotCachedError returns the error used to answer a request with
+// the only-if-cached directive, when no suitable cached response is
+// available (RFC 7234, section 5.2.1.7).
+func newNotCachedError(url string) *GatewayError {
+	return &GatewayError{
+		Kind: ErrNotCached,
+		ID:   newErrorID(),
+		URL:  url,
+		Err:  errors.New("only-if-cached: no suitable cached response"),
+	}
+}
+
+func (e *GatewayError) Error() string {
+	return e.Kind.String() + " (" + e.ID + "): " + e.Err.Error()
+}
+
+// StatusCode returns the HTTP status code used to report the error to
+// the client: 504 (Gateway Timeout) for timeouts, only-if-cached
+// misses and failed revalidation of must-revalidate responses, and 502
+// (Bad Gateway) for all other errors.
+func (e *GatewayError) StatusCode() int {
+	if e.Kind == ErrTimeout || e.Kind == ErrNotCached || e.MustRevalidate {
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
+
+func classifyError(err error) ErrorKind {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		if dnsErr.IsTimeout {
+			return ErrTimeout
+		}
+		return ErrDNS
+	}
+
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return ErrConnectionRefused
+	}
+
+	var recordErr tls.RecordHeaderError
+	var verifyErr *tls.CertificateVerificationError
+	var authorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+	if errors.As(err, &recordErr) || errors.As(err, &verifyErr) ||
+		errors.As(err, &authorityErr) || errors.As(err, &hostnameErr) ||
+		errors.As(err, &invalidErr) ||
+		strings.Contains(err.Error(), "tls: ") {
+		return ErrTLS
+	}
+
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) ||
+		(errors.As(err, &netErr) && netErr.Timeout()) {
+		return ErrTimeout
+	}
+
+	// The errors for malformed responses in net/http are not
+	// exported, so we have to look at the error message here.
+	if strings.Contains(err.Error(), "malformed") {
+		return ErrMalformed
+	}
+
+	return ErrOther
+}
+
+func newErrorID() string {
+	buf := make([]byte, 6)
+	_, err := io.ReadFull(rand.Reader, buf)
+	if err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(buf)
+}
+
+// errorIDHeader is the response header field used to report the error
+// ID of a GatewayError to the client.
+const errorIDHeader = "X-Jvproxy-Error-Id"
+
+type errorPage struct {
+	Status      int    `json:"status"`
+	StatusText  string `json:"statusText"`
+	Kind        string `json:"error"`
+	Description string `json:"description"`
+	Message     string `json:"message"`
+	URL         string `json:"url"`
+	ID          string `json:"id"`
+}
+
+var defaultErrorTmpl = template.Must(template.New("error.html").Parse(
+	`<!DOCTYPE html>
+<html>
+<head><title>{{.Status}} {{.StatusText}}</title></head>
+<body>
+<h1>{{.Status}} {{.StatusText}}</h1>
+<p>{{.Description}}
+<p>URL: {{.URL}}<br>
+Error: {{.Kind}}<br>
+Error ID: {{.ID}}
+</body>
+</html>
+`))
+
+// errorResponse generates the response sent to the client after the
+// upstream request for `req` failed.  Depending on the Accept header
+// of the request, the response body is either a HTML page (rendered
+// using proxy.ErrorTmpl) or a JSON object.
+func (proxy *Proxy) errorResponse(req *http.Request, gwErr *GatewayError) *cache.Entry {
+	code := gwErr.StatusCode()
+	data := &errorPage{
+		Status:      code,
+		StatusText:  http.StatusText(code),
+		Kind:        gwErr.Kind.String(),
+		Description: errorKindDescriptions[gwErr.Kind],
+		Message:     gwErr.Err.Error(),
+		URL:         gwErr.URL,
+		ID:          gwErr.ID,
+	}
+
+	h := http.Header{}
+	buf := &bytes.Buffer{}
+	if prefersJSON(req.Header.Get("Accept")) {
+		h.Set("Content-Type", "application/json")
+		err := json.NewEncoder(buf).Encode(data)
+		if err != nil {
+			panic(err)
+		}
+	} else {
+		h.Set("Content-Type", "text/html; charset=utf-8")
+		tmpl := proxy.ErrorTmpl
+		if tmpl == nil {
+			tmpl = defaultErrorTmpl
+		}
+		err := tmpl.Execute(buf, data)
+		if err != nil {
+			trace.T("jvproxy/handler", trace.PrioError,
+				"rendering error page failed: %s", err.Error())
+			buf.Reset()
+			buf.WriteString(gwErr.Error())
+			h.Set("Content-Type", "text/plain")
+		}
+	}
+	h.Set("Cache-Control", "no-store")
+	h.Set(errorIDHeader, gwErr.ID)
+	body := buf.Bytes()
+	h.Set("Content-Length", strconv.Itoa(len(body)))
+
+	return &cache.Entry{
+		MetaData: cache.MetaData{
+			StatusCode: code,
+			Header:     h,
+		},
+		Source: "error",
+		GetBody: func() io.ReadCloser {
+			return ioutil.NopCloser(bytes.NewReader(body))
+		},
+	}
+}
+
+// prefersJSON checks whether the Accept header `accept` ranks
+// application/json higher than text/html.
+func prefersJSON(accept string) bool {
+	var qJSON, qHTML float64
+	for _, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+		mediaRange := strings.ToLower(strings.TrimSpace(params[0]))
+		q := 1.0
+		for _, param := range params[1:] {
+			kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+			if len(kv) == 2 && strings.TrimSpace(kv[0]) == "q" {
+				val, err := strconv.ParseFloat(strings.TrimSpace(kv[1]), 64)
+				if err == nil {
+					q = val
+				}
+			}
+		}
+		switch mediaRange {
+		case "application/json", "application/*":
+			if q > qJSON {
+				qJSON = q
+			}
+		case "text/html", "text/*":
+			if q > qHTML {
+				qHTML = q
+			}
+		case "*/*":
+			if q > qJSON {
+				qJSON = q
+			}
+			if q > qHTML {
+				qHTML = q
+			}
+		}
+	}
+	return qJSON > qHTML
+}
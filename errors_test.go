@@ -0,0 +1,73 @@
+package jvproxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"syscall"
+
+	"github.com/seehuhn/jvproxy/cache"
+	. "gopkg.in/check.v1"
+)
+
+func (s *MySuite) TestClassifyError(c *C) {
+	dnsErr := &net.DNSError{Err: "no such host", Name: "example.invalid"}
+	c.Assert(classifyError(dnsErr), Equals, ErrDNS)
+
+	refused := &net.OpError{
+		Op:  "dial",
+		Net: "tcp",
+		Err: os.NewSyscallError("connect", syscall.ECONNREFUSED),
+	}
+	c.Assert(classifyError(refused), Equals, ErrConnectionRefused)
+
+	c.Assert(classifyError(context.DeadlineExceeded), Equals, ErrTimeout)
+	c.Assert(classifyError(errors.New("net/http: HTTP/1.x transport connection broken: malformed HTTP status code \"x\"")),
+		Equals, ErrMalformed)
+	c.Assert(classifyError(errors.New("remote error: tls: handshake failure")),
+		Equals, ErrTLS)
+	c.Assert(classifyError(errors.New("something else")), Equals, ErrOther)
+}
+
+func (s *MySuite) TestPrefersJSON(c *C) {
+	c.Assert(prefersJSON(""), Equals, false)
+	c.Assert(prefersJSON("text/html,application/xhtml+xml,*/*;q=0.8"), Equals, false)
+	c.Assert(prefersJSON("application/json"), Equals, true)
+	c.Assert(prefersJSON("application/json, */*;q=0.1"), Equals, true)
+	c.Assert(prefersJSON("text/html;q=0.5, application/json;q=0.9"), Equals, true)
+	c.Assert(prefersJSON("*/*"), Equals, false)
+}
+
+func (s *MySuite) TestErrorResponse(c *C) {
+	timeout := roundTripFunc(func(*http.Request) (*http.Response, error) {
+		return nil, context.DeadlineExceeded
+	})
+	proxy := NewProxy("test", timeout, &cache.NullCache{}, true)
+	defer proxy.Close()
+
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	res := proxy.requestFromUpstream(req, nil)
+	c.Assert(res.StatusCode, Equals, http.StatusGatewayTimeout)
+	c.Assert(res.Source, Equals, "error")
+	id := res.Header.Get(errorIDHeader)
+	c.Assert(id, Not(Equals), "")
+	body, _ := ioutil.ReadAll(res.GetBody())
+	c.Assert(strings.Contains(string(body), id), Equals, true)
+	c.Assert(strings.HasPrefix(res.Header.Get("Content-Type"), "text/html"), Equals, true)
+
+	proxy.upstream = failingUpstream
+	req.Header.Set("Accept", "application/json")
+	res = proxy.requestFromUpstream(req, nil)
+	c.Assert(res.StatusCode, Equals, http.StatusBadGateway)
+	c.Assert(res.Header.Get("Content-Type"), Equals, "application/json")
+	data := &errorPage{}
+	err := json.NewDecoder(res.GetBody()).Decode(data)
+	c.Assert(err, IsNil)
+	c.Assert(data.ID, Equals, res.Header.Get(errorIDHeader))
+	c.Assert(data.Kind, Equals, "upstream-error")
+}
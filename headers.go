@@ -18,9 +18,12 @@ package jvproxy
 
 import (
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/seehuhn/httputil"
+	"github.com/seehuhn/jvproxy/cache"
 )
 
 func parseHeaders(headers []string) (map[string]string, error) {
@@ -36,6 +39,97 @@ func parseHeaders(headers []string) (map[string]string, error) {
 	return res, err
 }
 
+// acceptsEncoding checks whether the Accept-Encoding header fields in
+// `header` allow the given content-coding (RFC 7231, section 5.3.4).
+func acceptsEncoding(header http.Header, coding string) bool {
+	q, star := -1.0, -1.0
+	for _, field := range header["Accept-Encoding"] {
+		for _, item := range strings.Split(field, ",") {
+			params := strings.Split(item, ";")
+			name := strings.ToLower(strings.TrimSpace(params[0]))
+			weight := 1.0
+			for _, param := range params[1:] {
+				param = strings.TrimSpace(param)
+				if len(param) > 2 && strings.EqualFold(param[:2], "q=") {
+					if w, err := strconv.ParseFloat(param[2:], 64); err == nil {
+						weight = w
+					}
+				}
+			}
+			switch name {
+			case coding:
+				q = weight
+			case "*":
+				star = weight
+			}
+		}
+	}
+	if q < 0 {
+		q = star
+	}
+	return q > 0
+}
+
+// addVary adds `name` to the Vary header field in `header`, unless it
+// is already listed.
+func addVary(header http.Header, name string) {
+	for _, field := range header["Vary"] {
+		for _, item := range strings.Split(field, ",") {
+			item = strings.TrimSpace(item)
+			if item == "*" || strings.EqualFold(item, name) {
+				return
+			}
+		}
+	}
+	header.Add("Vary", name)
+}
+
+// encodedETagInfix separates the entity tag of the identity
+// representation from the content-coding, in the entity tags of
+// compressed representations sent by the proxy.
+const encodedETagInfix = "-jv-"
+
+// encodedETag derives the entity tag of the representation with
+// content-coding `coding` applied from the entity tag `etag` of the
+// identity representation.  Different representations must not share
+// a strong validator (RFC 7232, section 2.3.3).  If `etag` is
+// malformed, the empty string is returned.
+func encodedETag(etag, coding string) string {
+	if len(etag) < 2 || !strings.HasSuffix(etag, "\"") {
+		return ""
+	}
+	return etag[:len(etag)-1] + encodedETagInfix + coding + "\""
+}
+
+// decodeETags replaces the entity tags created by encodedETag in the
+// header field values `values` by the original entity tags, for use in
+// requests to the upstream server.  The second return value indicates
+// whether any entity tags were replaced.  `values` is not modified.
+func decodeETags(values []string) ([]string, bool) {
+	changed := false
+	res := make([]string, len(values))
+	for i, field := range values {
+		items := strings.Split(field, ",")
+		for j, item := range items {
+			tag := strings.TrimSpace(item)
+			items[j] = tag
+			pos := strings.LastIndex(tag, encodedETagInfix)
+			if pos < 0 || !strings.HasSuffix(tag, "\"") {
+				continue
+			}
+			coding := tag[pos+len(encodedETagInfix) : len(tag)-1]
+			for _, known := range cache.Codecs() {
+				if coding == known {
+					items[j] = tag[:pos] + "\""
+					changed = true
+				}
+			}
+		}
+		res[i] = strings.Join(items, ", ")
+	}
+	return res, changed
+}
+
 func copyHeader(dst, src http.Header) {
 	for k, vv := range src {
 		for _, v := range vv {
@@ -43,3 +137,90 @@ func copyHeader(dst, src http.Header) {
 		}
 	}
 }
+
+// addWarning appends a Warning header field with the given warn-code
+// and warn-text to `header`, see RFC 7234, section 5.5.
+func (proxy *Proxy) addWarning(header http.Header, code int, text string) {
+	agent := proxy.Name
+	if agent == "" {
+		agent = "jvproxy"
+	}
+	header.Add("Warning", strconv.Itoa(code)+" "+agent+" \""+text+"\"")
+}
+
+// dropTransientWarnings removes all Warning header fields with
+// warn-code 1xx from `header`.  These warnings describe the freshness
+// or validation status of a response, and must not be kept in stored
+// responses after validation (RFC 7234, section 5.5).
+func dropTransientWarnings(header http.Header) {
+	warn, ok := header["Warning"]
+	if !ok {
+		return
+	}
+	var keep []string
+	for _, w := range warn {
+		if !strings.HasPrefix(strings.TrimSpace(w), "1") {
+			keep = append(keep, w)
+		}
+	}
+	if len(keep) > 0 {
+		header["Warning"] = keep
+	} else {
+		delete(header, "Warning")
+	}
+}
+
+// maxAgeValue is the value sent in the Age header field if the age of
+// a response is too large to be represented (RFC 7234, section 1.2.1).
+const maxAgeValue = 2147483648
+
+// setAge replaces the Age header field in `header` with the given
+// age, see RFC 7234, section 5.1.
+func setAge(header http.Header, age time.Duration) {
+	sec := int64(age / time.Second)
+	if sec < 0 {
+		sec = 0
+	} else if sec > maxAgeValue {
+		sec = maxAgeValue
+	}
+	header.Set("Age", strconv.FormatInt(sec, 10))
+}
+
+// storedMetaData returns a copy of `meta` for storage in the cache.
+// Header fields listed in no-cache="..." directives, and for shared
+// caches in private="..." directives, are removed from the copy (RFC
+// 7234, sections 5.2.2.2 and 5.2.2.6).  The request header fields
+// nominated by the Vary header field are recorded from `req`, unless
+// `meta` already lists them.
+func (proxy *Proxy) storedMetaData(req *http.Request, meta *cache.MetaData) *cache.MetaData {
+	if meta.VaryHeader == nil {
+		if vary := cache.VaryHeader(meta.Header, req.Header); vary != nil {
+			res := *meta
+			res.VaryHeader = vary
+			meta = &res
+		}
+	}
+
+	cc, _ := parseHeaders(meta.Header["Cache-Control"])
+	var fields []string
+	if val := cc["no-cache"]; val != "" {
+		fields = append(fields, strings.Split(val, ",")...)
+	}
+	if val := cc["private"]; val != "" && proxy.shared {
+		fields = append(fields, strings.Split(val, ",")...)
+	}
+	if len(fields) == 0 {
+		return meta
+	}
+
+	res := *meta
+	res.Header = make(http.Header)
+	copyHeader(res.Header, meta.Header)
+	for _, name := range fields {
+		name = strings.TrimSpace(name)
+		if name != "" {
+			res.Header.Del(name)
+		}
+	}
+	return &res
+}
@@ -0,0 +1,137 @@
+package jvproxy
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/seehuhn/httputil"
+	"github.com/seehuhn/jvproxy/cache"
+)
+
+// HeuristicPolicy controls the freshness lifetime assigned to
+// responses which carry a Last-Modified header field, but no explicit
+// expiration time (RFC 7234, section 4.2.2).
+type HeuristicPolicy struct {
+	// Fraction is the freshness lifetime as a fraction of the time
+	// between the Last-Modified and Date header fields.  Zero
+	// disables heuristic freshness.
+	Fraction float64
+
+	// MaxLifetime is an upper bound for the heuristic freshness
+	// lifetime.  Zero means no limit.
+	MaxLifetime time.Duration
+}
+
+// Heuristics selects the HeuristicPolicy for a response.  A policy
+// for the host name of the request URL takes precedence; host names
+// also match all subdomains, so that an entry for "example.com"
+// applies to "static.example.com", unless there is a more specific
+// entry.  If no host policy applies, the policy for the status code
+// of the response is used, or Default if there is none.
+type Heuristics struct {
+	Default  HeuristicPolicy
+	ByStatus map[int]HeuristicPolicy
+	ByHost   map[string]HeuristicPolicy
+}
+
+// DefaultHeuristics is used by proxies where the Heuristics field is
+// not set.  The values follow the suggestion in RFC 7234, section
+// 4.2.2.
+var DefaultHeuristics = &Heuristics{
+	Default: HeuristicPolicy{
+		Fraction:    0.1,
+		MaxLifetime: 3 * 24 * time.Hour,
+	},
+}
+
+func (h *Heuristics) policy(host string, statusCode int) HeuristicPolicy {
+	host = strings.ToLower(host)
+	for host != "" {
+		if p, ok := h.ByHost[host]; ok {
+			return p
+		}
+		pos := strings.IndexByte(host, '.')
+		if pos < 0 {
+			break
+		}
+		host = host[pos+1:]
+	}
+	if p, ok := h.ByStatus[statusCode]; ok {
+		return p
+	}
+	return h.Default
+}
+
+// hasExplicitExpiry checks whether the freshness lifetime of `entry`
+// is given by the server (RFC 7234, section 4.2.1).
+func (proxy *Proxy) hasExplicitExpiry(entry *cache.Entry) bool {
+	cc, _ := parseHeaders(entry.Header["Cache-Control"])
+	if _, hasSMaxAge := cc["s-maxage"]; hasSMaxAge && proxy.shared {
+		return true
+	}
+	if _, hasMaxAge := cc["max-age"]; hasMaxAge {
+		return true
+	}
+	_, hasExpires := entry.Header["Expires"]
+	return hasExpires
+}
+
+// getHeuristicLifetime computes a heuristic freshness lifetime for a
+// response without explicit expiration time.  The second return
+// value is false, if no heuristic freshness lifetime can be used.
+func (proxy *Proxy) getHeuristicLifetime(req *http.Request, entry *cache.Entry) (time.Duration, bool) {
+	// RFC 7234, section 4.2.2: heuristics can only be used for
+	// responses with status codes defined as cacheable by default,
+	// or if the response is marked as public.
+	switch entry.StatusCode {
+	case 200, 203, 204, 206, 300, 301, 404, 405, 410, 414, 501:
+		// pass
+	default:
+		cc, _ := parseHeaders(entry.Header["Cache-Control"])
+		if _, hasPublic := cc["public"]; !hasPublic {
+			return 0, false
+		}
+	}
+
+	lastModified := httputil.ParseDate(entry.Header.Get("Last-Modified"))
+	if lastModified.IsZero() {
+		return 0, false
+	}
+	date := httputil.ParseDate(entry.Header.Get("Date"))
+	if date.IsZero() {
+		date = entry.ResponseTime
+	}
+
+	heuristics := proxy.Heuristics
+	if heuristics == nil {
+		heuristics = DefaultHeuristics
+	}
+	policy := heuristics.policy(req.URL.Hostname(), entry.StatusCode)
+	if policy.Fraction <= 0 {
+		return 0, false
+	}
+
+	res := time.Duration(policy.Fraction * float64(date.Sub(lastModified)))
+	if res < 0 {
+		res = 0
+	}
+	if policy.MaxLifetime > 0 && res > policy.MaxLifetime {
+		res = policy.MaxLifetime
+	}
+	return res, true
+}
+
+// needsHeuristicWarning checks whether a Warning header with warn-code
+// 113 must be added when serving `entry` from the cache.  This is the
+// case if the freshness lifetime was determined heuristically and the
+// current age is more than 24 hours (RFC 7234, section 4.2.2).
+func (proxy *Proxy) needsHeuristicWarning(req *http.Request, entry *cache.Entry) bool {
+	if proxy.hasExplicitExpiry(entry) {
+		return false
+	}
+	if _, ok := proxy.getHeuristicLifetime(req, entry); !ok {
+		return false
+	}
+	return proxy.getCurrentAge(entry) > 24*time.Hour
+}
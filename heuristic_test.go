@@ -0,0 +1,96 @@
+package jvproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/seehuhn/jvproxy/cache"
+	. "gopkg.in/check.v1"
+)
+
+func newHeuristicEntry(age, modified time.Duration) *cache.Entry {
+	entry := newStaleEntry("", age)
+	entry.Header.Del("Cache-Control")
+	date := entry.ResponseTime
+	entry.Header.Set("Last-Modified", date.Add(-modified).Format(time.RFC1123))
+	return entry
+}
+
+func (s *MySuite) TestHeuristicPolicy(c *C) {
+	h := &Heuristics{
+		Default: HeuristicPolicy{Fraction: 0.1},
+		ByStatus: map[int]HeuristicPolicy{
+			404: {Fraction: 0.01},
+		},
+		ByHost: map[string]HeuristicPolicy{
+			"example.com":     {Fraction: 0.2},
+			"www.example.com": {Fraction: 0.3},
+		},
+	}
+	c.Check(h.policy("example.org", 200).Fraction, Equals, 0.1)
+	c.Check(h.policy("example.org", 404).Fraction, Equals, 0.01)
+	c.Check(h.policy("Example.com", 404).Fraction, Equals, 0.2)
+	c.Check(h.policy("static.example.com", 200).Fraction, Equals, 0.2)
+	c.Check(h.policy("www.example.com", 200).Fraction, Equals, 0.3)
+}
+
+func (s *MySuite) TestHeuristicLifetime(c *C) {
+	proxy := NewProxy("test", failingUpstream, &cache.NullCache{}, true)
+	defer proxy.Close()
+	proxy.Heuristics = &Heuristics{
+		Default: HeuristicPolicy{
+			Fraction:    0.1,
+			MaxLifetime: 2 * time.Hour,
+		},
+		ByHost: map[string]HeuristicPolicy{
+			"dynamic.example.com": {},
+		},
+	}
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+
+	entry := newHeuristicEntry(time.Minute, 10*time.Hour)
+	c.Check(proxy.getFreshnessLifetime(req, entry), Equals, time.Hour)
+	entry = newHeuristicEntry(time.Minute, 100*time.Hour)
+	c.Check(proxy.getFreshnessLifetime(req, entry), Equals, 2*time.Hour)
+
+	entry = newHeuristicEntry(time.Minute, 10*time.Hour)
+	entry.Header.Set("Cache-Control", "max-age=60")
+	c.Check(proxy.getFreshnessLifetime(req, entry), Equals, time.Minute)
+
+	entry = newHeuristicEntry(time.Minute, 10*time.Hour)
+	entry.StatusCode = http.StatusFound
+	c.Check(proxy.getFreshnessLifetime(req, entry) < 0, Equals, true)
+
+	req, _ = http.NewRequest("GET", "http://dynamic.example.com/", nil)
+	entry = newHeuristicEntry(time.Minute, 10*time.Hour)
+	c.Check(proxy.getFreshnessLifetime(req, entry) < 0, Equals, true)
+}
+
+func (s *MySuite) TestHeuristicWarning(c *C) {
+	store := &fixedCache{}
+	proxy := NewProxy("test", failingUpstream, store, true)
+	defer proxy.Close()
+	proxy.Heuristics = &Heuristics{
+		Default: HeuristicPolicy{Fraction: 0.1},
+	}
+
+	get := func() *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "http://example.com/", nil)
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, req)
+		return w
+	}
+
+	store.entries = []*cache.Entry{newHeuristicEntry(time.Hour, 100*24*time.Hour)}
+	w := get()
+	c.Assert(w.Code, Equals, http.StatusOK)
+	c.Assert(w.Header()["Warning"], HasLen, 0)
+
+	store.entries = []*cache.Entry{newHeuristicEntry(48*time.Hour, 100*24*time.Hour)}
+	w = get()
+	c.Assert(w.Code, Equals, http.StatusOK)
+	c.Assert(w.Header()["Warning"], DeepEquals,
+		[]string{"113 test \"Heuristic Expiration\""})
+	c.Assert(store.entries[0].Header["Warning"], HasLen, 0)
+}
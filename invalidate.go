@@ -0,0 +1,80 @@
+package jvproxy
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/seehuhn/jvproxy/cache"
+	"github.com/seehuhn/trace"
+)
+
+// isUnsafeMethod checks whether responses to `method` invalidate
+// cached responses for the target URI (RFC 7234, section 4.4).
+func isUnsafeMethod(method string) bool {
+	switch method {
+	case "POST", "PUT", "DELETE", "PATCH":
+		return true
+	}
+	return false
+}
+
+// invalidate removes cached responses after a non-error response to a
+// request with an unsafe method was received.  This affects the
+// effective request URI, as well as the URIs in the Location and
+// Content-Location header fields of the response.  To prevent denial
+// of service attacks, the latter are only invalidated if they have the
+// same origin as the request URI.  The URIs are converted to cache
+// keys using proxy.KeyFunc.
+func (proxy *Proxy) invalidate(req *http.Request, resp *cache.Entry, log *LogEntry) {
+	if !isUnsafeMethod(req.Method) || resp.Source == "error" ||
+		resp.StatusCode < 200 || resp.StatusCode >= 400 {
+		return
+	}
+
+	urls := []string{log.CacheKey}
+	for _, name := range []string{"Location", "Content-Location"} {
+		val := resp.Header.Get(name)
+		if val == "" {
+			continue
+		}
+		target, err := req.URL.Parse(val)
+		if err != nil || !sameOrigin(req.URL, target) {
+			continue
+		}
+		r := *req
+		r.URL = target
+		s := proxy.CacheKey(&r)
+		if s != urls[0] {
+			urls = append(urls, s)
+		}
+	}
+
+	for _, u := range urls {
+		trace.T("jvproxy/handler", trace.PrioDebug,
+			"invalidating %s after %s", u, req.Method)
+		proxy.cache.Invalidate(u)
+	}
+	log.CacheResult += ",INVALIDATE"
+}
+
+// sameOrigin checks whether the two URLs have the same scheme and
+// authority (RFC 6454).
+func sameOrigin(a, b *url.URL) bool {
+	return strings.EqualFold(a.Scheme, b.Scheme) &&
+		strings.EqualFold(canonicalHost(a), canonicalHost(b))
+}
+
+func canonicalHost(u *url.URL) string {
+	host := u.Hostname()
+	port := u.Port()
+	if port == "" {
+		switch strings.ToLower(u.Scheme) {
+		case "http":
+			port = "80"
+		case "https":
+			port = "443"
+		}
+	}
+	return host + ":" + port
+}
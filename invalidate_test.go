@@ -0,0 +1,76 @@
+package jvproxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"github.com/seehuhn/jvproxy/cache"
+	. "gopkg.in/check.v1"
+)
+
+type invalidationRecorder struct {
+	cache.NullCache
+	urls []string
+}
+
+func (r *invalidationRecorder) Invalidate(url string) {
+	r.urls = append(r.urls, url)
+}
+
+func (s *MySuite) TestInvalidateUnsafe(c *C) {
+	var code int
+	upstream := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		h := http.Header{}
+		h.Set("Location", "/items/42")
+		h.Set("Content-Location", "http://other.example.com/items/42")
+		return &http.Response{
+			StatusCode: code,
+			Proto:      "HTTP/1.1",
+			Header:     h,
+			Body:       ioutil.NopCloser(strings.NewReader("")),
+			Request:    req,
+		}, nil
+	})
+	rec := &invalidationRecorder{}
+	proxy := NewProxy("test", upstream, rec, true)
+	defer proxy.Close()
+
+	code = http.StatusCreated
+	req, _ := http.NewRequest("POST", "http://example.com/items", nil)
+	proxy.ServeHTTP(httptest.NewRecorder(), req)
+	c.Assert(rec.urls, DeepEquals, []string{
+		"http://example.com/items",
+		"http://example.com/items/42",
+	})
+
+	rec.urls = nil
+	code = http.StatusInternalServerError
+	req, _ = http.NewRequest("DELETE", "http://example.com/items/42", nil)
+	proxy.ServeHTTP(httptest.NewRecorder(), req)
+	c.Assert(rec.urls, HasLen, 0)
+
+	code = http.StatusOK
+	req, _ = http.NewRequest("GET", "http://example.com/items", nil)
+	proxy.ServeHTTP(httptest.NewRecorder(), req)
+	c.Assert(rec.urls, HasLen, 0)
+}
+
+func (s *MySuite) TestSameOrigin(c *C) {
+	base, _ := http.NewRequest("GET", "http://Example.com/a", nil)
+	for _, test := range []struct {
+		target string
+		same   bool
+	}{
+		{"/b", true},
+		{"http://example.com:80/b", true},
+		{"https://example.com/b", false},
+		{"http://example.com:8080/b", false},
+		{"http://evil.example.com/b", false},
+	} {
+		u, err := base.URL.Parse(test.target)
+		c.Assert(err, IsNil)
+		c.Check(sameOrigin(base.URL, u), Equals, test.same, Commentf("%s", test.target))
+	}
+}
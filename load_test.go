@@ -1,12 +1,15 @@
 package jvproxy
 
 import (
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"strconv"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -81,3 +84,183 @@ func TestParallelAccess(t *testing.T) {
 	}
 	wait.Wait()
 }
+
+func TestCoalescedMisses(t *testing.T) {
+	var mutex sync.Mutex
+	count := 0
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			mutex.Lock()
+			count++
+			mutex.Unlock()
+			<-release
+			fmt.Fprintln(w, "Hello, client")
+		}))
+	defer upstream.Close()
+
+	n := 20
+	joined := make(chan struct{}, n)
+	proxy := NewProxy("test", nil, &cache.NullCache{}, true)
+	proxy.flights.joined = func(string) {
+		select {
+		case joined <- struct{}{}:
+		default:
+		}
+	}
+	proxyServer := httptest.NewServer(proxy)
+	defer proxyServer.Close()
+
+	transport := &http.Transport{
+		Proxy: func(r *http.Request) (*url.URL, error) {
+			return url.Parse(proxyServer.URL)
+		},
+		DisableKeepAlives: true,
+	}
+	viaProxy := &http.Client{Transport: transport}
+
+	wait := &sync.WaitGroup{}
+	for i := 0; i < n; i++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			resp, err := viaProxy.Get(upstream.URL)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			body, err := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err != nil {
+				t.Error(err)
+			}
+			if string(body) != "Hello, client\n" {
+				t.Errorf("wrong body %q", body)
+			}
+		}()
+	}
+
+	// wait until all clients have joined the upstream request
+	for i := 0; i < n-1; i++ {
+		<-joined
+	}
+	close(release)
+	wait.Wait()
+
+	if count != 1 {
+		t.Errorf("%d upstream requests for %d clients", count, n)
+	}
+}
+
+// goneWriter is the http.ResponseWriter for a client which has
+// disconnected.
+type goneWriter struct {
+	header http.Header
+}
+
+func (w *goneWriter) Header() http.Header { return w.header }
+
+func (w *goneWriter) WriteHeader(int) {}
+
+func (w *goneWriter) Write([]byte) (int, error) {
+	return 0, errors.New("client has gone away")
+}
+
+// coalesceLeaderGone lets the leader of a coalesced request disconnect
+// before the body has been received, and returns the number of
+// upstream requests used to serve the leader and `n` followers.
+func coalesceLeaderGone(t *testing.T, store cache.Cache, size, n int) int {
+	var mutex sync.Mutex
+	count := 0
+	started := make(chan struct{}, n+1)
+	release := make(chan struct{})
+	text := strings.Repeat("x", size)
+	upstream := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		mutex.Lock()
+		count++
+		mutex.Unlock()
+		select {
+		case started <- struct{}{}:
+		default:
+		}
+		<-release
+		h := http.Header{}
+		h.Set("Cache-Control", "max-age=3600")
+		h.Set("Content-Length", strconv.Itoa(size))
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Proto:      "HTTP/1.1",
+			Header:     h,
+			Body:       ioutil.NopCloser(strings.NewReader(text)),
+			Request:    req,
+		}, nil
+	})
+	proxy := NewProxy("test", upstream, store, true)
+	defer proxy.Close()
+	joined := make(chan struct{}, n)
+	proxy.flights.joined = func(string) {
+		select {
+		case joined <- struct{}{}:
+		default:
+		}
+	}
+
+	wait := &sync.WaitGroup{}
+	wait.Add(1)
+	go func() {
+		defer wait.Done()
+		req, _ := http.NewRequest("GET", "http://example.com/", nil)
+		proxy.ServeHTTP(&goneWriter{header: http.Header{}}, req)
+	}()
+	// the leader has started the flight once upstream is contacted
+	<-started
+
+	for i := 0; i < n; i++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			req, _ := http.NewRequest("GET", "http://example.com/", nil)
+			w := httptest.NewRecorder()
+			proxy.ServeHTTP(w, req)
+			if w.Body.String() != text {
+				t.Errorf("wrong body of length %d", w.Body.Len())
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		<-joined
+	}
+	close(release)
+	wait.Wait()
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	return count
+}
+
+func TestCoalescedLeaderGone(t *testing.T) {
+	count := coalesceLeaderGone(t, &cache.NullCache{}, 1000, 5)
+	if count != 1 {
+		t.Errorf("%d upstream requests for shared response", count)
+	}
+
+	// large bodies are only shared if the cache can provide them
+	count = coalesceLeaderGone(t, &cache.NullCache{}, maxFlightBuffer+1, 5)
+	if count != 6 {
+		t.Errorf("%d upstream requests for large response", count)
+	}
+
+	tempDir, err := ioutil.TempDir("", "jvproxy-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	store, err := cache.NewLevelDBCache(tempDir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	count = coalesceLeaderGone(t, store, maxFlightBuffer+1, 5)
+	if count != 1 {
+		t.Errorf("%d upstream requests for stored response", count)
+	}
+}
@@ -11,6 +11,7 @@ type LogEntry struct {
 	RemoteAddr  string
 	Method      string
 	RequestURI  string
+	CacheKey    string
 
 	StatusCode    int
 	ContentLength int64
@@ -20,6 +21,7 @@ type LogEntry struct {
 	HandlerCompleteNano  int64
 
 	CacheResult string
+	ErrorID     string
 }
 
 var logChannel chan *LogEntry
@@ -32,10 +34,18 @@ func logger() {
 	}
 	for log := range logChannel {
 		t := log.RequestTime.Format("2006-01-02 15:04:05.999")
+		extra := ""
+		if log.ErrorID != "" {
+			extra += " error=" + log.ErrorID
+		}
+		if log.CacheKey != "" && log.CacheKey != log.RequestURI {
+			extra += " key=" + log.CacheKey
+		}
 		_, err = fmt.Fprintf(outFile, "%-23s %-16s %-4s %s\n"+
-			"                        %d %d %s %s\n",
+			"                        %d %d %s %s%s\n",
 			t, log.RemoteAddr, log.Method, log.RequestURI,
-			log.StatusCode, log.ContentLength, log.CacheResult, log.Comments)
+			log.StatusCode, log.ContentLength, log.CacheResult, log.Comments,
+			extra)
 		if err != nil {
 			panic(err)
 		}
@@ -14,20 +14,28 @@
 // You should have received a copy of the GNU General Public License
 // along with this program.  If not, see <http://www.gnu.org/licenses/>.
 
+//go:build ignore
 // +build ignore
 
 package main
 
 import (
+	"context"
 	"encoding/hex"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"html/template"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
+	"os"
+	"os/signal"
 	"path/filepath"
+	"sort"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/seehuhn/jvproxy"
@@ -38,9 +46,160 @@ import (
 var listenAddr = flag.String("listen-addr", "0.0.0.0:8080",
 	"the address to listen on, in the form host:port")
 
+var adminAddr = flag.String("admin-addr", "",
+	"an additional address for the admin pages, in the form host:port; "+
+		"cache options can be changed from there, or else only from the local host")
+
+// shutdownTimeout is the time allowed for requests in progress to
+// complete, when the proxy is shut down.
+const shutdownTimeout = 30 * time.Second
+
 var upstreamProxy = flag.String("upstream-proxy", "",
 	"an upstream proxy to forward requests to")
 
+var cacheOptions = cache.DefaultLevelDBOptions
+
+func init() {
+	flag.Int64Var(&cacheOptions.MaxBytes, "cache-max-bytes",
+		cacheOptions.MaxBytes, "maximal total size of the disk cache")
+	flag.Int64Var(&cacheOptions.MaxEntries, "cache-max-entries",
+		cacheOptions.MaxEntries, "maximal number of entries in the disk cache")
+	flag.Int64Var(&cacheOptions.MaxObjectSize, "cache-max-object",
+		cacheOptions.MaxObjectSize, "largest response body stored in the disk cache")
+	flag.Int64Var(&cacheOptions.MinFreeBytes, "cache-min-free",
+		cacheOptions.MinFreeBytes, "free space to keep on the disk cache volume")
+	flag.DurationVar(&cacheOptions.MaxStaleness, "cache-max-staleness",
+		cacheOptions.MaxStaleness, "time after which expired data is removed from the disk cache")
+	flag.BoolVar(&cacheOptions.VerifyReads, "cache-verify",
+		cacheOptions.VerifyReads, "check the hashes of cached content while reading")
+	flag.StringVar(&cacheOptions.Policy, "cache-policy",
+		cache.DefaultEvictionPolicy, "eviction policy for the disk cache, one of "+
+			strings.Join(cache.EvictionPolicies(), ", "))
+	flag.Var(compressionFlag{&cacheOptions}, "cache-compress",
+		"media types to store compressed in the disk cache, e.g. \"text/*=zstd,application/json=gzip\"; content-codings: "+
+			strings.Join(cache.Codecs(), ", "))
+}
+
+// compressionFlag sets LevelDBOptions.Compression from a
+// comma-separated list of "type/subtype=coding" entries.
+type compressionFlag struct {
+	opts *cache.LevelDBOptions
+}
+
+func (f compressionFlag) String() string {
+	if f.opts == nil {
+		return ""
+	}
+	var parts []string
+	for mediaType, coding := range f.opts.Compression {
+		parts = append(parts, mediaType+"="+coding)
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ",")
+}
+
+func (f compressionFlag) Set(value string) error {
+	res := make(map[string]string)
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		pos := strings.IndexByte(part, '=')
+		if pos < 0 {
+			return fmt.Errorf("missing content-coding for %q", part)
+		}
+		res[strings.ToLower(part[:pos])] = part[pos+1:]
+	}
+	f.opts.Compression = res
+	return nil
+}
+
+var keyNormalizer = &jvproxy.KeyNormalizer{}
+
+func init() {
+	flag.BoolVar(&keyNormalizer.SortQuery, "key-sort-query",
+		keyNormalizer.SortQuery, "sort the query parameters in cache keys")
+	flag.Var(listFlag{&keyNormalizer.StripParams}, "key-strip",
+		"query parameters to remove from cache keys, e.g. \"utm_*,fbclid\"")
+	flag.Var(listFlag{&keyNormalizer.IgnoreQuery}, "key-ignore-query",
+		"host names where the query string is removed from cache keys")
+}
+
+// listFlag sets a list of strings from a comma-separated value.
+type listFlag struct {
+	list *[]string
+}
+
+func (f listFlag) String() string {
+	if f.list == nil {
+		return ""
+	}
+	return strings.Join(*f.list, ",")
+}
+
+func (f listFlag) Set(value string) error {
+	var res []string
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part != "" {
+			res = append(res, part)
+		}
+	}
+	*f.list = res
+	return nil
+}
+
+var userAgentBuckets cache.UserAgentBuckets
+
+func init() {
+	flag.Var(bucketsFlag{&userAgentBuckets}, "vary-user-agent",
+		"buckets for responses with \"Vary: User-Agent\", e.g. \"mobile=Mobile|Android,desktop=\"; an empty pattern matches all user agents")
+}
+
+// bucketsFlag sets UserAgentBuckets from a comma-separated list of
+// "name=pattern|pattern" entries.
+type bucketsFlag struct {
+	buckets *cache.UserAgentBuckets
+}
+
+func (f bucketsFlag) String() string {
+	if f.buckets == nil {
+		return ""
+	}
+	var parts []string
+	for _, bucket := range *f.buckets {
+		parts = append(parts, bucket.Name+"="+strings.Join(bucket.Patterns, "|"))
+	}
+	return strings.Join(parts, ",")
+}
+
+func (f bucketsFlag) Set(value string) error {
+	var res cache.UserAgentBuckets
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		pos := strings.IndexByte(part, '=')
+		if pos <= 0 {
+			return fmt.Errorf("missing bucket name in %q", part)
+		}
+		res = append(res, cache.UserAgentBucket{
+			Name:     part[:pos],
+			Patterns: strings.Split(part[pos+1:], "|"),
+		})
+	}
+	*f.buckets = res
+	return nil
+}
+
+var memoryCacheSize = flag.Int64("memory-cache", 64*1024*1024,
+	"size of the in-memory cache tier in bytes, or 0 to disable")
+
+var memoryMaxObject = flag.Int64("memory-max-object", 1024*1024,
+	"largest response body kept in the in-memory cache tier")
+
 const tmplDir = "tmpl"
 
 var tmplFuncs = template.FuncMap{
@@ -130,17 +289,75 @@ func installReport(mux *http.ServeMux, name string, handler http.HandlerFunc) {
 	})
 }
 
-func installAdminHandlers(mux *http.ServeMux, proxy *jvproxy.Proxy, cache cache.Cache) {
+func installAdminHandlers(mux *http.ServeMux, proxy *jvproxy.Proxy, store, disk cache.Cache) {
 	installReport(mux, "index", func(w http.ResponseWriter, r *http.Request) {
-		err := reportTmpl["index"].Execute(w, map[string]interface{}{
+		data := map[string]interface{}{
 			"proxy": proxy,
-			"cache": cache,
-		})
+			"cache": store,
+			"keys":  keyNormalizer,
+		}
+		if tiered, ok := store.(*cache.TieredCache); ok {
+			data["tiered"] = tiered.Stats()
+		}
+		// The form on the page shows the cache key for a URL.
+		if target := r.FormValue("url"); target != "" {
+			data["url"] = target
+			req, err := http.NewRequest("GET", target, nil)
+			if err == nil && req.URL.IsAbs() {
+				data["key"] = proxy.CacheKey(req)
+			}
+		}
+		err := reportTmpl["index"].Execute(w, data)
 		if err != nil {
 			trace.T("jvproxy/admin", trace.PrioError,
 				"rendering summary data into template failed: %s", err.Error())
 		}
 	})
+	if conf, ok := disk.(cache.Configurable); ok {
+		mux.HandleFunc("/options", func(w http.ResponseWriter, r *http.Request) {
+			switch r.Method {
+			case "GET", "HEAD":
+				// pass
+			case "POST", "PUT":
+				if !canChangeOptions(r) {
+					code := http.StatusForbidden
+					http.Error(w, http.StatusText(code), code)
+					return
+				}
+				// Fields missing from the request body keep
+				// their current values.
+				opts := conf.Options()
+				// The decoder would modify the map in place.
+				compression := make(map[string]string)
+				for mediaType, coding := range opts.Compression {
+					compression[mediaType] = coding
+				}
+				opts.Compression = compression
+				err := json.NewDecoder(r.Body).Decode(&opts)
+				if err == nil {
+					err = conf.SetOptions(opts)
+				}
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				trace.T("jvproxy/admin", trace.PrioInfo,
+					"cache options changed to %+v", opts)
+			default:
+				w.Header().Set("Allow", "GET, HEAD, POST, PUT")
+				code := http.StatusMethodNotAllowed
+				http.Error(w, http.StatusText(code), code)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"options": conf.Options(),
+				"usage":   conf.Usage(),
+				"stats":   conf.EvictionStats(),
+				"dedup":   conf.DedupStats(),
+			})
+		})
+	}
 	mux.Handle("/css/",
 		http.StripPrefix("/css/", http.FileServer(http.Dir("css"))))
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
@@ -152,8 +369,32 @@ func installAdminHandlers(mux *http.ServeMux, proxy *jvproxy.Proxy, cache cache.
 	})
 }
 
+// adminKey marks the requests received at the admin address in the
+// request context.
+type adminKey struct{}
+
+// canChangeOptions checks whether `r` may change the cache options.
+// This is allowed for requests received at the admin address, and for
+// requests from the local host.
+func canChangeOptions(r *http.Request) bool {
+	if r.Context().Value(adminKey{}) != nil {
+		return true
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
 func main() {
 	flag.Parse()
+	vary := cache.DefaultVaryNormalizers()
+	if len(userAgentBuckets) > 0 {
+		vary["User-Agent"] = userAgentBuckets
+	}
+	cacheOptions.VaryNormalizers = vary
 
 	transport := &http.Transport{
 		TLSHandshakeTimeout:   10 * time.Second,
@@ -175,13 +416,26 @@ func main() {
 		}
 	}
 
-	cache, err := cache.NewLevelDBCache("cache-root")
+	disk, err := cache.NewLevelDBCache("cache-root", &cacheOptions)
 	if err != nil {
 		log.Fatalf("cannot create cache: %s", err.Error())
 	}
-	proxy := jvproxy.NewProxy(*listenAddr, transport, cache, true)
+	store := disk
+	if *memoryCacheSize > 0 {
+		mem := cache.NewMemoryCache(*memoryCacheSize)
+		mem.VaryNormalizers = vary
+		store = cache.NewTieredCache(mem, disk, cache.Admission{
+			MaxSize: *memoryMaxObject,
+			MinUses: 2,
+		})
+	}
+	proxy := jvproxy.NewProxy(*listenAddr, transport, store, true)
+	proxy.KeyFunc = keyNormalizer.Key
+	proxy.VaryNormalizers = vary
+	proxy.ErrorTmpl = template.Must(template.New("error.html").
+		ParseFiles(filepath.Join(tmplDir, "error.html")))
 
-	installAdminHandlers(proxy.AdminMux, proxy, cache)
+	installAdminHandlers(proxy.AdminMux, proxy, store, disk)
 
 	server := &http.Server{
 		Addr:         *listenAddr,
@@ -189,8 +443,58 @@ func main() {
 		ReadTimeout:  10 * time.Second,
 		WriteTimeout: 10 * time.Second,
 	}
+	var admin *http.Server
+	if *adminAddr != "" {
+		admin = &http.Server{
+			Addr: *adminAddr,
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				ctx := context.WithValue(r.Context(), adminKey{}, true)
+				proxy.AdminMux.ServeHTTP(w, r.WithContext(ctx))
+			}),
+		}
+		go func() {
+			trace.T("main", trace.PrioInfo, "admin pages at %q", *adminAddr)
+			err := admin.ListenAndServe()
+			if err != http.ErrServerClosed {
+				log.Fatalf("cannot serve admin pages: %s", err.Error())
+			}
+		}()
+	}
+
+	// On shutdown, the requests in progress are completed first.
+	// Then the proxy stops its background work, and finally the
+	// cache is closed, so that the index is complete when the proxy
+	// is restarted.
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	stopped := make(chan struct{})
+	go func() {
+		<-sig
+		trace.T("main", trace.PrioInfo, "shutting down")
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if admin != nil {
+			admin.Shutdown(ctx)
+		}
+		err := server.Shutdown(ctx)
+		if err != nil {
+			trace.T("main", trace.PrioError,
+				"requests still in progress: %s", err.Error())
+		}
+		close(stopped)
+	}()
+
 	trace.T("main", trace.PrioInfo, "listening at %q", *listenAddr)
 	err = server.ListenAndServe()
+	if err != http.ErrServerClosed {
+		log.Fatalf("something went wrong: %s", err.Error())
+	}
+	<-stopped
 
-	trace.T("main", trace.PrioInfo, "something went wrong: %s", err.Error())
+	// Proxy.Close waits for the background revalidations and for
+	// shared responses to be stored, and then closes the cache.
+	err = proxy.Close()
+	if err != nil {
+		log.Fatalf("cannot close cache: %s", err.Error())
+	}
 }
@@ -1,8 +1,8 @@
 package jvproxy
 
 import (
+	"html/template"
 	"io"
-	"io/ioutil"
 	"net"
 	"net/http"
 	"sort"
@@ -16,19 +16,44 @@ import (
 )
 
 type Proxy struct {
-	Name     string
-	upstream http.RoundTripper
-	cache    cache.Cache
-	logger   chan<- *LogEntry
-	AdminMux *http.ServeMux
-	shared   bool
+	Name       string
+	upstream   http.RoundTripper
+	cache      cache.Cache
+	logger     chan<- *LogEntry
+	AdminMux   *http.ServeMux
+	shared     bool
+	background *revalidator
+	flights    flightGroup
+
+	// Heuristics determines the freshness lifetime of responses
+	// without explicit expiration time.  If this is nil,
+	// DefaultHeuristics is used.
+	Heuristics *Heuristics
+
+	// ErrorTmpl, if set, is used to render the HTML error pages
+	// sent to clients when the upstream server cannot be reached.
+	ErrorTmpl *template.Template
+
+	// KeyFunc, if set, computes the key under which responses to a
+	// request are stored in the cache.  Requests with the same key
+	// share cache entries.  The key must be an absolute URL.  If
+	// KeyFunc is nil, the request URL is used unchanged; a
+	// KeyNormalizer can be used to merge equivalent URLs.
+	KeyFunc func(*http.Request) string
+
+	// VaryNormalizers decides whether a response which is being
+	// fetched for one request can be used for a concurrent request
+	// with the same key, and should agree with the normalizers used
+	// by the cache.  If this is nil, cache.DefaultVaryNormalizers is
+	// used.
+	VaryNormalizers cache.VaryNormalizers
 }
 
 func NewProxy(name string, transport http.RoundTripper, cache cache.Cache, shared bool) *Proxy {
 	if transport == nil {
 		transport = http.DefaultTransport
 	}
-	return &Proxy{
+	proxy := &Proxy{
 		Name:     name,
 		upstream: transport,
 		cache:    cache,
@@ -36,9 +61,13 @@ func NewProxy(name string, transport http.RoundTripper, cache cache.Cache, share
 		AdminMux: http.NewServeMux(),
 		shared:   shared,
 	}
+	proxy.background = newRevalidator(proxy, backgroundWorkers, backgroundQueueSize)
+	return proxy
 }
 
 func (proxy *Proxy) Close() error {
+	proxy.background.Close()
+	proxy.flights.wait.Wait()
 	return proxy.cache.Close()
 }
 
@@ -138,6 +167,7 @@ func (proxy *Proxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	log.CacheKey = proxy.CacheKey(req)
 	cacheInfo := proxy.getCacheability(req)
 
 	var respData *cache.Entry
@@ -145,7 +175,7 @@ func (proxy *Proxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	// step 1: check whether any cached responses are available
 	var choices []*cache.Entry
 	if cacheInfo.canServeFromCache {
-		choices = proxy.cache.Retrieve(req)
+		choices = withBody(proxy.retrieve(req))
 		if len(choices) > 0 {
 			sort.Sort(byDate(choices))
 
@@ -158,12 +188,30 @@ func (proxy *Proxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 
 	// step 2: if the responses are stale, send a validation request
 	if respData != nil {
-		freshnessLifetime := proxy.getFreshnessLifetime(respData)
-		currentAge := proxy.getCurrentAge(respData)
-		stale := freshnessLifetime <= currentAge
-		// TODO(voss): revalidate, if the cached response contains the
-		// no-cache directive
-		if stale || cacheInfo.mustRevalidate {
+		state, reason := proxy.checkFreshness(req, respData, cacheInfo)
+		if reason != "" {
+			cacheInfo.log = append(cacheInfo.log, reason)
+		}
+		switch {
+		case state == isFresh && !cacheInfo.mustRevalidate:
+			// pass
+		case state == staleAllowed && !cacheInfo.mustRevalidate:
+			respData = proxy.staleCopy(req, respData)
+		case cacheInfo.onlyIfCached:
+			respData = nil
+		case state == isStale && !cacheInfo.mustRevalidate &&
+			proxy.canServeStaleWhileRevalidate(req, respData, cacheInfo):
+			// The copy is taken before the background job can
+			// access the stored responses.
+			stale := proxy.staleCopy(req, respData)
+			if proxy.background.Submit(req, choices) {
+				log.CacheResult += "BACKGROUND,"
+				respData = stale
+			} else {
+				log.CacheResult += "REVALIDATE,"
+				respData = proxy.requestFromUpstream(req, choices)
+			}
+		default:
 			log.CacheResult += "REVALIDATE,"
 			respData = proxy.requestFromUpstream(req, choices)
 		}
@@ -171,8 +219,15 @@ func (proxy *Proxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 
 	// step 3: make sure we still have the body of the selected response
 	var body io.ReadCloser
+	encoded := false
 	if respData != nil {
-		body = respData.GetBody()
+		if proxy.canSendEncoded(req, respData) {
+			body = respData.GetEncodedBody()
+			encoded = body != nil
+		}
+		if body == nil {
+			body = respData.GetBody()
+		}
 		if body == nil {
 			log.CacheResult += "DROPPED,"
 			respData = nil
@@ -180,20 +235,85 @@ func (proxy *Proxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	}
 
 	// step 4: if the above fails, forward the request upstream
+	var leader *flight
 	isHit := respData != nil
 	if isHit {
-		log.CacheResult += "HIT"
+		switch respData.Source {
+		case "stale":
+			log.CacheResult += "STALE"
+		case "cache":
+			log.CacheResult += "HIT"
+			respData = proxy.cachedCopy(req, respData)
+		case "error":
+			// revalidation failed, see .requestFromUpstream()
+			log.CacheResult += "ERROR"
+		default:
+			log.CacheResult += "HIT"
+		}
+		if encoded {
+			log.CacheResult += ",ENCODED"
+			respData = proxy.encodedCopy(respData)
+		}
 		cacheInfo.canStore = false
-	} else {
+	} else if cacheInfo.onlyIfCached {
+		// RFC 7234, section 5.2.1.7
 		log.CacheResult += "MISS"
-		respData = proxy.requestFromUpstream(req, nil)
+		cacheInfo.log = append(cacheInfo.log, "req:CC=OIC")
+		respData = proxy.errorResponse(req, newNotCachedError(req.URL.String()))
+	} else {
+		respData, leader = proxy.fetch(req, cacheInfo, log)
 	}
 
 	log.ResponseReceivedNano = int64(time.Since(requestTime) / time.Nanosecond)
 	log.StatusCode = respData.StatusCode
+	if respData.Source == "error" {
+		log.ErrorID = respData.Header.Get(errorIDHeader)
+	}
 
 	proxy.updateCacheability(respData, cacheInfo)
 	log.Comments = append(log.Comments, cacheInfo.log...)
+	proxy.invalidate(req, respData, log)
+
+	var entry cache.StoreCont
+	if cacheInfo.canStore {
+		if part := cacheInfo.partial; part != nil {
+			meta := completeMetaData(respData, part.total)
+			entry = proxy.cache.StorePartial(log.CacheKey,
+				proxy.storedMetaData(req, meta), part.start, part.total)
+			log.CacheResult += ",STORE_PARTIAL"
+		} else {
+			entry = proxy.cache.StoreStart(log.CacheKey,
+				proxy.storedMetaData(req, &respData.MetaData))
+			log.CacheResult += ",STORE"
+		}
+	}
+
+	shared := false
+	if leader != nil {
+		if entry != nil && cacheInfo.partial == nil {
+			body = proxy.share(leader, req, respData, entry, log.CacheKey)
+		}
+		if body != nil {
+			// The body is stored by the flight.
+			shared = true
+			entry = nil
+		} else {
+			leader.publish(respData, req.Header, false)
+			proxy.flights.remove(log.CacheKey, leader)
+			leader.finish(nil)
+		}
+	}
+
+	if isHit && req.Method == "GET" && req.Header.Get("Range") != "" &&
+		respData.StatusCode == http.StatusOK {
+		if content, ok := body.(io.ReadSeeker); ok {
+			defer body.Close()
+			log.CacheResult += ",RANGE"
+			log.StatusCode, log.ContentLength =
+				serveRange(w, req, respData, content)
+			return
+		}
+	}
 
 	h := w.Header()
 	copyHeader(h, respData.Header)
@@ -207,20 +327,28 @@ func (proxy *Proxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 
 	var n int64
 	var err error
-	if cacheInfo.canStore {
-		entry := proxy.cache.StoreStart(req.URL.String(), &respData.MetaData)
+	if entry != nil {
 		n, err = io.Copy(w, entry.Reader(body))
 		if err != nil {
 			entry.Discard()
 		} else {
 			entry.Commit(n)
 		}
-		log.CacheResult += ",STORE"
 	} else {
-		n, err = io.Copy(w, body)
-		if !isHit {
+		rec := &readErrorRecorder{r: body}
+		n, err = io.Copy(w, rec)
+		if !isHit && !shared && respData.Source != "coalesced" {
 			log.CacheResult += ",NOSTORE"
 		}
+		if (isHit || shared || respData.Source == "coalesced") && rec.err != nil {
+			// The cached or shared body could not be read
+			// completely, e.g. because the stored content is
+			// corrupt or the upstream transfer failed.  Make
+			// sure the client does not mistake the truncated
+			// body for a complete one.
+			log.CacheResult += ",ABORTED"
+			defer panic(http.ErrAbortHandler)
+		}
 	}
 	if err != nil {
 		trace.T("jvproxy/handler", trace.PrioDebug,
@@ -232,13 +360,28 @@ func (proxy *Proxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	// cached version?
 }
 
+// readErrorRecorder remembers the first error other than io.EOF
+// returned by the underlying reader.
+type readErrorRecorder struct {
+	r   io.Reader
+	err error
+}
+
+func (r *readErrorRecorder) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err != nil && err != io.EOF && r.err == nil {
+		r.err = err
+	}
+	return n, err
+}
+
 type byDate []*cache.Entry
 
 func (x byDate) Len() int      { return len(x) }
 func (x byDate) Swap(i, j int) { x[i], x[j] = x[j], x[i] }
 func (x byDate) Less(i, j int) bool {
 	dateI := httputil.ParseDate(x[i].Header.Get("Date"))
-	dateJ := httputil.ParseDate(x[i].Header.Get("Date"))
+	dateJ := httputil.ParseDate(x[j].Header.Get("Date"))
 	return dateI.After(dateJ)
 }
 
@@ -287,6 +430,19 @@ func (proxy *Proxy) requestFromUpstream(req *http.Request, stale []*cache.Entry)
 		}
 	}
 
+	// The entity tags of compressed representations sent by the
+	// proxy are unknown to the upstream server.
+	for _, name := range []string{"If-None-Match", "If-Match", "If-Range"} {
+		if values, changed := decodeETags(upReq.Header[name]); changed {
+			if !copiedHeaders {
+				upReq.Header = make(http.Header)
+				copyHeader(upReq.Header, req.Header)
+				copiedHeaders = true
+			}
+			upReq.Header[name] = values
+		}
+	}
+
 	if clientIP, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
 		// If we aren't the first proxy, retain prior X-Forwarded-For
 		// information as a comma+space separated list and fold
@@ -326,24 +482,20 @@ func (proxy *Proxy) requestFromUpstream(req *http.Request, stale []*cache.Entry)
 	upResp, err := proxy.upstream.RoundTrip(upReq)
 	responseTime := time.Now()
 	if err != nil {
-		// TODO(voss): serve stale responses if available?
 		trace.T("jvproxy/handler", trace.PrioDebug,
 			"upstream server request failed: %s %s: %s",
 			req.Method, req.RequestURI, err.Error())
-		msg := "error: " + err.Error()
-		h := http.Header{}
-		h.Add("Content-Type", "text/plain")
-		// TODO(voss): use the correct 502/504 responses.
-		return &cache.Entry{ // TODO(voss): invent error reporting mechanism
-			MetaData: cache.MetaData{
-				StatusCode: 555,
-				Header:     h,
-			},
-			Source: "error",
-			GetBody: func() io.ReadCloser {
-				return ioutil.NopCloser(strings.NewReader(msg))
-			},
+		if res := proxy.staleOnError(req, stale); res != nil {
+			return res
+		}
+		gwErr := newGatewayError(req.URL.String(), err)
+		if len(stale) > 0 && proxy.forbidsStale(stale[0]) {
+			// RFC 7234, section 5.2.2.1
+			gwErr.MustRevalidate = true
 		}
+		trace.T("jvproxy/handler", trace.PrioInfo,
+			"%s %s: %s", req.Method, req.RequestURI, gwErr.Error())
+		return proxy.errorResponse(req, gwErr)
 	}
 
 	// Fix upstream-provided headers as required for forwarding and
@@ -356,6 +508,13 @@ func (proxy *Proxy) requestFromUpstream(req *http.Request, stale []*cache.Entry)
 		upResp.Header.Set("Date", responseTime.Format(time.RFC1123))
 	}
 
+	if upResp.StatusCode >= 500 {
+		if res := proxy.staleOnError(req, stale); res != nil {
+			upResp.Body.Close()
+			return res
+		}
+	}
+
 	if conditional && upResp.StatusCode == http.StatusNotModified {
 		var selected []*cache.Entry
 		done := false
@@ -446,21 +605,29 @@ func (proxy *Proxy) requestFromUpstream(req *http.Request, stale []*cache.Entry)
 		}
 
 		if len(selected) > 0 {
+			// The entries obtained from the cache may be in use by
+			// other requests, so the updates are applied to copies.
+			updated := make([]*cache.Entry, len(selected))
+			for i, orig := range selected {
+				entry := new(cache.Entry)
+				*entry = *orig
+				entry.Header = make(http.Header)
+				copyHeader(entry.Header, orig.Header)
+				updated[i] = entry
+			}
+			selected = updated
+
 			// RFC 7234, section 4.3.4: If a stored response is
 			// selected for update, the cache MUST:
 			for _, entry := range selected {
 				// RFC 7234, section 4.3.4d: delete any Warning header
 				// fields in the stored response with warn-code 1xx;
-				warn := entry.Header["Warning"]
-				i := 0
-				for i < len(warn) {
-					if strings.HasPrefix(warn[i], "1") {
-						warn = append(warn[:i], warn[i+1:]...)
-					} else {
-						i++
-					}
-				}
+				dropTransientWarnings(entry.Header)
 
+				// RFC 7234, section 4.3.4e: retain any Warning header
+				// fields in the stored response with warn-code 2xx;
+				// and
+				//
 				// RFC 7234, section 4.3.4f: use other header fields
 				// provided in the 304 (Not Modified) response to
 				// replace all instances of the corresponding header
@@ -468,12 +635,22 @@ func (proxy *Proxy) requestFromUpstream(req *http.Request, stale []*cache.Entry)
 				//
 				// TODO(voss): what is "other"?
 				for key, val := range upResp.Header {
+					if key == "Warning" {
+						continue
+					}
 					entry.Header[key] = val
 				}
+				for _, warn := range upResp.Header["Warning"] {
+					if !strings.HasPrefix(strings.TrimSpace(warn), "1") {
+						entry.Header.Add("Warning", warn)
+					}
+				}
 
 				entry.ResponseTime = responseTime
 				entry.ResponseDelay = responseTime.Sub(requestTime)
-				proxy.cache.Update(req.URL.String(), entry)
+				stored := *entry
+				stored.MetaData = *proxy.storedMetaData(req, &entry.MetaData)
+				proxy.cache.Update(proxy.CacheKey(req), &stored)
 			}
 
 			sort.Sort(byDate(selected))
@@ -494,6 +671,108 @@ func (proxy *Proxy) requestFromUpstream(req *http.Request, stale []*cache.Entry)
 	}
 }
 
+// withBody removes the entries without a stored body from `entries`.
+// Revalidating such an entry would need a second, unconditional
+// request to obtain the body after a 304 (Not Modified) response, so
+// the request is forwarded with only the client's own validators
+// instead.
+func withBody(entries []*cache.Entry) []*cache.Entry {
+	var res []*cache.Entry
+	for _, entry := range entries {
+		if !entry.Dropped {
+			res = append(res, entry)
+		}
+	}
+	return res
+}
+
+// staleOnError selects the newest of the `stale` responses for use
+// after a failed revalidation attempt.  If the stale-if-error
+// directives do not allow this, nil is returned.  The returned entry
+// is a copy of the cached entry, with the appropriate Warning headers
+// added.
+func (proxy *Proxy) staleOnError(req *http.Request, stale []*cache.Entry) *cache.Entry {
+	if len(stale) == 0 || !proxy.canServeStaleOnError(req, stale[0]) {
+		return nil
+	}
+	res := proxy.staleCopy(req, stale[0])
+	proxy.addWarning(res.Header, 111, "Revalidation Failed")
+	return res
+}
+
+// staleCopy returns a copy of the cached response `entry`, for use
+// without successful validation.  The headers are adjusted as
+// described for cachedCopy().
+func (proxy *Proxy) staleCopy(req *http.Request, entry *cache.Entry) *cache.Entry {
+	res := proxy.cachedCopy(req, entry)
+	res.Source = "stale"
+	return res
+}
+
+// cachedCopy returns a copy of the cached response `entry`, with the
+// headers prepared for sending the response to the client: the Age
+// header field is set to the current age of the response, warnings
+// with warn-code 1xx from the stored response are removed, and new
+// warnings are added as appropriate (RFC 7234, sections 4.2.3 and
+// 5.5).
+func (proxy *Proxy) cachedCopy(req *http.Request, entry *cache.Entry) *cache.Entry {
+	res := new(cache.Entry)
+	*res = *entry
+	res.Header = make(http.Header)
+	copyHeader(res.Header, entry.Header)
+	dropTransientWarnings(res.Header)
+
+	currentAge := proxy.getCurrentAge(entry)
+	setAge(res.Header, currentAge)
+	if proxy.getFreshnessLifetime(req, entry) <= currentAge {
+		proxy.addWarning(res.Header, 110, "Response is Stale")
+	}
+	if proxy.needsHeuristicWarning(req, entry) {
+		proxy.addWarning(res.Header, 113, "Heuristic Expiration")
+	}
+	return res
+}
+
+// canSendEncoded checks whether the compressed copy of the stored body
+// of `entry` can be sent to the client.  This requires the client to
+// accept the content-coding, and the stored response must allow
+// transformations (RFC 7234, section 5.2.2.4).  Byte ranges are always
+// served from the uncompressed body.
+func (proxy *Proxy) canSendEncoded(req *http.Request, entry *cache.Entry) bool {
+	if entry.Encoding == "" || entry.GetEncodedBody == nil ||
+		req.Header.Get("Range") != "" {
+		return false
+	}
+	cc, _ := parseHeaders(entry.Header["Cache-Control"])
+	if _, noTransform := cc["no-transform"]; noTransform {
+		return false
+	}
+	return acceptsEncoding(req.Header, entry.Encoding)
+}
+
+// encodedCopy returns a copy of `entry`, with the headers adjusted for
+// sending the compressed copy of the body.  Since the origin server
+// sent the body without content-coding, the Warning header field
+// described in RFC 7234, section 5.5.6 is added.  The entity tag is
+// replaced by one for the compressed representation, see encodedETag.
+func (proxy *Proxy) encodedCopy(entry *cache.Entry) *cache.Entry {
+	res := new(cache.Entry)
+	*res = *entry
+	res.Header = make(http.Header)
+	copyHeader(res.Header, entry.Header)
+	res.Header.Set("Content-Encoding", entry.Encoding)
+	res.Header.Del("Content-Length")
+	if etag := res.Header.Get("Etag"); etag != "" {
+		res.Header.Del("Etag")
+		if etag = encodedETag(etag, entry.Encoding); etag != "" {
+			res.Header.Set("Etag", etag)
+		}
+	}
+	addVary(res.Header, "Accept-Encoding")
+	proxy.addWarning(res.Header, 214, "Transformation Applied")
+	return res
+}
+
 func (proxy *Proxy) setVia(header http.Header, proto string) {
 	via := proto + " " + proxy.Name + " (jvproxy)"
 	if strings.HasPrefix(via, "HTTP/") {
@@ -505,11 +784,20 @@ func (proxy *Proxy) setVia(header http.Header, proto string) {
 	header.Set("Via", via)
 }
 
+// unlimitedStaleness is used for decision.maxStale, if any amount of
+// staleness is acceptable.
+const unlimitedStaleness = 3600 * 24 * 365 * 100 * time.Second
+
 type decision struct {
 	canServeFromCache bool
 	canStore          bool
 	hasAuthorization  bool
 	mustRevalidate    bool
+	onlyIfCached      bool
+	maxAge            time.Duration // negative if not set
+	maxStale          time.Duration // negative if not set
+	minFresh          time.Duration
+	partial           *contentRange
 	log               []string
 }
 
@@ -553,6 +841,30 @@ func (proxy *Proxy) getCacheability(req *http.Request) *decision {
 		res.log = append(res.log, "req:CC=NC")
 	}
 
+	// RFC 7234, section 5.2.1
+	res.maxAge = -1
+	if val, hasMaxAge := cc["max-age"]; hasMaxAge {
+		if sec, ok := parseDeltaSeconds(val); ok {
+			res.maxAge = sec
+		}
+	}
+	res.maxStale = -1
+	if val, hasMaxStale := cc["max-stale"]; hasMaxStale {
+		if val == "" {
+			res.maxStale = unlimitedStaleness
+		} else if sec, ok := parseDeltaSeconds(val); ok {
+			res.maxStale = sec
+		}
+	}
+	if val, hasMinFresh := cc["min-fresh"]; hasMinFresh {
+		if sec, ok := parseDeltaSeconds(val); ok {
+			res.minFresh = sec
+		}
+	}
+	if _, hasOnlyIfCached := cc["only-if-cached"]; hasOnlyIfCached {
+		res.onlyIfCached = true
+	}
+
 	return res
 }
 
@@ -573,8 +885,20 @@ func (proxy *Proxy) updateCacheability(resp *cache.Entry, res *decision) {
 		// status codes understood by the proxy
 
 		// pass
+	case http.StatusPartialContent:
+		// RFC 7234, section 3.1: partial responses can be stored, if
+		// they can later be combined with other parts into a complete
+		// response.  RFC 7233, section 4.3 requires strong
+		// validators for this.
+		part, ok := parseContentRange(headers.Get("Content-Range"))
+		eTag := headers.Get("Etag")
+		if ok && eTag != "" && !strings.HasPrefix(eTag, "W/") {
+			res.partial = part
+		} else {
+			res.canStore = false
+			res.log = append(res.log, "resp:code=206")
+		}
 	default:
-		// This currently includes 206 (partial content)
 		res.canStore = false
 		res.log = append(res.log, "resp:code="+strconv.Itoa(resp.StatusCode))
 	}
@@ -584,7 +908,10 @@ func (proxy *Proxy) updateCacheability(resp *cache.Entry, res *decision) {
 		res.log = append(res.log, "resp:CC=NS")
 	}
 
-	if _, hasPrivate := cc["private"]; proxy.shared && hasPrivate {
+	// RFC 7234, section 5.2.2.6: private with field names only
+	// restricts storage of the named header fields, see
+	// .storedMetaData().
+	if val, hasPrivate := cc["private"]; proxy.shared && hasPrivate && val == "" {
 		res.canStore = false
 		res.log = append(res.log, "resp:CC=P")
 	}
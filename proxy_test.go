@@ -0,0 +1,463 @@
+package jvproxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing/iotest"
+	"time"
+
+	"github.com/seehuhn/jvproxy/cache"
+	. "gopkg.in/check.v1"
+)
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+var failingUpstream = roundTripFunc(func(*http.Request) (*http.Response, error) {
+	return nil, errors.New("upstream is down")
+})
+
+func staticUpstream(code int, body string) http.RoundTripper {
+	return roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: code,
+			Proto:      "HTTP/1.1",
+			Header:     http.Header{},
+			Body:       ioutil.NopCloser(strings.NewReader(body)),
+			Request:    req,
+		}, nil
+	})
+}
+
+func newStaleEntry(cc string, age time.Duration) *cache.Entry {
+	date := time.Now().Add(-age)
+	h := http.Header{}
+	h.Set("Date", date.Format(time.RFC1123))
+	h.Set("Cache-Control", cc)
+	h.Set("Etag", "\"x\"")
+	return &cache.Entry{
+		MetaData: cache.MetaData{
+			StatusCode:   200,
+			Header:       h,
+			ResponseTime: date,
+		},
+		GetBody: func() io.ReadCloser {
+			return ioutil.NopCloser(strings.NewReader("stale"))
+		},
+		Source: "cache",
+	}
+}
+
+func (s *MySuite) TestStaleIfError(c *C) {
+	proxy := NewProxy("test", failingUpstream, &cache.NullCache{}, true)
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+
+	entry := newStaleEntry("max-age=60, stale-if-error=3600", 2*time.Minute)
+	res := proxy.requestFromUpstream(req, []*cache.Entry{entry})
+	c.Assert(res.Source, Equals, "stale")
+	c.Assert(res.StatusCode, Equals, 200)
+	c.Assert(res.Header["Warning"], DeepEquals, []string{
+		"110 test \"Response is Stale\"",
+		"111 test \"Revalidation Failed\"",
+	})
+	c.Assert(entry.Header["Warning"], HasLen, 0)
+
+	entry = newStaleEntry("max-age=60, stale-if-error=30", 2*time.Minute)
+	res = proxy.requestFromUpstream(req, []*cache.Entry{entry})
+	c.Assert(res.Source, Not(Equals), "stale")
+
+	entry = newStaleEntry("max-age=60", 2*time.Minute)
+	req.Header.Set("Cache-Control", "stale-if-error=600")
+	res = proxy.requestFromUpstream(req, []*cache.Entry{entry})
+	c.Assert(res.Source, Equals, "stale")
+}
+
+func (s *MySuite) TestStaleIfErrorServerError(c *C) {
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	entry := newStaleEntry("max-age=60, stale-if-error=3600", 2*time.Minute)
+
+	proxy := NewProxy("test", staticUpstream(503, "busy"), &cache.NullCache{}, true)
+	res := proxy.requestFromUpstream(req, []*cache.Entry{entry})
+	c.Assert(res.Source, Equals, "stale")
+
+	proxy = NewProxy("test", staticUpstream(404, "gone"), &cache.NullCache{}, true)
+	res = proxy.requestFromUpstream(req, []*cache.Entry{entry})
+	c.Assert(res.Source, Equals, "upstream")
+	c.Assert(res.StatusCode, Equals, 404)
+}
+
+func (s *MySuite) TestStaleIfErrorNewest(c *C) {
+	old := newStaleEntry("max-age=60, stale-if-error=3600", 10*time.Minute)
+	old.GetBody = func() io.ReadCloser {
+		return ioutil.NopCloser(strings.NewReader("old"))
+	}
+	recent := newStaleEntry("max-age=60, stale-if-error=3600", 2*time.Minute)
+	recent.GetBody = func() io.ReadCloser {
+		return ioutil.NopCloser(strings.NewReader("recent"))
+	}
+	store := &fixedCache{entries: []*cache.Entry{old, recent}}
+	proxy := NewProxy("test", failingUpstream, store, true)
+	defer proxy.Close()
+
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, req)
+	c.Assert(w.Code, Equals, http.StatusOK)
+	c.Check(w.Body.String(), Equals, "recent")
+	c.Check(w.Header().Get("Age"), Equals, "120")
+}
+
+// fixedCache is a cache which always returns the same entries.
+func (s *MySuite) TestRevalidationError(c *C) {
+	store := &fixedCache{
+		entries: []*cache.Entry{newStaleEntry("max-age=60", 2*time.Minute)},
+	}
+	proxy := NewProxy("test", failingUpstream, store, true)
+	defer proxy.Close()
+	logs := make(chan *LogEntry, 1)
+	proxy.logger = logs
+
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, req)
+	c.Check(w.Code, Equals, http.StatusBadGateway)
+	log := <-logs
+	c.Check(log.CacheResult, Equals, "REVALIDATE,ERROR")
+}
+
+type fixedCache struct {
+	cache.NullCache
+	entries []*cache.Entry
+}
+
+func (f *fixedCache) Retrieve(*http.Request) []*cache.Entry {
+	return f.entries
+}
+
+func (s *MySuite) TestDroppedEntry(c *C) {
+	var conditional []bool
+	upstream := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		isConditional := req.Header.Get("If-None-Match") != ""
+		conditional = append(conditional, isConditional)
+		if isConditional {
+			return staticUpstream(http.StatusNotModified, "").RoundTrip(req)
+		}
+		return staticUpstream(200, "fresh").RoundTrip(req)
+	})
+	entry := newStaleEntry("max-age=60", 48*time.Hour)
+	entry.Dropped = true
+	entry.GetBody = func() io.ReadCloser { return nil }
+	store := &fixedCache{entries: []*cache.Entry{entry}}
+	proxy := NewProxy("test", upstream, store, true)
+	defer proxy.Close()
+
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, req)
+	c.Assert(w.Body.String(), Equals, "fresh")
+	c.Assert(conditional, DeepEquals, []bool{false})
+}
+
+func (s *MySuite) TestRequestDirectives(c *C) {
+	store := &fixedCache{}
+	proxy := NewProxy("test", staticUpstream(200, "fresh"), store, true)
+	defer proxy.Close()
+
+	get := func(cc string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "http://example.com/", nil)
+		req.Header.Set("Cache-Control", cc)
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, req)
+		return w
+	}
+
+	w := get("only-if-cached")
+	c.Assert(w.Code, Equals, http.StatusGatewayTimeout)
+
+	store.entries = []*cache.Entry{newStaleEntry("max-age=60", 2*time.Minute)}
+	w = get("only-if-cached")
+	c.Assert(w.Code, Equals, http.StatusGatewayTimeout)
+
+	w = get("only-if-cached, max-stale=300")
+	c.Assert(w.Code, Equals, http.StatusOK)
+	c.Assert(w.Body.String(), Equals, "stale")
+	c.Assert(w.Header()["Warning"], DeepEquals,
+		[]string{"110 test \"Response is Stale\""})
+
+	w = get("max-stale=30")
+	c.Assert(w.Body.String(), Equals, "fresh")
+
+	store.entries = []*cache.Entry{newStaleEntry("max-age=600", 2*time.Minute)}
+	w = get("only-if-cached")
+	c.Assert(w.Body.String(), Equals, "stale")
+	c.Assert(w.Header()["Warning"], HasLen, 0)
+
+	w = get("max-age=60")
+	c.Assert(w.Body.String(), Equals, "fresh")
+}
+
+func (s *MySuite) TestCachedCopy(c *C) {
+	proxy := NewProxy("test", failingUpstream, &cache.NullCache{}, true)
+	defer proxy.Close()
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+
+	entry := newStaleEntry("max-age=3600", 10*time.Minute)
+	entry.Header.Set("Age", "5")
+	entry.Header.Add("Warning", "110 other \"Response is Stale\"")
+	entry.Header.Add("Warning", "299 other \"Something\"")
+	res := proxy.cachedCopy(req, entry)
+	c.Assert(res.Header.Get("Age"), Equals, "605")
+	c.Assert(res.Header["Warning"], DeepEquals,
+		[]string{"299 other \"Something\""})
+	c.Assert(entry.Header.Get("Age"), Equals, "5")
+	c.Assert(entry.Header["Warning"], HasLen, 2)
+
+	res = proxy.cachedCopy(req, newStaleEntry("max-age=60", 10*time.Minute))
+	c.Assert(res.Header["Warning"], DeepEquals, []string{
+		"110 test \"Response is Stale\"",
+	})
+}
+
+func (s *MySuite) TestRevalidationWarnings(c *C) {
+	upstream := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		h := http.Header{}
+		h.Set("Etag", "\"x\"")
+		h.Set("Cache-Control", "max-age=3600")
+		h.Add("Warning", "110 other \"Response is Stale\"")
+		h.Add("Warning", "214 other \"Transformation Applied\"")
+		return &http.Response{
+			StatusCode: http.StatusNotModified,
+			Proto:      "HTTP/1.1",
+			Header:     h,
+			Body:       ioutil.NopCloser(strings.NewReader("")),
+			Request:    req,
+		}, nil
+	})
+	proxy := NewProxy("test", upstream, &cache.NullCache{}, true)
+	defer proxy.Close()
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+
+	entry := newStaleEntry("max-age=60", 2*time.Minute)
+	entry.Header.Add("Warning", "113 other \"Heuristic Expiration\"")
+	entry.Header.Add("Warning", "299 other \"Something\"")
+	res := proxy.requestFromUpstream(req, []*cache.Entry{entry})
+	c.Assert(res, NotNil)
+	c.Assert(res.Header["Warning"], DeepEquals, []string{
+		"299 other \"Something\"",
+		"214 other \"Transformation Applied\"",
+	})
+	// the entry obtained from the cache is not modified
+	c.Assert(entry.Header["Warning"], HasLen, 2)
+	c.Assert(entry.Header.Get("Cache-Control"), Equals, "max-age=60")
+}
+
+func (s *MySuite) TestStoredMetaData(c *C) {
+	meta := &cache.MetaData{
+		StatusCode: 200,
+		Header:     http.Header{},
+	}
+	meta.Header.Set("Cache-Control", "max-age=60, no-cache=\"Set-Cookie, X-A\", private=\"X-B\"")
+	meta.Header.Set("Set-Cookie", "a=b")
+	meta.Header.Set("X-A", "a")
+	meta.Header.Set("X-B", "b")
+	meta.Header.Set("X-C", "c")
+
+	shared := NewProxy("test", failingUpstream, &cache.NullCache{}, true)
+	defer shared.Close()
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	stored := shared.storedMetaData(req, meta)
+	c.Check(stored.Header.Get("Set-Cookie"), Equals, "")
+	c.Check(stored.Header.Get("X-A"), Equals, "")
+	c.Check(stored.Header.Get("X-B"), Equals, "")
+	c.Check(stored.Header.Get("X-C"), Equals, "c")
+	c.Check(meta.Header.Get("Set-Cookie"), Equals, "a=b")
+
+	private := NewProxy("test", failingUpstream, &cache.NullCache{}, false)
+	defer private.Close()
+	stored = private.storedMetaData(req, meta)
+	c.Check(stored.Header.Get("X-A"), Equals, "")
+	c.Check(stored.Header.Get("X-B"), Equals, "b")
+
+	resp := &cache.Entry{MetaData: *meta}
+	info := shared.getCacheability(req)
+	shared.updateCacheability(resp, info)
+	c.Check(info.canStore, Equals, true)
+	resp.Header.Set("Cache-Control", "max-age=60, private")
+	info = shared.getCacheability(req)
+	shared.updateCacheability(resp, info)
+	c.Check(info.canStore, Equals, false)
+}
+
+func (s *MySuite) TestMemoryCacheHit(c *C) {
+	var count int
+	upstream := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		count++
+		h := http.Header{}
+		h.Set("Cache-Control", "max-age=3600")
+		h.Set("Etag", "\"x\"")
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Proto:      "HTTP/1.1",
+			Header:     h,
+			Body:       ioutil.NopCloser(strings.NewReader("0123456789")),
+			Request:    req,
+		}, nil
+	})
+	proxy := NewProxy("test", upstream, cache.NewMemoryCache(1<<20), true)
+	defer proxy.Close()
+
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, req)
+	c.Assert(w.Body.String(), Equals, "0123456789")
+
+	w = httptest.NewRecorder()
+	proxy.ServeHTTP(w, req)
+	c.Assert(w.Body.String(), Equals, "0123456789")
+	c.Assert(w.Header().Get("Age"), Equals, "0")
+
+	req.Header.Set("Range", "bytes=2-4")
+	w = httptest.NewRecorder()
+	proxy.ServeHTTP(w, req)
+	c.Assert(w.Code, Equals, http.StatusPartialContent)
+	c.Assert(w.Body.String(), Equals, "234")
+
+	c.Assert(count, Equals, 1)
+}
+
+func (s *MySuite) TestCorruptHit(c *C) {
+	entry := newStaleEntry("max-age=60", 0)
+	entry.GetBody = func() io.ReadCloser {
+		return ioutil.NopCloser(io.MultiReader(strings.NewReader("sta"),
+			iotest.ErrReader(cache.ErrCorrupt)))
+	}
+	store := &fixedCache{entries: []*cache.Entry{entry}}
+	proxy := NewProxy("test", staticUpstream(200, "fresh"), store, true)
+	defer proxy.Close()
+
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	w := httptest.NewRecorder()
+	c.Assert(func() { proxy.ServeHTTP(w, req) }, Panics, http.ErrAbortHandler)
+	c.Assert(w.Body.String(), Equals, "sta")
+}
+
+func (s *MySuite) TestEncodedHit(c *C) {
+	text := "hello, hello, hello, hello"
+	buf := &bytes.Buffer{}
+	zw := gzip.NewWriter(buf)
+	zw.Write([]byte(text))
+	zw.Close()
+	zipped := buf.Bytes()
+
+	entry := newStaleEntry("max-age=60", 0)
+	entry.Encoding = "gzip"
+	entry.GetBody = func() io.ReadCloser {
+		return ioutil.NopCloser(strings.NewReader(text))
+	}
+	entry.GetEncodedBody = func() io.ReadCloser {
+		return ioutil.NopCloser(bytes.NewReader(zipped))
+	}
+	store := &fixedCache{entries: []*cache.Entry{entry}}
+	proxy := NewProxy("test", failingUpstream, store, true)
+	defer proxy.Close()
+
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	req.Header.Set("Accept-Encoding", "deflate, gzip;q=0.5")
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, req)
+	c.Assert(w.Code, Equals, http.StatusOK)
+	c.Check(w.Header().Get("Content-Encoding"), Equals, "gzip")
+	c.Check(w.Header().Get("Vary"), Equals, "Accept-Encoding")
+	c.Check(w.Header()["Warning"], DeepEquals,
+		[]string{"214 test \"Transformation Applied\""})
+	c.Check(w.Body.Bytes(), DeepEquals, zipped)
+	c.Check(w.Header().Get("Etag"), Equals, "\"x-jv-gzip\"")
+	c.Check(entry.Header.Get("Content-Encoding"), Equals, "")
+	c.Check(entry.Header.Get("Etag"), Equals, "\"x\"")
+
+	for _, ae := range []string{"", "identity", "gzip;q=0", "*;q=0"} {
+		req.Header.Set("Accept-Encoding", ae)
+		w = httptest.NewRecorder()
+		proxy.ServeHTTP(w, req)
+		c.Check(w.Header().Get("Content-Encoding"), Equals, "")
+		c.Check(w.Header().Get("Etag"), Equals, "\"x\"")
+		c.Check(w.Body.String(), Equals, text)
+	}
+
+	// no-transform forbids sending the compressed bytes
+	entry.Header.Set("Cache-Control", "max-age=60, no-transform")
+	req.Header.Set("Accept-Encoding", "gzip")
+	w = httptest.NewRecorder()
+	proxy.ServeHTTP(w, req)
+	c.Check(w.Header().Get("Content-Encoding"), Equals, "")
+	c.Check(w.Body.String(), Equals, text)
+}
+
+func (s *MySuite) TestEncodedETag(c *C) {
+	var upHeader http.Header
+	upstream := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		upHeader = req.Header
+		return staticUpstream(http.StatusNotModified, "").RoundTrip(req)
+	})
+	proxy := NewProxy("test", upstream, &cache.NullCache{}, true)
+	defer proxy.Close()
+
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	req.Header.Set("If-None-Match", "\"x-jv-gzip\", W/\"y\", \"z-jv-unknown\"")
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, req)
+	c.Check(w.Code, Equals, http.StatusNotModified)
+	c.Assert(upHeader, NotNil)
+	c.Check(upHeader["If-None-Match"], DeepEquals,
+		[]string{"\"x\", W/\"y\", \"z-jv-unknown\""})
+	c.Check(req.Header.Get("If-None-Match"), Equals,
+		"\"x-jv-gzip\", W/\"y\", \"z-jv-unknown\"")
+}
+
+func (s *MySuite) TestVaryAcceptEncoding(c *C) {
+	var count int
+	upstream := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		count++
+		h := http.Header{}
+		h.Set("Cache-Control", "max-age=3600")
+		h.Set("Vary", "Accept-Encoding")
+		body := "plain"
+		if acceptsEncoding(req.Header, "gzip") {
+			h.Set("Content-Encoding", "gzip")
+			body = "compressed"
+		}
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Proto:      "HTTP/1.1",
+			Header:     h,
+			Body:       ioutil.NopCloser(strings.NewReader(body)),
+			Request:    req,
+		}, nil
+	})
+	proxy := NewProxy("test", upstream, cache.NewMemoryCache(1<<20), true)
+	defer proxy.Close()
+
+	get := func(acceptEncoding string) string {
+		req, _ := http.NewRequest("GET", "http://example.com/", nil)
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, req)
+		return w.Body.String()
+	}
+	c.Check(get("gzip, deflate, br"), Equals, "compressed")
+	c.Check(get("gzip, br"), Equals, "compressed")
+	c.Check(get("br;q=1.0, gzip;q=0.8"), Equals, "compressed")
+	c.Check(count, Equals, 1)
+	c.Check(get("identity"), Equals, "plain")
+	c.Check(get("br"), Equals, "plain")
+	c.Check(count, Equals, 2)
+}
@@ -0,0 +1,92 @@
+package jvproxy
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/seehuhn/httputil"
+	"github.com/seehuhn/jvproxy/cache"
+)
+
+// contentRange describes the Content-Range header field of a 206
+// (Partial Content) response.  The byte positions `start` and `end`
+// are inclusive, as in the header field.
+type contentRange struct {
+	start, end, total int64
+}
+
+// parseContentRange parses a Content-Range header field of the form
+// "bytes first-last/complete-length" (RFC 7233, section 4.2).
+// Responses where the complete length is unknown are not accepted,
+// since these cannot be combined into a complete response.
+func parseContentRange(s string) (*contentRange, bool) {
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(s, "bytes ") {
+		return nil, false
+	}
+	s = strings.TrimSpace(s[6:])
+	slash := strings.IndexByte(s, '/')
+	dash := strings.IndexByte(s, '-')
+	if slash < 0 || dash < 0 || dash > slash {
+		return nil, false
+	}
+	start, err1 := strconv.ParseInt(s[:dash], 10, 64)
+	end, err2 := strconv.ParseInt(s[dash+1:slash], 10, 64)
+	total, err3 := strconv.ParseInt(s[slash+1:], 10, 64)
+	if err1 != nil || err2 != nil || err3 != nil ||
+		start < 0 || end < start || total <= end {
+		return nil, false
+	}
+	return &contentRange{start, end, total}, true
+}
+
+// completeMetaData converts the metadata of a 206 (Partial Content)
+// response into the metadata of the corresponding complete response.
+func completeMetaData(resp *cache.Entry, total int64) *cache.MetaData {
+	res := resp.MetaData
+	res.StatusCode = http.StatusOK
+	res.Header = make(http.Header)
+	copyHeader(res.Header, resp.Header)
+	res.Header.Del("Content-Range")
+	res.Header.Set("Content-Length", strconv.FormatInt(total, 10))
+	return &res
+}
+
+// serveRange answers a range request from the complete, cached body
+// `content`.  This handles single and multiple ranges, as well as the
+// If-Range header field.  The return values are the status code and
+// the number of bytes written.
+func serveRange(w http.ResponseWriter, req *http.Request, resp *cache.Entry, content io.ReadSeeker) (int, int64) {
+	h := w.Header()
+	copyHeader(h, resp.Header)
+	h.Del("Content-Length")
+
+	modTime := httputil.ParseDate(resp.Header.Get("Last-Modified"))
+	cw := &countingWriter{ResponseWriter: w}
+	http.ServeContent(cw, req, "", modTime, content)
+	return cw.status, cw.n
+}
+
+// countingWriter records the status code and the number of bytes
+// written to a http.ResponseWriter.
+type countingWriter struct {
+	http.ResponseWriter
+	status int
+	n      int64
+}
+
+func (w *countingWriter) WriteHeader(code int) {
+	w.status = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,87 @@
+package jvproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"github.com/seehuhn/jvproxy/cache"
+	. "gopkg.in/check.v1"
+)
+
+func (s *MySuite) TestParseContentRange(c *C) {
+	cr, ok := parseContentRange("bytes 0-499/1234")
+	c.Assert(ok, Equals, true)
+	c.Assert(*cr, Equals, contentRange{0, 499, 1234})
+
+	for _, bad := range []string{"", "bytes 0-499/*", "bytes */1234",
+		"items 0-1/2", "bytes 5-4/10", "bytes 0-10/10"} {
+		_, ok = parseContentRange(bad)
+		c.Assert(ok, Equals, false, Commentf("%q", bad))
+	}
+}
+
+func (s *MySuite) TestPartialCacheability(c *C) {
+	proxy := NewProxy("test", nil, &cache.NullCache{}, true)
+	defer proxy.Close()
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+
+	resp := &cache.Entry{
+		MetaData: cache.MetaData{
+			StatusCode: http.StatusPartialContent,
+			Header:     http.Header{},
+		},
+	}
+	resp.Header.Set("Content-Range", "bytes 10-19/100")
+	info := proxy.getCacheability(req)
+	proxy.updateCacheability(resp, info)
+	c.Assert(info.canStore, Equals, false)
+
+	resp.Header.Set("Etag", "\"strong\"")
+	info = proxy.getCacheability(req)
+	proxy.updateCacheability(resp, info)
+	c.Assert(info.canStore, Equals, true)
+	c.Assert(*info.partial, Equals, contentRange{10, 19, 100})
+
+	meta := completeMetaData(resp, 100)
+	c.Assert(meta.StatusCode, Equals, http.StatusOK)
+	c.Assert(meta.Header.Get("Content-Range"), Equals, "")
+	c.Assert(meta.Header.Get("Content-Length"), Equals, "100")
+	c.Assert(resp.Header.Get("Content-Range"), Not(Equals), "")
+}
+
+func (s *MySuite) TestServeRange(c *C) {
+	body := "0123456789"
+	resp := &cache.Entry{
+		MetaData: cache.MetaData{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{},
+		},
+	}
+	resp.Header.Set("Content-Type", "text/plain")
+	resp.Header.Set("Content-Length", "10")
+	resp.Header.Set("Etag", "\"x\"")
+
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	req.Header.Set("Range", "bytes=2-4")
+	w := httptest.NewRecorder()
+	code, n := serveRange(w, req, resp, strings.NewReader(body))
+	c.Assert(code, Equals, http.StatusPartialContent)
+	c.Assert(n, Equals, int64(3))
+	c.Assert(w.Body.String(), Equals, "234")
+	c.Assert(w.Header().Get("Content-Range"), Equals, "bytes 2-4/10")
+
+	req.Header.Set("Range", "bytes=0-1,8-")
+	w = httptest.NewRecorder()
+	code, _ = serveRange(w, req, resp, strings.NewReader(body))
+	c.Assert(code, Equals, http.StatusPartialContent)
+	c.Assert(strings.HasPrefix(w.Header().Get("Content-Type"),
+		"multipart/byteranges"), Equals, true)
+
+	req.Header.Set("Range", "bytes=2-4")
+	req.Header.Set("If-Range", "\"other\"")
+	w = httptest.NewRecorder()
+	code, n = serveRange(w, req, resp, strings.NewReader(body))
+	c.Assert(code, Equals, http.StatusOK)
+	c.Assert(n, Equals, int64(10))
+}
@@ -0,0 +1,188 @@
+package jvproxy
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/seehuhn/jvproxy/cache"
+	"github.com/seehuhn/trace"
+)
+
+const (
+	backgroundWorkers   = 4
+	backgroundQueueSize = 64
+)
+
+// clientOnlyHeaders are request header fields which ask for part of a
+// response, or which make the request conditional on the client's own
+// copy.  These are removed from background validation requests, since
+// the response is obtained for the cache and not for the client.
+var clientOnlyHeaders = []string{
+	"Range",
+	"If-Range",
+	"If-Match",
+	"If-None-Match",
+	"If-Modified-Since",
+	"If-Unmodified-Since",
+}
+
+type revalidateJob struct {
+	key     string
+	variant string
+	req     *http.Request
+	stale   []*cache.Entry
+}
+
+// A revalidator runs validation requests for stale cache entries in
+// the background, using a fixed number of worker goroutines.  This is
+// used to implement the stale-while-revalidate directive from RFC
+// 5861.
+type revalidator struct {
+	proxy *Proxy
+	jobs  chan *revalidateJob
+	wait  sync.WaitGroup
+
+	mutex   sync.Mutex
+	pending map[string]bool
+	closed  bool
+}
+
+func newRevalidator(proxy *Proxy, workers, queueSize int) *revalidator {
+	res := &revalidator{
+		proxy:   proxy,
+		jobs:    make(chan *revalidateJob, queueSize),
+		pending: make(map[string]bool),
+	}
+	for i := 0; i < workers; i++ {
+		res.wait.Add(1)
+		go res.worker()
+	}
+	return res
+}
+
+// Submit schedules a background revalidation of the `stale` responses
+// for `req`.  If a revalidation for the same variant of the response
+// is already pending, no new request is scheduled.  The return value
+// indicates whether the caller can rely on the cache being updated in
+// the background; if the job queue is full, false is returned and the
+// caller must revalidate synchronously.
+func (r *revalidator) Submit(req *http.Request, stale []*cache.Entry) bool {
+	key := r.proxy.CacheKey(req)
+	variant := r.variantKey(key, req, stale)
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.closed {
+		return false
+	}
+	if r.pending[variant] {
+		return true
+	}
+
+	// The client request is cancelled once the handler returns, so we
+	// need a copy which is independent of the client connection.
+	jobReq := req.Clone(context.Background())
+	for _, name := range clientOnlyHeaders {
+		jobReq.Header.Del(name)
+	}
+	job := &revalidateJob{
+		key:     key,
+		variant: variant,
+		req:     jobReq,
+		stale:   stale,
+	}
+	select {
+	case r.jobs <- job:
+		r.pending[variant] = true
+		return true
+	default:
+		return false
+	}
+}
+
+// variantKey identifies the variant of the stored response which is
+// selected for `req`, by the cache key and the normalized values of the
+// request header fields nominated by the Vary header field.  Requests
+// with the same variant key share a background revalidation.
+func (r *revalidator) variantKey(key string, req *http.Request, stale []*cache.Entry) string {
+	if len(stale) == 0 {
+		return key
+	}
+	values := r.proxy.VaryNormalizers.Values(stale[0].Header, req.Header)
+	return strings.Join(append([]string{key}, values...), "\x00")
+}
+
+// Close stops accepting new jobs and waits until all pending
+// revalidation requests have completed.
+func (r *revalidator) Close() {
+	r.mutex.Lock()
+	if r.closed {
+		r.mutex.Unlock()
+		return
+	}
+	r.closed = true
+	close(r.jobs)
+	r.mutex.Unlock()
+
+	r.wait.Wait()
+}
+
+func (r *revalidator) worker() {
+	defer r.wait.Done()
+	for job := range r.jobs {
+		r.revalidate(job)
+
+		r.mutex.Lock()
+		delete(r.pending, job.variant)
+		r.mutex.Unlock()
+	}
+}
+
+func (r *revalidator) revalidate(job *revalidateJob) {
+	proxy := r.proxy
+	trace.T("jvproxy/background", trace.PrioDebug,
+		"revalidating %s", job.key)
+
+	// If the server answers with 304 (Not Modified), the stored
+	// responses are updated inside .requestFromUpstream().  Stale
+	// responses returned after errors are ignored here.
+	resp := proxy.requestFromUpstream(job.req, job.stale)
+	if resp == nil || resp.Source != "upstream" {
+		return
+	}
+
+	body := resp.GetBody()
+	defer body.Close()
+
+	cacheInfo := proxy.getCacheability(job.req)
+	proxy.updateCacheability(resp, cacheInfo)
+	if !cacheInfo.canStore {
+		trace.T("jvproxy/background", trace.PrioDebug,
+			"new response for %s cannot be stored: %v",
+			job.key, cacheInfo.log)
+		return
+	}
+
+	var entry cache.StoreCont
+	if part := cacheInfo.partial; part != nil {
+		meta := completeMetaData(resp, part.total)
+		entry = proxy.cache.StorePartial(job.key,
+			proxy.storedMetaData(job.req, meta), part.start, part.total)
+	} else {
+		entry = proxy.cache.StoreStart(job.key,
+			proxy.storedMetaData(job.req, &resp.MetaData))
+	}
+	n, err := io.Copy(ioutil.Discard, entry.Reader(body))
+	if err != nil {
+		trace.T("jvproxy/background", trace.PrioInfo,
+			"error while reading response for %s: %s",
+			job.key, err.Error())
+		entry.Discard()
+		return
+	}
+	entry.Commit(n)
+}
@@ -0,0 +1,206 @@
+package jvproxy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/seehuhn/jvproxy/cache"
+	. "gopkg.in/check.v1"
+)
+
+func (s *MySuite) TestStaleWhileRevalidate(c *C) {
+	proxy := NewProxy("test", failingUpstream, &cache.NullCache{}, true)
+	defer proxy.Close()
+
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	info := proxy.getCacheability(req)
+	entry := newStaleEntry("max-age=60, stale-while-revalidate=600", 2*time.Minute)
+	c.Assert(proxy.canServeStaleWhileRevalidate(req, entry, info), Equals, true)
+	entry = newStaleEntry("max-age=60, stale-while-revalidate=30", 2*time.Minute)
+	c.Assert(proxy.canServeStaleWhileRevalidate(req, entry, info), Equals, false)
+	entry = newStaleEntry("max-age=60", 2*time.Minute)
+	c.Assert(proxy.canServeStaleWhileRevalidate(req, entry, info), Equals, false)
+
+	// request directives take precedence
+	entry = newStaleEntry("max-age=60, stale-while-revalidate=600", 2*time.Minute)
+	for _, cc := range []string{"max-age=0", "min-fresh=10", "no-cache"} {
+		req.Header.Set("Cache-Control", cc)
+		info = proxy.getCacheability(req)
+		c.Check(proxy.canServeStaleWhileRevalidate(req, entry, info), Equals, false,
+			Commentf("%s", cc))
+	}
+}
+
+func (s *MySuite) TestStaleWhileRevalidateMaxAge(c *C) {
+	count := 0
+	upstream := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		count++
+		return staticUpstream(200, "fresh").RoundTrip(req)
+	})
+	store := &fixedCache{
+		entries: []*cache.Entry{
+			newStaleEntry("max-age=60, stale-while-revalidate=600", 2*time.Minute),
+		},
+	}
+	proxy := NewProxy("test", upstream, store, true)
+
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	req.Header.Set("Cache-Control", "max-age=0")
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, req)
+	proxy.Close()
+
+	c.Check(w.Body.String(), Equals, "fresh")
+	c.Check(count, Equals, 1)
+}
+
+func (s *MySuite) TestBackgroundDuplicates(c *C) {
+	var mutex sync.Mutex
+	count := 0
+	release := make(chan struct{})
+	upstream := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		mutex.Lock()
+		count++
+		mutex.Unlock()
+		<-release
+		return &http.Response{
+			StatusCode: http.StatusNotModified,
+			Proto:      "HTTP/1.1",
+			Header:     http.Header{},
+			Body:       ioutil.NopCloser(strings.NewReader("")),
+			Request:    req,
+		}, nil
+	})
+	proxy := NewProxy("test", upstream, &cache.NullCache{}, true)
+
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	stale := []*cache.Entry{newStaleEntry("max-age=60", 2*time.Minute)}
+	for i := 0; i < 10; i++ {
+		c.Assert(proxy.background.Submit(req, stale), Equals, true)
+	}
+	close(release)
+	proxy.Close()
+
+	c.Assert(count, Equals, 1)
+	c.Assert(proxy.background.Submit(req, stale), Equals, false)
+}
+
+func (s *MySuite) TestBackgroundVariants(c *C) {
+	var mutex sync.Mutex
+	var languages []string
+	release := make(chan struct{})
+	upstream := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		mutex.Lock()
+		languages = append(languages, req.Header.Get("Accept-Language"))
+		mutex.Unlock()
+		<-release
+		return staticUpstream(http.StatusNotModified, "").RoundTrip(req)
+	})
+	proxy := NewProxy("test", upstream, &cache.NullCache{}, true)
+
+	entry := newStaleEntry("max-age=60", 2*time.Minute)
+	entry.Header.Set("Vary", "Accept-Language")
+	stale := []*cache.Entry{entry}
+	for _, lang := range []string{"en", "de", "en", "de"} {
+		req, _ := http.NewRequest("GET", "http://example.com/", nil)
+		req.Header.Set("Accept-Language", lang)
+		c.Assert(proxy.background.Submit(req, stale), Equals, true)
+	}
+	close(release)
+	proxy.Close()
+
+	sort.Strings(languages)
+	c.Check(languages, DeepEquals, []string{"de", "en"})
+}
+
+// TestBackgroundUpdate serves stale responses while the background
+// revalidation applies 304 (Not Modified) responses.  Run with -race
+// to check that the stored responses are not modified concurrently.
+func (s *MySuite) TestBackgroundUpdate(c *C) {
+	upstream := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		resp, err := staticUpstream(http.StatusNotModified, "").RoundTrip(req)
+		if err == nil {
+			resp.Header.Set("X-Updated", "yes")
+			resp.Header.Add("Warning", "199 - \"updated\"")
+		}
+		return resp, err
+	})
+	entry := newStaleEntry("max-age=60, stale-while-revalidate=600", 2*time.Minute)
+	entry.Header.Add("Warning", "110 - \"Response is Stale\"")
+	store := &fixedCache{entries: []*cache.Entry{entry}}
+	proxy := NewProxy("test", upstream, store, true)
+
+	for i := 0; i < 50; i++ {
+		req, _ := http.NewRequest("GET", "http://example.com/", nil)
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, req)
+		c.Assert(w.Body.String(), Equals, "stale")
+	}
+	proxy.Close()
+
+	// the entries obtained from the cache are left unchanged
+	c.Check(entry.Header.Get("X-Updated"), Equals, "")
+	c.Check(entry.Header["Warning"], HasLen, 1)
+}
+
+// storeRecorder is a cache which serves fixed entries and records
+// which responses are stored.
+type storeRecorder struct {
+	fixedCache
+	stores []string
+}
+
+func (r *storeRecorder) StoreStart(url string, meta *cache.MetaData) cache.StoreCont {
+	r.stores = append(r.stores, fmt.Sprintf("%d", meta.StatusCode))
+	return r.fixedCache.StoreStart(url, meta)
+}
+
+func (r *storeRecorder) StorePartial(url string, meta *cache.MetaData, offset, total int64) cache.StoreCont {
+	r.stores = append(r.stores, fmt.Sprintf("%d %d/%d", meta.StatusCode, offset, total))
+	return r.fixedCache.StorePartial(url, meta, offset, total)
+}
+
+func (s *MySuite) TestBackgroundRange(c *C) {
+	var upHeader http.Header
+	upstream := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		upHeader = req.Header
+		// The server ignores the missing Range header field and
+		// sends part of the body anyway.
+		h := http.Header{}
+		h.Set("Etag", "\"y\"")
+		h.Set("Cache-Control", "max-age=60")
+		h.Set("Content-Range", "bytes 0-1/5")
+		return &http.Response{
+			StatusCode: http.StatusPartialContent,
+			Proto:      "HTTP/1.1",
+			Header:     h,
+			Body:       ioutil.NopCloser(strings.NewReader("ne")),
+			Request:    req,
+		}, nil
+	})
+	entry := newStaleEntry("max-age=60, stale-while-revalidate=600", 2*time.Minute)
+	store := &storeRecorder{}
+	store.entries = []*cache.Entry{entry}
+	proxy := NewProxy("test", upstream, store, true)
+
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	req.Header.Set("Range", "bytes=0-1")
+	req.Header.Set("If-Range", "\"x\"")
+	req.Header.Set("If-Modified-Since", time.Now().Format(time.RFC1123))
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, req)
+	proxy.Close()
+
+	c.Assert(upHeader, NotNil)
+	c.Check(upHeader.Get("Range"), Equals, "")
+	c.Check(upHeader.Get("If-Range"), Equals, "")
+	c.Check(upHeader.Get("If-Modified-Since"), Equals, "")
+	c.Check(upHeader["If-None-Match"], DeepEquals, []string{"\"x\""})
+	c.Check(store.stores, DeepEquals, []string{"200 0/5"})
+}
@@ -0,0 +1,162 @@
+package lib
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/seehuhn/jvproxy/tester/test"
+)
+
+// hasWarning checks whether `header` contains a Warning header field
+// with the given warn-code.  If `agent` is non-empty, only warnings
+// generated by this agent are considered.
+func hasWarning(header http.Header, code int, agent string) bool {
+	prefix := strconv.Itoa(code) + " "
+	for _, warn := range header["Warning"] {
+		warn = strings.TrimSpace(warn)
+		if !strings.HasPrefix(warn, prefix) {
+			continue
+		}
+		if agent == "" || strings.HasPrefix(warn[len(prefix):], agent+" ") {
+			return true
+		}
+	}
+	return false
+}
+
+// AgeHeader verifies that responses served from the cache carry an
+// Age header field which reflects the time since the response was
+// generated by the origin server.
+func AgeHeader(h test.Helper, _ ...interface{}) {
+	h.SetInfo("", "7234-4.2.3")
+
+	date := time.Now().Add(-time.Hour)
+
+	req := h.NewRequest("GET")
+	header, _ := h.SendRequestToServer(req)
+	header.Set("Date", date.Format(time.RFC1123))
+	header.Set("Cache-Control", "public, max-age=86400")
+	header.Set("Age", "10")
+	h.SendResponseToClient(http.StatusOK, nil)
+
+	req = h.NewRequest("GET")
+	_, req = h.SendRequestToServer(req)
+	if req != nil {
+		h.Pass("proxy sent new upstream request (no caching?)")
+	}
+	header = h.SendResponseToClient(http.StatusOK, nil)
+	age, err := strconv.Atoi(header.Get("Age"))
+	if err != nil {
+		h.Fail("invalid Age header %q", header.Get("Age"))
+	}
+	if age < 3600 || age > 3700 {
+		h.Fail("wrong Age header %d, expected approximately 3600", age)
+	}
+}
+
+// StaleWarning verifies that a stale response, served because the
+// client allowed this using max-stale, carries Warning 110.
+func StaleWarning(h test.Helper, _ ...interface{}) {
+	h.SetInfo("", "7234-5.5.1")
+
+	date := time.Now().Add(-time.Hour)
+
+	req := h.NewRequest("GET")
+	header, _ := h.SendRequestToServer(req)
+	header.Set("Date", date.Format(time.RFC1123))
+	header.Set("Cache-Control", "public, max-age=60")
+	h.SendResponseToClient(http.StatusOK, nil)
+
+	req = h.NewRequest("GET")
+	req.Header.Set("Cache-Control", "max-stale=86400")
+	_, req = h.SendRequestToServer(req)
+	if req != nil {
+		h.Pass("proxy sent new upstream request (max-stale ignored?)")
+	}
+	header = h.SendResponseToClient(http.StatusOK, nil)
+	if !hasWarning(header, 110, "") {
+		h.Fail("stale response without Warning 110")
+	}
+	if header.Get("Age") == "" {
+		h.Fail("stale response without Age header")
+	}
+}
+
+// WarningUpdate verifies that after successful validation, warnings
+// with warn-code 1xx are removed from the stored response, while
+// warnings with warn-code 2xx are kept.
+func WarningUpdate(h test.Helper, _ ...interface{}) {
+	h.SetInfo("", "7234-4.3.4")
+
+	eTag := "\"" + test.RandomString(16) + "\""
+	now := time.Now()
+
+	req := h.NewRequest("GET")
+	header, _ := h.SendRequestToServer(req)
+	header.Set("Cache-Control", "public")
+	header.Set("Etag", eTag)
+	header.Set("Expires", now.Add(-time.Minute).Format(time.RFC1123))
+	header.Add("Warning", "110 upstream \"Response is Stale\"")
+	header.Add("Warning", "214 upstream \"Transformation Applied\"")
+	h.SendResponseToClient(http.StatusOK, nil)
+
+	req = h.NewRequest("GET")
+	header, req = h.SendRequestToServer(req)
+	if req == nil {
+		h.Fail("proxy did not revalidate a stale response")
+	}
+	if req.Header.Get("If-None-Match") != eTag {
+		h.Pass("proxy sent new upstream request (no validation?)")
+	}
+	header.Set("Etag", eTag)
+	header.Set("Expires", now.Add(time.Hour).Format(time.RFC1123))
+	header = h.SendResponseToClient(http.StatusNotModified, nil)
+	if hasWarning(header, 110, "upstream") {
+		h.Fail("Warning 110 not removed after validation")
+	}
+	if !hasWarning(header, 214, "upstream") {
+		h.Fail("Warning 214 not kept after validation")
+	}
+	if header.Get("Age") == "" {
+		h.Fail("revalidated response without Age header")
+	}
+
+	req = h.NewRequest("GET")
+	_, req = h.SendRequestToServer(req)
+	if req != nil {
+		h.Fail("proxy did not use the revalidated response")
+	}
+	header = h.SendResponseToClient(http.StatusOK, nil)
+	if hasWarning(header, 110, "") {
+		h.Fail("fresh response with Warning 110")
+	}
+	if !hasWarning(header, 214, "upstream") {
+		h.Fail("Warning 214 missing from the stored response")
+	}
+}
+
+// HeuristicWarning verifies that Warning 113 is added, when a response
+// with heuristic freshness lifetime is more than 24 hours old.
+func HeuristicWarning(h test.Helper, _ ...interface{}) {
+	h.SetInfo("", "7234-4.2.2")
+
+	now := time.Now()
+
+	req := h.NewRequest("GET")
+	header, _ := h.SendRequestToServer(req)
+	header.Set("Date", now.Add(-48*time.Hour).Format(time.RFC1123))
+	header.Set("Last-Modified", now.Add(-100*24*time.Hour).Format(time.RFC1123))
+	h.SendResponseToClient(http.StatusOK, nil)
+
+	req = h.NewRequest("GET")
+	_, req = h.SendRequestToServer(req)
+	if req != nil {
+		h.Pass("proxy sent new upstream request (no heuristic freshness?)")
+	}
+	header = h.SendResponseToClient(http.StatusOK, nil)
+	if !hasWarning(header, 113, "") {
+		h.Fail("Warning 113 missing")
+	}
+}
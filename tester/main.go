@@ -84,4 +84,10 @@ func main() {
 	// tests relating to validation of stale responses
 	testRunner.Run(lib.HasValidate)
 	testRunner.Run(lib.CacheUpdate)
+
+	// tests relating to the Age and Warning header fields
+	testRunner.Run(lib.AgeHeader)
+	testRunner.Run(lib.StaleWarning)
+	testRunner.Run(lib.WarningUpdate)
+	testRunner.Run(lib.HeuristicWarning)
 }